@@ -19,7 +19,7 @@ require (
 	github.com/jose-joye/osb-broker-k8s-lib v0.0.4 // indirect
 	github.com/juju/ratelimit v0.0.0-20171026090426-59fac5042749 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
-	github.com/lib/pq v1.2.0 // indirect
+	github.com/lib/pq v1.2.0
 	github.com/mailru/easyjson v0.7.0 // indirect
 	github.com/petar/GoLLRB v0.0.0-20190514000832-33fb24c13b99 // indirect
 	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
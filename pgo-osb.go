@@ -17,8 +17,14 @@ limitations under the License.
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
@@ -51,6 +57,8 @@ var options struct {
 	TLSKeyFile           string
 	AuthenticateK8SToken bool
 	KubeConfig           string
+	AdminPort            int
+	AdminToken           string
 }
 
 func main() {
@@ -64,6 +72,8 @@ func main() {
 	flag.StringVar(&options.TLSKey, "tlsKey", "", "base-64 encoded PEM block to use as the private key matching the TLS certificate.")
 	flag.BoolVar(&options.AuthenticateK8SToken, "authenticate-k8s-token", false, "former option to specify if the broker should validate the bearer auth token with kubernetes, disabled 4.6+")
 	flag.StringVar(&options.KubeConfig, "kube-config", "", "specify the kube config path to be used")
+	flag.IntVar(&options.AdminPort, "admin-port", 0, "port for the operator admin API to listen on, disabled when 0")
+	flag.StringVar(&options.AdminToken, "admin-token", os.Getenv("PGO_OSB_ADMIN_TOKEN"), "bearer token required by the admin API, defaults to the PGO_OSB_ADMIN_TOKEN env var")
 	bridge.AddFlags(&options.Options)
 
 	flag.Parse()
@@ -83,6 +93,7 @@ func main() {
 
 	if err := run(); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
 		log.Print(err)
+		os.Exit(1)
 	}
 }
 
@@ -113,11 +124,41 @@ func runWithContext(ctx context.Context) error {
 	}
 	options.Options.KubeAPIClient = RESTClient
 
+	kubeClientset, err := getKubernetesClient(options.KubeConfig)
+	if err != nil {
+		return err
+	}
+	options.Options.KubeClientset = kubeClientset
+
 	businessLogic, err := bridge.NewBusinessLogic(options.Options)
 	if err != nil {
 		return err
 	}
 
+	// A failing admin API stops the broker, whose error is then reported
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	adminErr := make(chan error, 1)
+	if options.AdminPort != 0 {
+		if options.AdminToken == "" {
+			return errors.New("the admin API requires a token, specify --admin-token or PGO_OSB_ADMIN_TOKEN")
+		}
+		tlsConfig, err := adminTLSConfig()
+		if err != nil {
+			return err
+		}
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(options.AdminPort))
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := runAdmin(ctx, ln, tlsConfig, businessLogic.AdminHandler(options.AdminToken)); err != nil {
+				adminErr <- err
+				cancelFunc()
+			}
+		}()
+	}
+
 	// Prom. metrics
 	reg := prom.NewRegistry()
 	osbMetrics := metrics.New()
@@ -153,7 +194,62 @@ func runWithContext(ctx context.Context) error {
 			err = s.RunTLSWithTLSFiles(ctx, addr, options.TLSCertFile, options.TLSKeyFile)
 		}
 	}
-	return err
+	select {
+	case aerr := <-adminErr:
+		return aerr
+	default:
+		return err
+	}
+}
+
+// adminTLSConfig is the TLS configuration of the admin API, which uses the
+// certificate of the broker. It is nil when the broker runs with --insecure
+func adminTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case options.Insecure:
+		return nil, nil
+	case options.TLSCert != "" && options.TLSKey != "":
+		var certPEM, keyPEM []byte
+		if certPEM, err = base64.StdEncoding.DecodeString(options.TLSCert); err != nil {
+			return nil, err
+		}
+		if keyPEM, err = base64.StdEncoding.DecodeString(options.TLSKey); err != nil {
+			return nil, err
+		}
+		cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	case options.TLSCertFile != "" && options.TLSKeyFile != "":
+		cert, err = tls.LoadX509KeyPair(options.TLSCertFile, options.TLSKeyFile)
+	default:
+		return nil, errors.New("the admin API requires a TLS certificate and key, specify --tls-cert-file and --tls-private-key-file or --tlsCert and --tlsKey")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// runAdmin serves the admin API on ln until ctx is cancelled, over TLS unless
+// tlsConfig is nil
+func runAdmin(ctx context.Context, ln net.Listener, tlsConfig *tls.Config, h http.Handler) error {
+	srv := &http.Server{Handler: h, TLSConfig: tlsConfig}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Printf("Starting admin API on %s", ln.Addr())
+	var err error
+	if tlsConfig != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("admin API stopped: %w", err)
+	}
+	return nil
 }
 
 func getKubernetesConfig(kubeConfigPath string) (*clientrest.Config, error) {
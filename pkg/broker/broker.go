@@ -15,10 +15,45 @@ package broker
  limitations under the License.
 */
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
 // BasicCred represents a common pair of username and password
 type BasicCred struct {
 	Username string
 	Password string
+	// Database and Schema are set for isolated bindings, naming the
+	// database or schema dedicated to the binding
+	Database string
+	Schema   string
+	// ExpiresAt is set for bindings with a limited lifetime
+	ExpiresAt *time.Time
+	// ClientCert and ClientKey are the PEM encoded client certificate and
+	// key of bindings authenticating with one instead of a password, issued
+	// by ClientCA
+	ClientCert string
+	ClientKey  string
+	ClientCA   string
+}
+
+// ServiceDetails describes a Service of a cluster and the addresses it may
+// be reached at from outside of it
+type ServiceDetails struct {
+	Name       string
+	ClusterIP  string
+	ExternalIP string
+	// LoadBalancer is the hostname, or otherwise the IP, of the load
+	// balancer of a LoadBalancer Service once provisioned
+	LoadBalancer string
+	// NodePort exposes the PostgreSQL port on every node, zero for Services
+	// of other types
+	NodePort int
+	// Route is the host of an OpenShift Route named after the Service
+	Route string
 }
 
 // ClusterDetails encapsulates information returned about the cluster
@@ -27,7 +62,179 @@ type ClusterDetails struct {
 	ClusterIP   string
 	ExternalIP  string
 	ClusterName string
+	Namespace   string
 	Database    string
+	PlanID      string
+	// Ready is set once the cluster has been initialized
+	Ready bool
+	// StandbyOf is the ID of the instance a standby cluster replicates
+	// from, empty for clusters which are not standbys
+	StandbyOf string
+	// Deprovisioning is set while a deprovisioned cluster awaits its final
+	// backup before being deleted
+	Deprovisioning bool
+	// TLS is set when the cluster accepts TLS connections and TLSOnly when
+	// it accepts nothing else. CACert is the PEM encoded CA certificate
+	// clients verify the server with, when available
+	TLS     bool
+	TLSOnly bool
+	CACert  string
+	// Port is the PostgreSQL port of the cluster's Services
+	Port int
+	// Primary is the Service of the primary, whose ClusterIP and ExternalIP
+	// are also those of the cluster. Replica and PgBouncer are the Services
+	// of the replicas and of pgBouncer, with an empty Name when the cluster
+	// has none
+	Primary   ServiceDetails
+	Replica   ServiceDetails
+	PgBouncer ServiceDetails
+}
+
+// AccessLevel is what a binding's role is granted on the instance database
+type AccessLevel string
+
+const (
+	// AccessReadOnly allows reading the tables of the database
+	AccessReadOnly AccessLevel = "readonly"
+	// AccessReadWrite additionally allows modifying the rows of tables
+	AccessReadWrite AccessLevel = "readwrite"
+	// AccessOwner additionally allows creating and altering objects
+	AccessOwner AccessLevel = "owner"
+)
+
+// Isolation is how a binding's data is separated from that of other
+// bindings of the same instance
+type Isolation string
+
+const (
+	// IsolationShared binds to the instance database, shared by bindings
+	IsolationShared Isolation = "shared"
+	// IsolationSchema binds to a schema of the instance database owned by
+	// the binding's role
+	IsolationSchema Isolation = "schema"
+	// IsolationDatabase binds to a database owned by the binding's role
+	IsolationDatabase Isolation = "database"
+)
+
+// BindingType is what a binding's role is for, other than connecting apps
+// to the instance database
+type BindingType string
+
+const (
+	// BindingMonitoring roles are members of pg_monitor only
+	BindingMonitoring BindingType = "monitoring"
+	// BindingReplication roles may stream changes, through the publication
+	// and logical replication slot of the binding when it has them
+	BindingReplication BindingType = "replication"
+)
+
+// BindingRecord describes a binding as recorded by the broker
+type BindingRecord struct {
+	BindingID string `json:"binding_id"`
+	Role      string `json:"role"`
+	// Access is empty for bindings created before access levels existed,
+	// whose roles keep the operator's default grants
+	Access    AccessLevel `json:"access,omitempty"`
+	Isolation Isolation   `json:"isolation,omitempty"`
+	// KeepOnUnbind keeps the schema or database of an isolated binding
+	// when it is unbound, handing it to the owner group
+	KeepOnUnbind bool `json:"keep_on_unbind,omitempty"`
+	// PgBouncer is set for bindings connecting through pgBouncer
+	PgBouncer bool `json:"pgbouncer,omitempty"`
+	// AppNamespace is set for bindings whose NetworkPolicy admits that
+	// namespace to the instance
+	AppNamespace string    `json:"app_namespace,omitempty"`
+	AppGUID      string    `json:"app_guid,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// AlternateRole is created by the first rotation with a grace period and
+	// acts as Role. Rotations with a grace period switch the credentials of
+	// the binding between the two roles, ActiveRole being the one in use
+	// when it is not Role, so that the other keeps its password until
+	// GraceUntil
+	AlternateRole string     `json:"alternate_role,omitempty"`
+	ActiveRole    string     `json:"active_role,omitempty"`
+	RotatedAt     *time.Time `json:"rotated_at,omitempty"`
+	GraceUntil    *time.Time `json:"grace_until,omitempty"`
+
+	// ExpiresAt is the end of the lifetime of the binding, after which its
+	// roles cannot log in and are dropped by the janitor
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Predecessor and Successor link a binding to the one it replaces and
+	// the one replacing it. Isolated successors take over the schema or
+	// database of their predecessor, named DataName
+	Predecessor string `json:"predecessor_binding_id,omitempty"`
+	Successor   string `json:"successor_binding_id,omitempty"`
+	DataName    string `json:"data_name,omitempty"`
+
+	// PasswordPolicy is applied again whenever the password is rotated
+	PasswordPolicy *PasswordPolicy `json:"password_policy,omitempty"`
+	// ClientCert is set for bindings authenticating with a client
+	// certificate, which have no password to rotate
+	ClientCert bool `json:"client_certificate,omitempty"`
+
+	// Type is empty for app bindings. Monitoring and replication bindings
+	// have the readonly Access, which only replication bindings are granted.
+	// Publication and Slot are created for replication bindings asking for
+	// them and dropped on unbind
+	Type        BindingType `json:"type,omitempty"`
+	Publication string      `json:"publication,omitempty"`
+	Slot        string      `json:"replication_slot,omitempty"`
+
+	// Limits are set on the role, and on its alternate role
+	Limits *RoleLimits `json:"limits,omitempty"`
+}
+
+// dataName is the name of the schema or database of an isolated binding
+func (rec BindingRecord) dataName() string {
+	if rec.DataName != "" {
+		return rec.DataName
+	}
+	return rec.Role
+}
+
+// activeRole is the role the credentials of the binding are for
+func (rec BindingRecord) activeRole() string {
+	if rec.ActiveRole != "" {
+		return rec.ActiveRole
+	}
+	return rec.Role
+}
+
+// inactiveRole is the role of a binding rotated with a grace period which is
+// not in use, if any
+func (rec BindingRecord) inactiveRole() string {
+	switch {
+	case rec.AlternateRole == "":
+		return ""
+	case rec.ActiveRole == rec.AlternateRole:
+		return rec.Role
+	default:
+		return rec.AlternateRole
+	}
+}
+
+// RotationPolicy describes the scheduled rotation of binding passwords
+type RotationPolicy struct {
+	// Interval is the age of a password after which the janitor rotates it,
+	// zero disabling scheduled rotation
+	Interval time.Duration
+	// Grace keeps the previous password of a binding valid for this long
+	Grace time.Duration
+}
+
+// Retention describes what is kept of a cluster once its instance is
+// deprovisioned
+type Retention struct {
+	// FinalBackup takes a full backup before the cluster is deleted
+	FinalBackup bool
+	// BackupDays is the number of days the pgBackRest repository is kept
+	// after deletion, zero deleting it along with the cluster and a negative
+	// number keeping it indefinitely
+	BackupDays int
+	// DeleteData deletes the data volumes along with the cluster, otherwise
+	// they are kept for as long as the backups
+	DeleteData bool
 }
 
 type CreateRequest struct {
@@ -35,6 +242,122 @@ type CreateRequest struct {
 	Name       string
 	Namespace  string
 	PlanID     string
+
+	// Optional settings overriding those of the plan, left empty for the
+	// plan or operator defaults
+	StorageSize   string
+	StorageConfig string
+	ImageTag      string
+	PgBouncer     bool
+	TLSSecret     string
+	CASecret      string
+	TLSOnly       bool
+	CustomConfig  string
+	Labels        map[string]string
+
+	// RestoreFrom is the ID of an instance whose pgBackRest repository the
+	// new cluster is created from, restored up to RestoreTarget when set
+	RestoreFrom   string
+	RestoreTarget time.Time
+
+	// StandbyOf is the ID of an instance the new cluster follows as a
+	// standby, replaying WAL from its pgBackRest repository
+	StandbyOf string
+
+	Retention Retention
+	// DeletionProtection prevents the instance from being deprovisioned
+	DeletionProtection bool
+	// RestrictPublicSchema revokes CREATE on the public schema from PUBLIC
+	// once the instance is first bound
+	RestrictPublicSchema bool
+}
+
+// digest identifies the attributes an instance is requested with, to tell
+// repeated requests from conflicting ones
+func (r CreateRequest) digest() string {
+	r.InstanceID = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		// Marshalling strings, booleans and times does not fail
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	// Label values are limited to 63 characters
+	return hex.EncodeToString(sum[:20])
+}
+
+type DeleteRequest struct {
+	InstanceID string
+	// AcceptsIncomplete allows the cluster to be deleted by the janitor
+	// after a final backup. Without it, instances taking a final backup
+	// are not deprovisioned at all
+	AcceptsIncomplete bool
+}
+
+type UpdateRequest struct {
+	InstanceID string
+	PlanID     string
+	// PreviousPlanID is the plan reported by the platform, used when the
+	// instance's current plan cannot otherwise be determined
+	PreviousPlanID string
+	// Promote turns a standby cluster into a primary accepting writes
+	Promote bool
+	// DeletionProtection changes the deletion protection of the instance
+	// when set
+	DeletionProtection *bool
+}
+
+type BindRequest struct {
+	InstanceID string
+	BindingID  string
+	AppID      string
+	Access     AccessLevel
+
+	// Isolation, IsolationShared when empty, selects where the binding's
+	// data lives. Isolated bindings own their schema or database and are
+	// not granted Access to the instance database
+	Isolation    Isolation
+	KeepOnUnbind bool
+
+	// PgBouncer makes sure the role may connect through the pgBouncer of
+	// the cluster
+	PgBouncer bool
+
+	// AppNamespace, when set, is admitted to the instance by a NetworkPolicy
+	// of the binding, along with AllowNamespaces. The instance is closed to
+	// any other namespace while such bindings exist, so they are refused
+	// while bindings without a NetworkPolicy exist
+	AppNamespace    string
+	AllowNamespaces []string
+
+	// Lifetime limits how long the binding may be used, when positive
+	Lifetime time.Duration
+	// PredecessorID names the binding this one replaces, whose privileges,
+	// along with its schema or database, it is given
+	PredecessorID string
+	// PasswordPolicy constrains the password of the binding role
+	PasswordPolicy PasswordPolicy
+	// ClientCert has the binding authenticate with a client certificate
+	// instead of a password
+	ClientCert bool
+
+	// Type is empty for app bindings. Replication bindings may ask for a
+	// publication of all tables and a logical replication slot
+	Type        BindingType
+	Publication string
+	Slot        string
+
+	// Limits bound the connections and resources of the binding role
+	Limits RoleLimits
+}
+
+// RotateRequest asks for the password of a binding to be rotated
+type RotateRequest struct {
+	InstanceID string
+	BindingID  string
+	// Grace keeps the previous password valid for this long, during which
+	// the binding cannot be rotated again
+	Grace time.Duration
 }
 
 // Executor defines an interface for servicing OSB requests
@@ -47,11 +370,32 @@ type Executor interface {
 // Provisioner defines an interface for (de)provisioning clusters
 type Provisioner interface {
 	CreateCluster(req CreateRequest) error
-	DeleteCluster(instanceID string) error
+	UpdateCluster(req UpdateRequest) error
+	DeleteCluster(req DeleteRequest) error
+}
+
+// Janitor is implemented by executors which finish deprovisioning and purge
+// expired leftovers in the background
+type Janitor interface {
+	CleanUp() error
+}
+
+// RotationScheduler is implemented by janitors which rotate the passwords of
+// bindings on a schedule
+type RotationScheduler interface {
+	SetRotationPolicy(p RotationPolicy)
+}
+
+// ClientCertIssuer is implemented by brokers which issue client certificates
+// to bindings, from the CA held in a Secret named as namespace/name
+type ClientCertIssuer interface {
+	SetClientCA(secret string)
 }
 
 // Binder defines an interface for creating and deleting user bindings
 type Binder interface {
-	CreateBinding(instanceID, bindID, appID string) (BasicCred, error)
+	CreateBinding(req BindRequest) (BasicCred, error)
 	DeleteBinding(instanceID, bindID string) error
+	ListBindings(instanceID string) ([]BindingRecord, error)
+	RotateBinding(req RotateRequest) (BindingRecord, error)
 }
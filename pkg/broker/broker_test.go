@@ -0,0 +1,61 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnitCreateRequestDigest(t *testing.T) {
+	req := CreateRequest{
+		InstanceID: "a",
+		Name:       "unitinstance",
+		Namespace:  "unitnamespace",
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+		Labels:     map[string]string{"team": "unit"},
+		Retention:  Retention{BackupDays: 7, DeleteData: true},
+	}
+	digest := req.digest()
+	if len(digest) > 63 {
+		t.Fatalf("expected a digest fitting a label value, got %d characters", len(digest))
+	}
+
+	// Repeating the request for another instance ID asks for the same
+	repeated := req
+	repeated.InstanceID = "b"
+	repeated.Labels = map[string]string{"team": "unit"}
+	if repeated.digest() != digest {
+		t.Errorf("expected the digest to ignore the instance ID")
+	}
+
+	changes := []func(r *CreateRequest){
+		func(r *CreateRequest) { r.PlanID = "885a1cb6-ca42-43e9-a725-8195918e1343" },
+		func(r *CreateRequest) { r.StorageSize = "5Gi" },
+		func(r *CreateRequest) { r.Labels = map[string]string{"team": "other"} },
+		func(r *CreateRequest) { r.RestoreTarget = time.Unix(0, 0) },
+		func(r *CreateRequest) { r.Retention.BackupDays = 14 },
+		func(r *CreateRequest) { r.DeletionProtection = true },
+	}
+	for i, change := range changes {
+		changed := req
+		changed.Labels = map[string]string{"team": "unit"}
+		change(&changed)
+		if changed.digest() == digest {
+			t.Errorf("expected change %d to alter the digest", i)
+		}
+	}
+}
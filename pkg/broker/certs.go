@@ -0,0 +1,377 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v2"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Bindings may authenticate with a client certificate instead of a
+// password. Their roles join certGroup, which the pg_hba rules below let in
+// over TLS with a certificate only, and are issued a certificate whose CN is
+// the role name from the CA configured for the broker. The certificate and
+// key are kept in a Secret of the binding, so that repeated bind requests
+// return the same credentials
+
+// certGroup is the group of the roles of client certificate bindings
+const certGroup = "pgo_osb_cert"
+
+// certHBARules admit the members of certGroup with a client certificate
+// over TLS, and refuse them otherwise, ahead of the rules accepting
+// passwords
+var certHBARules = []string{
+	"hostssl all +" + certGroup + " all cert",
+	"host all +" + certGroup + " all reject",
+}
+
+// clientCertValidity is how long the certificates of bindings without a
+// lifetime are valid for
+const clientCertValidity = 365 * 24 * time.Hour
+
+// certAuthTimeout is how long binding waits for Patroni to write the rules
+// of certHBARules to the pg_hba.conf of the primary, polling every
+// certAuthPollInterval
+var (
+	certAuthTimeout      = 30 * time.Second
+	certAuthPollInterval = 2 * time.Second
+)
+
+// clientCertSecretName is the name of the Secret holding the client
+// certificate of a binding
+func clientCertSecretName(bindID string) string {
+	return "pgo-osb-binding-" + strings.ToLower(bindID) + "-tls"
+}
+
+// clientCA is the CA client certificates are issued from
+type clientCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pem  []byte
+}
+
+// parseClientCA reads a CA from its PEM encoded certificate and key
+func parseClientCA(certPEM, keyPEM []byte) (*clientCA, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %s is not a CA", cert.Subject)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key")
+	}
+
+	return &clientCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})}, nil
+}
+
+// issue returns a PEM encoded client certificate for cn, valid until
+// notAfter or the expiry of the CA, whichever comes first, and its key
+func (ca *clientCA) issue(cn string, notAfter time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		// Allowing for clocks running behind
+		NotBefore:   time.Now().Add(-5 * time.Minute),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// trustedBy reports whether a PEM encoded CA bundle holds the CA, so that
+// servers verifying clients against the bundle accept its certificates
+func (ca *clientCA) trustedBy(bundle []byte) bool {
+	for {
+		var block *pem.Block
+		if block, bundle = pem.Decode(bundle); block == nil {
+			return false
+		}
+		if block.Type == "CERTIFICATE" && bytes.Equal(block.Bytes, ca.cert.Raw) {
+			return true
+		}
+	}
+}
+
+// SetClientCA names the Secret, as namespace/name, holding the tls.crt and
+// tls.key of the CA client certificates are issued from
+func (po *PGOperator) SetClientCA(secret string) {
+	po.clientCASecret = secret
+}
+
+// loadClientCA reads the CA client certificates are issued from, which is
+// read again every time so that it can be replaced
+func (po *PGOperator) loadClientCA() (*clientCA, error) {
+	parts := strings.SplitN(po.clientCASecret, "/", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidParams{Violations: []string{"client certificates are not enabled for the broker"}}
+	}
+	secret, err := po.clientset.CoreV1().Secrets(parts[0]).Get(context.Background(), parts[1], metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA secret %s: %s", po.clientCASecret, err)
+	}
+
+	ca, err := parseClientCA(secret.Data["tls.crt"], secret.Data["tls.key"])
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA secret %s: %s", po.clientCASecret, err)
+	}
+	return ca, nil
+}
+
+// checkClientCA returns the CA client certificates for bindings of cluster
+// are issued from, provided the cluster verifies clients against it
+func (po *PGOperator) checkClientCA(cluster *crv1.Pgcluster) (*clientCA, error) {
+	if !cluster.Spec.TLS.IsTLSEnabled() {
+		return nil, ErrInvalidParams{Violations: []string{fmt.Sprintf("instance %s has no TLS", cluster.Labels[po.instLabelKey])}}
+	}
+	ca, err := po.loadClientCA()
+	if err != nil {
+		return nil, err
+	}
+	if !ca.trustedBy([]byte(po.caCert(cluster.GetNamespace(), cluster.Spec.TLS.CASecret))) {
+		return nil, ErrInvalidParams{Violations: []string{fmt.Sprintf("the CA secret of instance %s does not hold the client CA", cluster.Labels[po.instLabelKey])}}
+	}
+	return ca, nil
+}
+
+// certAuthStmts make the role of a binding a member of certGroup
+func certAuthStmts(role string) []string {
+	return []string{
+		createGroupStmt(certGroup),
+		fmt.Sprintf("GRANT %s TO %s", pq.QuoteIdentifier(certGroup), pq.QuoteIdentifier(role)),
+	}
+}
+
+// allowCertAuth adds certHBARules to the pg_hba of a cluster, which the
+// operator keeps in the Patroni configuration held in the <cluster>-pgha-config
+// ConfigMap and applies to every member when it changes
+func (po *PGOperator) allowCertAuth(cluster *crv1.Pgcluster) error {
+	ctx := context.Background()
+	name, key := cluster.GetName()+"-pgha-config", cluster.GetName()+"-dcs-config"
+	cms := po.clientset.CoreV1().ConfigMaps(cluster.GetNamespace())
+	cm, err := cms.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error reading configmap %s: %s", name, err)
+	}
+
+	dcs := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(cm.Data[key]), &dcs); err != nil {
+		return fmt.Errorf("error parsing %s of configmap %s: %s", key, name, err)
+	}
+	pg, ok := dcs["postgresql"].(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("configmap %s has no postgresql settings", name)
+	}
+	rules, _ := pg["pg_hba"].([]interface{})
+	if len(rules) == 0 {
+		return fmt.Errorf("configmap %s has no pg_hba rules", name)
+	}
+
+	for _, rule := range rules {
+		if rule == certHBARules[0] {
+			return nil
+		}
+	}
+
+	// Rules apply in order, so the rules are placed ahead of the first
+	// rule for TCP connections
+	hba := make([]interface{}, 0, len(rules)+len(certHBARules))
+	inserted := false
+	for _, rule := range rules {
+		if s, _ := rule.(string); !inserted && strings.HasPrefix(s, "host") {
+			for _, r := range certHBARules {
+				hba = append(hba, r)
+			}
+			inserted = true
+		}
+		hba = append(hba, rule)
+	}
+	if !inserted {
+		for _, r := range certHBARules {
+			hba = append(hba, r)
+		}
+	}
+	pg["pg_hba"] = hba
+
+	out, err := yaml.Marshal(dcs)
+	if err != nil {
+		return err
+	}
+	cm.Data[key] = string(out)
+	if _, err := cms.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("error updating configmap %s: %s", name, err)
+	}
+	log.Printf("added client certificate rules to pg_hba of cluster %s\n", cluster.GetName())
+
+	return nil
+}
+
+// awaitCertAuth waits until the pg_hba.conf of the primary of a cluster
+// holds certHBARules, as Patroni writes it some time after the ConfigMap
+// changes, and then reloads it, so that the certificates returned by bind
+// are accepted right away
+func (po *PGOperator) awaitCertAuth(hc *http.Client, cluster *crv1.Pgcluster) error {
+	db, err := po.openDB(hc, cluster)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	deadline := time.Now().Add(certAuthTimeout)
+	for {
+		var live bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT FROM pg_catalog.pg_hba_file_rules
+  WHERE type = 'hostssl' AND auth_method = 'cert' AND $1 = ANY (user_name))`, "+"+certGroup).Scan(&live)
+		if err != nil {
+			return ErrBackendUnavailable{err}
+		}
+		if live {
+			break
+		}
+		if time.Now().After(deadline) {
+			return ErrBackendUnavailable{fmt.Errorf("pg_hba of cluster %s lacks the client certificate rules after %s", cluster.GetName(), certAuthTimeout)}
+		}
+		time.Sleep(certAuthPollInterval)
+	}
+
+	if _, err := db.Exec("SELECT pg_catalog.pg_reload_conf()"); err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	return nil
+}
+
+// clientCert returns the client certificate of a binding, issuing it when
+// it has none yet
+func (po *PGOperator) clientCert(cluster *crv1.Pgcluster, ca *clientCA, rec BindingRecord) (*corev1.Secret, error) {
+	ctx := context.Background()
+	secrets := po.clientset.CoreV1().Secrets(cluster.GetNamespace())
+	name := clientCertSecretName(rec.BindingID)
+	if secret, err := secrets.Get(ctx, name, metav1.GetOptions{}); err == nil {
+		return secret, nil
+	} else if !kerrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(clientCertValidity)
+	if rec.ExpiresAt != nil {
+		notAfter = *rec.ExpiresAt
+	}
+	certPEM, keyPEM, err := ca.issue(rec.Role, notAfter)
+	if err != nil {
+		return nil, err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: cluster.GetNamespace(),
+			Labels: map[string]string{
+				po.instLabelKey: cluster.Labels[po.instLabelKey],
+				po.bindLabelKey: rec.BindingID,
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": certPEM,
+			"tls.key": keyPEM,
+			"ca.crt":  ca.pem,
+		},
+	}
+	if _, err := secrets.Create(ctx, secret, metav1.CreateOptions{}); kerrors.IsAlreadyExists(err) {
+		// Issued by a concurrent attempt at the same binding
+		return secrets.Get(ctx, name, metav1.GetOptions{})
+	} else if err != nil {
+		return nil, err
+	}
+	log.Printf("issued client certificate for %s\n", rec.Role)
+
+	return secret, nil
+}
+
+// deleteClientCert deletes the client certificate of a binding, if any
+func (po *PGOperator) deleteClientCert(cluster *crv1.Pgcluster, bindID string) error {
+	err := po.clientset.CoreV1().Secrets(cluster.GetNamespace()).Delete(context.Background(), clientCertSecretName(bindID), metav1.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// deleteClientCerts deletes the client certificates left of the bindings of
+// a deleted cluster. Failures are logged only, as the cluster is already
+// gone
+func (po *PGOperator) deleteClientCerts(cluster *crv1.Pgcluster) {
+	// Other Secrets of the cluster may carry the instance label
+	selector := po.instLabel(cluster.Labels[po.instLabelKey]) + "," + po.bindLabelKey
+	err := po.clientset.CoreV1().Secrets(cluster.GetNamespace()).DeleteCollection(context.Background(), metav1.DeleteOptions{}, metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		log.Printf("error deleting client certificates of cluster %s: %s\n", cluster.GetName(), err)
+	}
+}
@@ -0,0 +1,31 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import "testing"
+
+func TestUnitCertAuthStmts(t *testing.T) {
+	stmts := certAuthStmts(bindingRole("a"))
+	if len(stmts) != 2 {
+		t.Fatalf("expected the group to be created and granted, got %v", stmts)
+	}
+	if exp := `GRANT "` + certGroup + `" TO "` + bindingRole("a") + `"`; stmts[1] != exp {
+		t.Errorf("expected %q, got %q", exp, stmts[1])
+	}
+	if name := clientCertSecretName("ABC-123"); name != "pgo-osb-binding-abc-123-tls" {
+		t.Errorf("expected a lowercase secret name, got %s", name)
+	}
+}
@@ -17,12 +17,17 @@ package broker
 
 import (
 	"errors"
+	"strings"
 )
 
+// The errors below make up the failures a broker implementation reports to
+// its caller. Any other error is considered an unexpected internal failure.
+
 var (
 	ErrBindingsRemain = errors.New("one or more bindings still exist, unbind before deleting")
 )
 
+// ErrNoInstance is returned when no instance exists for the ID
 type ErrNoInstance struct {
 	ID string
 }
@@ -30,3 +35,120 @@ type ErrNoInstance struct {
 func (ni ErrNoInstance) Error() string {
 	return "no instance found for instance ID " + ni.ID
 }
+
+// ErrInstanceExists is returned when creating an instance with an ID already
+// in use. Identical is set when the instance was created with the same
+// attributes, which platforms do not consider an error
+type ErrInstanceExists struct {
+	ID        string
+	Identical bool
+}
+
+func (ie ErrInstanceExists) Error() string {
+	return "an instance already exists for instance ID " + ie.ID
+}
+
+// ErrNoBinding is returned when no binding exists for the ID on the instance
+type ErrNoBinding struct {
+	InstanceID string
+	BindID     string
+}
+
+func (nb ErrNoBinding) Error() string {
+	return "no binding found for binding ID " + nb.BindID + " on instance ID " + nb.InstanceID
+}
+
+// ErrConflict is returned when a request collides with existing resources
+// other than the instance itself, e.g. a cluster name already taken
+type ErrConflict struct {
+	Reason string
+}
+
+func (c ErrConflict) Error() string {
+	return "conflict: " + c.Reason
+}
+
+// ErrForbidden is returned when the caller is not permitted to make the
+// request, e.g. when provisioning into a namespace outside of policy
+type ErrForbidden struct {
+	Reason string
+}
+
+func (f ErrForbidden) Error() string {
+	return "forbidden: " + f.Reason
+}
+
+// ErrInvalidParams is returned when a request is rejected due to one or more
+// invalid parameters, each described in Violations
+type ErrInvalidParams struct {
+	Violations []string
+}
+
+func (ip ErrInvalidParams) Error() string {
+	return "invalid parameters: " + strings.Join(ip.Violations, "; ")
+}
+
+// ErrBackendUnavailable wraps failures to reach the operator apiserver or
+// Kubernetes API, which are expected to be transient
+type ErrBackendUnavailable struct {
+	Err error
+}
+
+func (bu ErrBackendUnavailable) Error() string {
+	return "backend unavailable: " + bu.Err.Error()
+}
+
+func (bu ErrBackendUnavailable) Unwrap() error {
+	return bu.Err
+}
+
+// ErrConcurrency is returned when an instance cannot be acted on because
+// another operation on it is still in progress
+type ErrConcurrency struct {
+	ID string
+}
+
+func (c ErrConcurrency) Error() string {
+	return "an operation is in progress for instance ID " + c.ID
+}
+
+// ErrQuotaExceeded is returned when the backend refuses to create resources
+// due to a quota or limit
+type ErrQuotaExceeded struct {
+	Reason string
+}
+
+func (qe ErrQuotaExceeded) Error() string {
+	return "quota exceeded: " + qe.Reason
+}
+
+// ErrPlanChangeUnsupported is returned when updating an instance to a plan
+// it cannot be moved to
+type ErrPlanChangeUnsupported struct {
+	From string
+	To   string
+}
+
+func (pc ErrPlanChangeUnsupported) Error() string {
+	return "unable to change plan from " + pc.From + " to " + pc.To
+}
+
+// ErrAsyncRequired is returned when deprovisioning an instance which takes a
+// final backup, and so is only deleted later, without accepting that
+type ErrAsyncRequired struct {
+	ID string
+}
+
+func (ar ErrAsyncRequired) Error() string {
+	return "instance ID " + ar.ID + " takes a final backup before it is deleted, which requires asynchronous deprovisioning"
+}
+
+// ErrDeletionProtected is returned when deprovisioning an instance with
+// deletion protection enabled
+type ErrDeletionProtected struct {
+	ID string
+}
+
+func (dp ErrDeletionProtected) Error() string {
+	return "deletion protection is enabled for instance ID " + dp.ID
+}
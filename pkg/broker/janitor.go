@@ -0,0 +1,346 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/crunchydata/postgres-operator/cmd/pgo/api"
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+	msgs "github.com/crunchydata/postgres-operator/pkg/apiservermsgs"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// RunJanitor calls CleanUp every interval until ctx is done
+func RunJanitor(ctx context.Context, j Janitor, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if err := j.CleanUp(); err != nil {
+			log.Printf("janitor: %s\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// retention reads the retention settings recorded on a cluster. Clusters
+// created before retention settings existed keep their data and backups
+// indefinitely, as they always have
+func retention(cluster *crv1.Pgcluster) Retention {
+	days, err := strconv.Atoi(cluster.Labels[_BACKUP_DAYS_LABEL_KEY])
+	if err != nil {
+		return Retention{BackupDays: -1}
+	}
+
+	return Retention{
+		FinalBackup: cluster.Labels[_FINAL_BACKUP_LABEL_KEY] == "true",
+		BackupDays:  days,
+		DeleteData:  cluster.Labels[_DELETE_DATA_LABEL_KEY] == "true",
+	}
+}
+
+// startFinalBackup requests a full backup of the cluster and marks it as
+// deprovisioned, leaving its deletion to the janitor
+func (po *PGOperator) startFinalBackup(hc *http.Client, cluster *crv1.Pgcluster) error {
+	instanceID := cluster.Labels[po.instLabelKey]
+	started := time.Now()
+
+	bReq := &msgs.CreateBackrestBackupRequest{
+		Namespace:  cluster.GetNamespace(),
+		Selector:   po.instLabel(instanceID),
+		BackupOpts: "--type=full",
+	}
+	resp, err := api.CreateBackrestBackup(hc, &po.pgoCreds, bReq)
+	if err != nil {
+		log.Printf("error requesting final backup: %s\n", err)
+		return ErrBackendUnavailable{err}
+	}
+	if resp.Status.Code != msgs.Ok {
+		log.Println(resp.Status.Msg)
+		return errors.New("error requesting final backup: " + resp.Status.Msg)
+	}
+
+	err = po.labelCluster(cluster, map[string]string{
+		_DEPROVISIONED_LABEL_KEY: strconv.FormatInt(started.Unix(), 10),
+	})
+	if err != nil {
+		log.Printf("error marking cluster deprovisioned: %s\n", err)
+		return err
+	}
+	log.Printf("final backup of instance %s requested\n", instanceID)
+
+	return nil
+}
+
+// deleteCluster deletes a cluster according to its retention settings,
+// marking any volumes left behind for the janitor
+func (po *PGOperator) deleteCluster(hc *http.Client, cluster *crv1.Pgcluster, ret Retention) error {
+	instanceID := cluster.Labels[po.instLabelKey]
+	selector := po.instLabel(instanceID)
+	deleteBackups := ret.BackupDays == 0
+	log.Printf("deleting cluster %s with delete-data %t, delete-backups %t\n", selector, ret.DeleteData, deleteBackups)
+
+	deleteClusterRequest := msgs.DeleteClusterRequest{
+		Clustername:   "all",
+		Selector:      selector,
+		ClientVersion: po.clientVer,
+		Namespace:     cluster.GetNamespace(),
+		DeleteData:    ret.DeleteData,
+		DeleteBackups: deleteBackups,
+	}
+	response, err := api.DeleteCluster(hc, &deleteClusterRequest, &po.pgoCreds)
+	if err != nil {
+		log.Printf("delete cluster error: %s\n", err)
+		return ErrBackendUnavailable{err}
+	}
+
+	if response.Status.Code == msgs.Ok {
+		for _, result := range response.Results {
+			log.Println(result)
+		}
+	} else {
+		log.Print(response.Status.Msg)
+		return errors.New("error deleting cluster: " + response.Status.Msg)
+	}
+	po.forgetInstance(instanceID)
+	po.deleteNetworkPolicies(cluster)
+	po.deleteClientCerts(cluster)
+
+	if !deleteBackups || !ret.DeleteData {
+		po.retainVolumes(cluster, ret)
+	}
+
+	return nil
+}
+
+// retainVolumes labels the volumes kept after a cluster is deleted with the
+// instance they belonged to and, for limited retention, when they expire.
+// Failures are logged only, as the cluster is already gone
+func (po *PGOperator) retainVolumes(cluster *crv1.Pgcluster, ret Retention) {
+	ctx := context.Background()
+	ns := cluster.GetNamespace()
+
+	labels := map[string]string{po.instLabelKey: cluster.Labels[po.instLabelKey]}
+	if ret.BackupDays > 0 {
+		expires := time.Now().AddDate(0, 0, ret.BackupDays)
+		labels[_EXPIRES_LABEL_KEY] = strconv.FormatInt(expires.Unix(), 10)
+	}
+	patch := labelPatch(labels)
+
+	pvcs, err := po.clientset.CoreV1().PersistentVolumeClaims(ns).List(ctx, metav1.ListOptions{
+		LabelSelector: "pg-cluster=" + cluster.GetName(),
+	})
+	if err != nil {
+		log.Printf("error listing volumes of cluster %s: %s\n", cluster.GetName(), err)
+		return
+	}
+	for _, pvc := range pvcs.Items {
+		isRepo := strings.HasSuffix(pvc.GetName(), "-pgbr-repo")
+		if (isRepo && ret.BackupDays == 0) || (!isRepo && ret.DeleteData) {
+			// Deleted along with the cluster
+			continue
+		}
+		_, err := po.clientset.CoreV1().PersistentVolumeClaims(ns).Patch(ctx, pvc.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			log.Printf("error labeling retained volume %s: %s\n", pvc.GetName(), err)
+		}
+	}
+}
+
+// CleanUp deletes deprovisioned clusters whose final backup has completed,
+// purges retained volumes past their expiry, drops the roles of expired
+// bindings and rotates binding passwords which are due
+func (po *PGOperator) CleanUp() error {
+	var errs []string
+	if err := po.finishDeprovisions(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := po.purgeExpired(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := po.reapExpired(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := po.rotateDue(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// finishDeprovisions deletes the clusters marked as deprovisioned once a
+// full backup taken since has completed. Clusters are never deleted without
+// their final backup; failed backups are left for an administrator
+func (po *PGOperator) finishDeprovisions() error {
+	hc, err := po.httpClient()
+	if err != nil {
+		return err
+	}
+
+	clusterList := &crv1.PgclusterList{}
+	err = po.kubeClient.Get().
+		Resource(crv1.PgclusterResourcePlural).
+		Param("labelSelector", _DEPROVISIONED_LABEL_KEY).
+		Do(context.Background()).
+		Into(clusterList)
+	if err != nil {
+		return fmt.Errorf("listing deprovisioned clusters: %s", err)
+	}
+
+	for i := range clusterList.Items {
+		cluster := &clusterList.Items[i]
+		started, err := strconv.ParseInt(cluster.Labels[_DEPROVISIONED_LABEL_KEY], 10, 64)
+		if err != nil {
+			log.Printf("janitor: invalid deprovision time on cluster %s: %s\n", cluster.GetName(), err)
+			continue
+		}
+
+		done, err := po.backupSince(hc, cluster, started)
+		if err != nil {
+			log.Printf("janitor: error checking backups of cluster %s: %s\n", cluster.GetName(), err)
+			continue
+		}
+		if !done {
+			log.Printf("janitor: waiting on final backup of cluster %s\n", cluster.GetName())
+			continue
+		}
+
+		if err := po.deleteCluster(hc, cluster, retention(cluster)); err != nil {
+			log.Printf("janitor: error deleting cluster %s: %s\n", cluster.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// activeClusters lists the clusters of instances which are not being
+// deprovisioned and are ready for their bindings to be managed
+func (po *PGOperator) activeClusters() ([]*crv1.Pgcluster, error) {
+	clusterList := &crv1.PgclusterList{}
+	err := po.kubeClient.Get().
+		Resource(crv1.PgclusterResourcePlural).
+		Param("labelSelector", po.instLabelKey).
+		Do(context.Background()).
+		Into(clusterList)
+	if err != nil {
+		return nil, fmt.Errorf("listing clusters: %s", err)
+	}
+
+	var clusters []*crv1.Pgcluster
+	for i := range clusterList.Items {
+		cluster := &clusterList.Items[i]
+		if _, ok := cluster.Labels[_DEPROVISIONED_LABEL_KEY]; ok || cluster.Status.State != crv1.PgclusterStateInitialized {
+			continue
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	return clusters, nil
+}
+
+// reapExpired deletes the bindings which expired without being unbound.
+// Their roles could no longer log in since they expired
+func (po *PGOperator) reapExpired() error {
+	clusters, err := po.activeClusters()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, cluster := range clusters {
+		for _, rec := range bindingRecords(cluster) {
+			if rec.ExpiresAt == nil || now.Before(*rec.ExpiresAt) {
+				continue
+			}
+			log.Printf("janitor: deleting binding %s, which expired at %s\n", rec.BindingID, rec.ExpiresAt.Format(time.RFC3339))
+			err := po.DeleteBinding(cluster.Labels[po.instLabelKey], rec.BindingID)
+			if _, ok := err.(ErrNoBinding); err != nil && !ok {
+				log.Printf("janitor: error deleting expired binding %s: %s\n", rec.BindingID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// backupSince reports whether a full backup of the cluster started at or
+// after the given Unix time has completed
+func (po *PGOperator) backupSince(hc *http.Client, cluster *crv1.Pgcluster, since int64) (bool, error) {
+	resp, err := api.ShowBackrest(hc, cluster.GetName(), "", &po.pgoCreds, cluster.GetNamespace())
+	if err != nil {
+		return false, err
+	}
+	if resp.Status.Code != msgs.Ok {
+		return false, errors.New(resp.Status.Msg)
+	}
+
+	for _, item := range resp.Items {
+		for _, info := range item.Info {
+			for _, b := range info.Backups {
+				if b.Type == "full" && b.Timestamp.Start >= since && b.Timestamp.Stop > 0 {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// purgeExpired deletes retained volumes whose expiry has passed
+func (po *PGOperator) purgeExpired() error {
+	ctx := context.Background()
+	pvcs, err := po.clientset.CoreV1().PersistentVolumeClaims("").List(ctx, metav1.ListOptions{
+		LabelSelector: _EXPIRES_LABEL_KEY,
+	})
+	if err != nil {
+		return fmt.Errorf("listing retained volumes: %s", err)
+	}
+
+	now := time.Now().Unix()
+	for _, pvc := range pvcs.Items {
+		expires, err := strconv.ParseInt(pvc.Labels[_EXPIRES_LABEL_KEY], 10, 64)
+		if err != nil || expires > now {
+			continue
+		}
+
+		log.Printf("janitor: deleting expired volume %s/%s\n", pvc.GetNamespace(), pvc.GetName())
+		err = po.clientset.CoreV1().PersistentVolumeClaims(pvc.GetNamespace()).Delete(ctx, pvc.GetName(), metav1.DeleteOptions{})
+		if err != nil {
+			log.Printf("janitor: error deleting volume %s/%s: %s\n", pvc.GetNamespace(), pvc.GetName(), err)
+		}
+	}
+
+	return nil
+}
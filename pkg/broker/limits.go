@@ -0,0 +1,134 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+	"github.com/lib/pq"
+)
+
+// minWorkMem is the smallest work_mem PostgreSQL accepts, in kB
+const minWorkMem = 64
+
+// RoleLimits bound the resources the role of a binding may use, so that a
+// single binding cannot exhaust those of the instance. Zero fields leave the
+// instance settings in place
+type RoleLimits struct {
+	// ConnectionLimit is the CONNECTION LIMIT of the role
+	ConnectionLimit int `json:"connection_limit,omitempty"`
+	// StatementTimeout and IdleInTransactionTimeout are set as the
+	// statement_timeout and idle_in_transaction_session_timeout of the role,
+	// in milliseconds
+	StatementTimeout         time.Duration `json:"statement_timeout,omitempty"`
+	IdleInTransactionTimeout time.Duration `json:"idle_in_transaction_session_timeout,omitempty"`
+	// WorkMem is the work_mem of the role in kB
+	WorkMem int `json:"work_mem,omitempty"`
+}
+
+// IsZero reports whether the limits leave the instance settings in place
+func (l RoleLimits) IsZero() bool {
+	return l == RoleLimits{}
+}
+
+// Validate checks that the limits can be applied to a role
+func (l RoleLimits) Validate() error {
+	switch {
+	case l.ConnectionLimit < 0:
+		return fmt.Errorf("connection limit %d is negative", l.ConnectionLimit)
+	case l.StatementTimeout < 0 || l.StatementTimeout > 0 && l.StatementTimeout < time.Millisecond:
+		return fmt.Errorf("statement timeout %s is not a positive number of milliseconds", l.StatementTimeout)
+	case l.IdleInTransactionTimeout < 0 || l.IdleInTransactionTimeout > 0 && l.IdleInTransactionTimeout < time.Millisecond:
+		return fmt.Errorf("idle in transaction timeout %s is not a positive number of milliseconds", l.IdleInTransactionTimeout)
+	case l.WorkMem < 0 || l.WorkMem > 0 && l.WorkMem < minWorkMem:
+		return fmt.Errorf("work_mem of %dkB is less than %dkB", l.WorkMem, minWorkMem)
+	}
+	return nil
+}
+
+// limitStmts apply limits to role. Settings only apply to the role logging
+// in, so they are repeated for the alternate role of a binding, whose
+// connection limit is set by connLimitStmts
+func limitStmts(role string, l RoleLimits) []string {
+	r := pq.QuoteIdentifier(role)
+	var stmts []string
+	if l.ConnectionLimit > 0 {
+		stmts = append(stmts, connLimitStmt(role, l.ConnectionLimit))
+	}
+	if l.StatementTimeout > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER ROLE %s SET statement_timeout = %d", r, l.StatementTimeout.Milliseconds()))
+	}
+	if l.IdleInTransactionTimeout > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER ROLE %s SET idle_in_transaction_session_timeout = %d", r, l.IdleInTransactionTimeout.Milliseconds()))
+	}
+	if l.WorkMem > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER ROLE %s SET work_mem = %d", r, l.WorkMem))
+	}
+	return stmts
+}
+
+func connLimitStmt(role string, n int) string {
+	return fmt.Sprintf("ALTER ROLE %s CONNECTION LIMIT %d", pq.QuoteIdentifier(role), n)
+}
+
+// connLimitStmts set the connection limits of the roles of a binding with
+// an alternate role. During a grace period the limit is divided between the
+// role handed out and the previous one, so that the binding cannot hold
+// twice its limit, though each role is left at least one connection.
+// Afterwards the role handed out has the whole limit
+func connLimitStmts(rec BindingRecord) []string {
+	n := rec.roleLimits().ConnectionLimit
+	if n == 0 || rec.AlternateRole == "" {
+		return nil
+	}
+	if rec.GraceUntil == nil {
+		return []string{connLimitStmt(rec.activeRole(), n)}
+	}
+	previous := n / 2
+	if previous == 0 {
+		previous = 1
+	}
+	return []string{
+		connLimitStmt(rec.activeRole(), n-n/2),
+		connLimitStmt(rec.inactiveRole(), previous),
+	}
+}
+
+// applyConnLimits sets the connection limits of the roles of a binding
+func (po *PGOperator) applyConnLimits(hc *http.Client, wc *crv1.Pgcluster, rec BindingRecord) error {
+	stmts := connLimitStmts(rec)
+	if len(stmts) == 0 {
+		return nil
+	}
+	db, err := po.openDB(hc, wc)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return execAll(db, stmts)
+}
+
+// roleLimits are the limits applied to the roles of a binding
+func (rec BindingRecord) roleLimits() RoleLimits {
+	if rec.Limits == nil {
+		return RoleLimits{}
+	}
+	return *rec.Limits
+}
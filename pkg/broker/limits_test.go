@@ -0,0 +1,65 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+)
+
+func TestUnitConnLimitStmts(t *testing.T) {
+	grace := time.Now().Add(time.Hour)
+	rec := BindingRecord{Role: "user_a", Limits: &RoleLimits{ConnectionLimit: 5}}
+	if stmts := connLimitStmts(rec); len(stmts) != 0 {
+		t.Errorf("expected no statements without an alternate role, got %v", stmts)
+	}
+
+	rec.AlternateRole = alternateRole(rec.Role)
+	rec.ActiveRole = rec.AlternateRole
+	rec.GraceUntil = &grace
+	expected := []string{
+		`ALTER ROLE "user_a_alt" CONNECTION LIMIT 3`,
+		`ALTER ROLE "user_a" CONNECTION LIMIT 2`,
+	}
+	if stmts := connLimitStmts(rec); !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected the limit divided during the grace period, got %v", stmts)
+	}
+
+	rec.Limits.ConnectionLimit = 1
+	expected = []string{
+		`ALTER ROLE "user_a_alt" CONNECTION LIMIT 1`,
+		`ALTER ROLE "user_a" CONNECTION LIMIT 1`,
+	}
+	if stmts := connLimitStmts(rec); !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected each role to keep a connection, got %v", stmts)
+	}
+
+	rec.GraceUntil = nil
+	expected = []string{`ALTER ROLE "user_a_alt" CONNECTION LIMIT 1`}
+	if stmts := connLimitStmts(rec); !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected the whole limit for the active role, got %v", stmts)
+	}
+
+	for _, stmt := range alternateStmts(&crv1.Pgcluster{}, rec) {
+		if strings.Contains(stmt, "CONNECTION LIMIT") {
+			t.Errorf("expected the alternate role to be created without a connection limit, got %q", stmt)
+		}
+	}
+}
@@ -16,39 +16,111 @@ package broker
 */
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Encapsulate test global data
 var MockStatic struct {
 	ExternalIP string
 	ClusterIP  string
+	ReplicaIP  string
+	BouncerIP  string
+	LBHostname string
+	NodePort   int
+	Database   string
 	Password   string
+	CACert     string
+	// Publication and Slot exist in every instance without belonging to
+	// a binding
+	Publication string
+	Slot        string
 }
 
 func init() {
 	MockStatic.ExternalIP = "198.51.100.42" // RFC5737 TEST-NET-2
 	MockStatic.ClusterIP = "10.10.33.44"
+	MockStatic.ReplicaIP = "10.10.33.45"
+	MockStatic.BouncerIP = "10.10.33.46"
+	MockStatic.LBHostname = "pg.lb.example.com"
+	MockStatic.NodePort = 30432
+	MockStatic.Database = "userdb"
 	MockStatic.Password = "WaltSentMe"
+	MockStatic.CACert = "-----BEGIN CERTIFICATE-----\nMOCK\n-----END CERTIFICATE-----\n"
+	MockStatic.Publication = "manual_pub"
+	MockStatic.Slot = "manual_slot"
 }
 
 type Mock struct {
 	sync.RWMutex
 	instances map[string]ClusterDetails
 	bindings  map[string]BasicCred
+	records   map[string]BindingRecord
+	busy      map[string]bool
+	retention map[string]Retention
+	protected map[string]bool
+	force     map[string]bool
+	rotations map[string]int
+	requests  map[string]string
+	retained  map[string]bool
+	rotation  RotationPolicy
+	clientCA  *clientCA
+
+	// InstanceLimit simulates a quota on the number of instances when
+	// greater than zero
+	InstanceLimit int
 }
 
 func NewMock() *Mock {
 	m := &Mock{
 		instances: map[string]ClusterDetails{},
 		bindings:  map[string]BasicCred{},
+		records:   map[string]BindingRecord{},
+		busy:      map[string]bool{},
+		retention: map[string]Retention{},
+		protected: map[string]bool{},
+		force:     map[string]bool{},
+		rotations: map[string]int{},
+		requests:  map[string]string{},
+		retained:  map[string]bool{},
 	}
 	return m
 }
 
+// SetBusy simulates an operation in progress on an instance, causing
+// requests against it to fail with ErrConcurrency until cleared
+func (m *Mock) SetBusy(instanceID string, busy bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if busy {
+		m.busy[instanceID] = true
+	} else {
+		delete(m.busy, instanceID)
+	}
+}
+
+// SetForceDelete simulates an administrator requesting that remaining
+// bindings be revoked when the instance is deprovisioned
+func (m *Mock) SetForceDelete(instanceID string, force bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.force[instanceID] = force
+}
+
 func (m *Mock) ClusterDetail(instanceID string) (ClusterDetails, error) {
 	m.RLock()
 	defer m.RUnlock()
@@ -57,6 +129,7 @@ func (m *Mock) ClusterDetail(instanceID string) (ClusterDetails, error) {
 	if !ok {
 		return ClusterDetails{}, ErrNoInstance{instanceID}
 	}
+	inst.Ready = !m.busy[instanceID]
 
 	return inst, nil
 }
@@ -65,45 +138,406 @@ func (m *Mock) CreateCluster(req CreateRequest) error {
 	m.Lock()
 	defer m.Unlock()
 
+	if inst, ok := m.instances[req.InstanceID]; ok {
+		identical := !inst.Deprovisioning && inst.PlanID == req.PlanID && m.requests[req.InstanceID] == req.digest()
+		return ErrInstanceExists{req.InstanceID, identical}
+	}
+	for _, inst := range m.instances {
+		if inst.Namespace == req.Namespace && inst.ClusterName == req.Name {
+			return ErrConflict{Reason: fmt.Sprintf("cluster %s already exists in namespace %s", req.Name, req.Namespace)}
+		}
+	}
+	if m.retained[req.Namespace+"/"+req.Name] {
+		return ErrConflict{Reason: fmt.Sprintf("volumes of a deleted cluster %s are retained in namespace %s", req.Name, req.Namespace)}
+	}
+	for _, src := range []string{req.RestoreFrom, req.StandbyOf} {
+		if _, ok := m.instances[src]; src != "" && !ok {
+			return ErrInvalidParams{Violations: []string{fmt.Sprintf("source instance %s does not exist", src)}}
+		}
+	}
+	if m.InstanceLimit > 0 && len(m.instances) >= m.InstanceLimit {
+		return ErrQuotaExceeded{Reason: fmt.Sprintf("limit of %d instances reached", m.InstanceLimit)}
+	}
+
 	m.instances[req.InstanceID] = ClusterDetails{
 		Name:        req.Name,
 		ClusterName: req.Name,
+		Namespace:   req.Namespace,
 		ExternalIP:  MockStatic.ExternalIP,
 		ClusterIP:   MockStatic.ClusterIP,
+		Database:    MockStatic.Database,
+		PlanID:      req.PlanID,
+		StandbyOf:   req.StandbyOf,
+		TLS:         req.TLSSecret != "",
+		TLSOnly:     req.TLSOnly,
+		Port:        5432,
+		Primary: ServiceDetails{
+			Name:         req.Name,
+			ClusterIP:    MockStatic.ClusterIP,
+			ExternalIP:   MockStatic.ExternalIP,
+			LoadBalancer: MockStatic.LBHostname,
+			NodePort:     MockStatic.NodePort,
+		},
+		Replica: ServiceDetails{
+			Name:      req.Name + "-replica",
+			ClusterIP: MockStatic.ReplicaIP,
+		},
+	}
+	if req.PgBouncer {
+		inst := m.instances[req.InstanceID]
+		inst.PgBouncer = ServiceDetails{
+			Name:      req.Name + "-pgbouncer",
+			ClusterIP: MockStatic.BouncerIP,
+		}
+		m.instances[req.InstanceID] = inst
+	}
+	if req.TLSSecret != "" {
+		inst := m.instances[req.InstanceID]
+		inst.CACert = MockStatic.CACert
+		m.instances[req.InstanceID] = inst
 	}
+	m.retention[req.InstanceID] = req.Retention
+	m.protected[req.InstanceID] = req.DeletionProtection
+	m.requests[req.InstanceID] = req.digest()
 
 	return nil
 }
 
-func (m *Mock) DeleteCluster(instanceID string) error {
+func (m *Mock) UpdateCluster(req UpdateRequest) error {
 	m.Lock()
 	defer m.Unlock()
 
-	if len(m.bindings) > 0 {
-		return ErrBindingsRemain
+	inst, ok := m.instances[req.InstanceID]
+	if !ok {
+		return ErrNoInstance{req.InstanceID}
+	}
+	if m.busy[req.InstanceID] {
+		return ErrConcurrency{req.InstanceID}
+	}
+	if req.PlanID != "" && req.PlanID != inst.PlanID {
+		return ErrPlanChangeUnsupported{From: inst.PlanID, To: req.PlanID}
+	}
+	if req.DeletionProtection != nil {
+		m.protected[req.InstanceID] = *req.DeletionProtection
+	}
+	if req.Promote {
+		if inst.StandbyOf == "" {
+			return ErrInvalidParams{Violations: []string{fmt.Sprintf("cluster %s is not a standby", inst.ClusterName)}}
+		}
+		inst.StandbyOf = ""
+		m.instances[req.InstanceID] = inst
 	}
 
+	return nil
+}
+
+func (m *Mock) DeleteCluster(req DeleteRequest) error {
+	m.Lock()
+	defer m.Unlock()
+
+	instanceID := req.InstanceID
+	inst, ok := m.instances[instanceID]
+	if !ok {
+		return ErrNoInstance{instanceID}
+	}
+
+	if m.protected[instanceID] {
+		return ErrDeletionProtected{instanceID}
+	}
+	if m.retention[instanceID].FinalBackup && !req.AcceptsIncomplete {
+		return ErrAsyncRequired{instanceID}
+	}
+
+	for key := range m.bindings {
+		if !strings.HasPrefix(key, instanceID+":") {
+			continue
+		}
+		if !m.force[instanceID] {
+			return ErrBindingsRemain
+		}
+		delete(m.bindings, key)
+		delete(m.records, key)
+		delete(m.rotations, key)
+	}
+
+	if m.retention[instanceID].FinalBackup {
+		// Completed by CleanUp, standing in for the final backup
+		inst.Deprovisioning = true
+		m.instances[instanceID] = inst
+		return nil
+	}
+	m.forget(instanceID)
+
+	return nil
+}
+
+// forget removes a deleted instance, keeping its name taken while volumes
+// are retained. Retained volumes do not expire in the mock
+func (m *Mock) forget(instanceID string) {
+	inst, ret := m.instances[instanceID], m.retention[instanceID]
+	if ret.BackupDays > 0 || !ret.DeleteData {
+		m.retained[inst.Namespace+"/"+inst.ClusterName] = true
+	}
 	delete(m.instances, instanceID)
+	delete(m.retention, instanceID)
+	delete(m.protected, instanceID)
+	delete(m.force, instanceID)
+	delete(m.requests, instanceID)
+}
+
+// CleanUp completes the deletion of instances awaiting a final backup,
+// deletes expired bindings and rotates binding passwords which are due
+func (m *Mock) CleanUp() error {
+	m.Lock()
+	defer m.Unlock()
+
+	for id, inst := range m.instances {
+		if inst.Deprovisioning {
+			m.forget(id)
+		}
+	}
+
+	now := time.Now().UTC()
+	for key, rec := range m.records {
+		if rec.ExpiresAt != nil && now.After(*rec.ExpiresAt) {
+			delete(m.bindings, key)
+			delete(m.records, key)
+			delete(m.rotations, key)
+			continue
+		}
+		if rec.GraceUntil != nil && !now.Before(*rec.GraceUntil) {
+			rec.GraceUntil = nil
+			m.records[key] = rec
+		}
+		last := rec.CreatedAt
+		if rec.RotatedAt != nil {
+			last = *rec.RotatedAt
+		}
+		if m.rotation.Interval > 0 && rec.GraceUntil == nil && !rec.ClientCert && now.Sub(last) >= m.rotation.Interval {
+			m.rotate(key, rec, m.rotation.Grace, now)
+		}
+	}
 
 	return nil
 }
 
-func (m *Mock) CreateBinding(instanceID, bindID, appID string) (BasicCred, error) {
+// SetRotationPolicy sets the schedule CleanUp rotates binding passwords on
+func (m *Mock) SetRotationPolicy(p RotationPolicy) {
 	m.Lock()
 	defer m.Unlock()
 
-	if _, ok := m.instances[instanceID]; !ok {
+	m.rotation = p
+}
+
+// SetClientCA enables client certificate bindings, which the Mock issues
+// from a CA of its own rather than reading the Secret
+func (m *Mock) SetClientCA(secret string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if secret == "" {
+		m.clientCA = nil
+		return
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pgo-osb mock client CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(2 * clientCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	m.clientCA = &clientCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (m *Mock) CreateBinding(req BindRequest) (BasicCred, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	instanceID, bindID := req.InstanceID, req.BindingID
+	inst, ok := m.instances[instanceID]
+	if !ok {
 		return BasicCred{}, ErrNoInstance{instanceID}
 	}
+	if m.busy[instanceID] || inst.Deprovisioning {
+		return BasicCred{}, ErrConcurrency{instanceID}
+	}
+
+	switch req.Access {
+	case AccessReadOnly, AccessReadWrite, AccessOwner:
+	default:
+		return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("unknown access level %q", req.Access)}}
+	}
+	if req.Isolation == "" {
+		req.Isolation = IsolationShared
+	}
+	if req.PgBouncer && inst.PgBouncer.Name == "" {
+		return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("instance %s has no pgBouncer", instanceID)}}
+	}
+	if inst.StandbyOf != "" && (req.Access != AccessReadOnly || req.Isolation != IsolationShared) {
+		return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("instance %s is a standby, which only takes %s bindings in the %s database", instanceID, AccessReadOnly, IsolationShared)}}
+	}
+	if err := req.PasswordPolicy.Validate(); err != nil {
+		return BasicCred{}, err
+	}
+	if err := req.Limits.Validate(); err != nil {
+		return BasicCred{}, ErrInvalidParams{Violations: []string{err.Error()}}
+	}
+	if req.ClientCert {
+		switch {
+		case req.PgBouncer:
+			return BasicCred{}, ErrInvalidParams{Violations: []string{"client certificates cannot be used through pgBouncer"}}
+		case m.clientCA == nil:
+			return BasicCred{}, ErrInvalidParams{Violations: []string{"client certificates are not enabled for the broker"}}
+		case !inst.TLS:
+			return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("instance %s has no TLS", instanceID)}}
+		}
+	}
+
+	switch req.Type {
+	case "", BindingMonitoring:
+	case BindingReplication:
+		if req.PgBouncer {
+			return BasicCred{}, ErrInvalidParams{Violations: []string{"pgBouncer does not authenticate replication roles"}}
+		}
+	default:
+		return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("unknown binding type %q", req.Type)}}
+	}
 
 	key := fmt.Sprintf("%s:%s", instanceID, bindID)
+	var others []BindingRecord
+	for k, other := range m.records {
+		if k == key || !strings.HasPrefix(k, instanceID+":") {
+			continue
+		}
+		others = append(others, other)
+		if req.Publication != "" && other.Publication == req.Publication {
+			return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("publication %s belongs to binding %s", req.Publication, other.BindingID)}
+		}
+		if req.Slot != "" && other.Slot == req.Slot {
+			return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("replication slot %s belongs to binding %s", req.Slot, other.BindingID)}
+		}
+	}
+	rec, recorded := m.records[key]
+	if !recorded {
+		if err := checkNetworkPolicy(others, req); err != nil {
+			return BasicCred{}, err
+		}
+	}
+	if !recorded && req.Publication != "" && req.Publication == MockStatic.Publication {
+		return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("publication %s exists and does not belong to a binding", req.Publication)}
+	}
+	if !recorded && req.Slot != "" && req.Slot == MockStatic.Slot {
+		return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("replication slot %s exists and does not belong to a binding", req.Slot)}
+	}
+	if recorded && (rec.Access != req.Access || rec.Isolation != req.Isolation ||
+		rec.KeepOnUnbind != req.KeepOnUnbind || rec.PgBouncer != req.PgBouncer ||
+		rec.AppNamespace != req.AppNamespace || rec.Predecessor != req.PredecessorID || rec.ClientCert != req.ClientCert ||
+		rec.Type != req.Type || rec.Publication != req.Publication || rec.Slot != req.Slot || rec.roleLimits() != req.Limits) {
+		return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("binding %s exists with different parameters", bindID)}
+	}
+	if recorded && rec.ExpiresAt != nil && time.Now().After(*rec.ExpiresAt) {
+		return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("binding %s expired at %s", bindID, rec.ExpiresAt.Format(time.RFC3339))}
+	}
+	if cred, ok := m.bindings[key]; ok {
+		return cred, nil
+	}
+	predKey := fmt.Sprintf("%s:%s", instanceID, req.PredecessorID)
+	pred, hasPred := m.records[predKey]
+	if req.PredecessorID != "" {
+		if !hasPred {
+			return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("predecessor_binding_id: binding %s does not exist", req.PredecessorID)}}
+		}
+		if pred.Isolation != req.Isolation {
+			return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("predecessor_binding_id: binding %s has %s isolation", pred.BindingID, pred.Isolation)}}
+		}
+		if pred.Successor != "" && pred.Successor != bindID {
+			return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("binding %s was already succeeded by binding %s", pred.BindingID, pred.Successor)}
+		}
+	}
 	h := md5.New()
 	io.WriteString(h, bindID)
 	user := fmt.Sprintf("user_%x", h.Sum(nil))
-	m.bindings[key] = BasicCred{
-		Username: user,
-		Password: MockStatic.Password,
+	if !recorded {
+		rec = BindingRecord{
+			BindingID:    bindID,
+			Role:         user,
+			Access:       req.Access,
+			Isolation:    req.Isolation,
+			KeepOnUnbind: req.KeepOnUnbind,
+			PgBouncer:    req.PgBouncer,
+			AppNamespace: req.AppNamespace,
+			AppGUID:      req.AppID,
+			CreatedAt:    time.Now().UTC(),
+			Predecessor:  req.PredecessorID,
+		}
+		if req.Lifetime > 0 {
+			expires := rec.CreatedAt.Add(req.Lifetime)
+			rec.ExpiresAt = &expires
+		}
+		if hasPred && req.Isolation != IsolationShared {
+			rec.DataName = pred.dataName()
+		}
+		if !req.PasswordPolicy.IsZero() {
+			policy := req.PasswordPolicy
+			rec.PasswordPolicy = &policy
+		}
+		rec.ClientCert = req.ClientCert
+		rec.Type, rec.Publication, rec.Slot = req.Type, req.Publication, req.Slot
+		if !req.Limits.IsZero() {
+			limits := req.Limits
+			rec.Limits = &limits
+		}
+		m.records[key] = rec
+	}
+	if hasPred {
+		pred.Successor = bindID
+		m.records[predKey] = pred
 	}
+	cred := BasicCred{
+		Username:  user,
+		Password:  MockStatic.Password,
+		ExpiresAt: rec.ExpiresAt,
+	}
+	if policy := rec.passwordPolicy(); !policy.IsZero() {
+		pw, err := policy.generate()
+		if err != nil {
+			return BasicCred{}, err
+		}
+		cred.Password = pw
+	}
+	if rec.ClientCert {
+		notAfter := time.Now().Add(clientCertValidity)
+		if rec.ExpiresAt != nil {
+			notAfter = *rec.ExpiresAt
+		}
+		certPEM, keyPEM, err := m.clientCA.issue(user, notAfter)
+		if err != nil {
+			return BasicCred{}, err
+		}
+		cred.Password = ""
+		cred.ClientCert, cred.ClientKey, cred.ClientCA = string(certPEM), string(keyPEM), string(m.clientCA.pem)
+	}
+	switch req.Isolation {
+	case IsolationSchema:
+		cred.Schema = rec.dataName()
+	case IsolationDatabase:
+		cred.Database = rec.dataName()
+	}
+	m.bindings[key] = cred
 
 	return m.bindings[key], nil
 }
@@ -112,8 +546,107 @@ func (m *Mock) DeleteBinding(instanceID, bindID string) error {
 	m.Lock()
 	defer m.Unlock()
 
+	if _, ok := m.instances[instanceID]; !ok {
+		return ErrNoInstance{instanceID}
+	}
+
 	key := fmt.Sprintf("%s:%s", instanceID, bindID)
+	if _, ok := m.bindings[key]; !ok {
+		return ErrNoBinding{InstanceID: instanceID, BindID: bindID}
+	}
 	delete(m.bindings, key)
+	delete(m.records, key)
+	delete(m.rotations, key)
 
 	return nil
 }
+
+func (m *Mock) RotateBinding(req RotateRequest) (BindingRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.instances[req.InstanceID]; !ok {
+		return BindingRecord{}, ErrNoInstance{req.InstanceID}
+	}
+	if m.busy[req.InstanceID] {
+		return BindingRecord{}, ErrConcurrency{req.InstanceID}
+	}
+
+	key := fmt.Sprintf("%s:%s", req.InstanceID, req.BindingID)
+	rec, ok := m.records[key]
+	if !ok {
+		return BindingRecord{}, ErrNoBinding{InstanceID: req.InstanceID, BindID: req.BindingID}
+	}
+
+	return m.rotate(key, rec, req.Grace, time.Now().UTC())
+}
+
+// rotate simulates rotating the password of a binding, numbering the
+// passwords it hands out
+func (m *Mock) rotate(key string, rec BindingRecord, grace time.Duration, now time.Time) (BindingRecord, error) {
+	if rec.ExpiresAt != nil && now.After(*rec.ExpiresAt) {
+		return BindingRecord{}, ErrConflict{Reason: fmt.Sprintf("binding %s expired at %s", rec.BindingID, rec.ExpiresAt.Format(time.RFC3339))}
+	}
+	if rec.ClientCert {
+		return BindingRecord{}, ErrConflict{Reason: fmt.Sprintf("binding %s authenticates with a client certificate", rec.BindingID)}
+	}
+	if rec.GraceUntil != nil && now.Before(*rec.GraceUntil) {
+		return BindingRecord{}, ErrConflict{Reason: fmt.Sprintf("binding %s keeps its previous password until %s",
+			rec.BindingID, rec.GraceUntil.Format(time.RFC3339))}
+	}
+	rec.GraceUntil = nil
+
+	role := rec.activeRole()
+	if grace > 0 {
+		if rec.AlternateRole == "" {
+			rec.AlternateRole = alternateRole(rec.Role)
+		}
+		role = rec.inactiveRole()
+	}
+	m.rotations[key]++
+	cred := m.bindings[key]
+	cred.Username = role
+	cred.Password = fmt.Sprintf("%s%d", MockStatic.Password, m.rotations[key])
+	if policy := rec.passwordPolicy(); !policy.IsZero() {
+		pw, err := policy.generate()
+		if err != nil {
+			return BindingRecord{}, err
+		}
+		cred.Password = pw
+	}
+	m.bindings[key] = cred
+
+	rec.ActiveRole = ""
+	if role != rec.Role {
+		rec.ActiveRole = role
+	}
+	rec.RotatedAt = &now
+	if grace > 0 {
+		until := now.Add(grace)
+		rec.GraceUntil = &until
+	}
+	m.records[key] = rec
+
+	return rec, nil
+}
+
+func (m *Mock) ListBindings(instanceID string) ([]BindingRecord, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if _, ok := m.instances[instanceID]; !ok {
+		return nil, ErrNoInstance{instanceID}
+	}
+
+	var recs []BindingRecord
+	for key, rec := range m.records {
+		if strings.HasPrefix(key, instanceID+":") {
+			recs = append(recs, rec)
+		}
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].CreatedAt.Before(recs[j].CreatedAt)
+	})
+
+	return recs, nil
+}
@@ -0,0 +1,150 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Bindings may be given a NetworkPolicy of their own, admitting their app's
+// namespace to the database port of the instance. NetworkPolicies are
+// additive, so the instance admits the namespaces of all such bindings, and
+// is open to everyone again once the last of them is unbound. The namespaces
+// of bindings without a NetworkPolicy are not known, so the first policy of
+// an instance is refused while they would be cut off
+
+// namespaceNameLabel is set by Kubernetes 1.21+ on every namespace
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// networkPolicyName is the name of the NetworkPolicy of a binding
+func networkPolicyName(bindID string) string {
+	return "pgo-osb-binding-" + strings.ToLower(bindID)
+}
+
+// bindingNetworkPolicy returns the NetworkPolicy admitting the app namespace
+// of a binding to the database port of a cluster. Selecting the cluster
+// closes it to all other traffic, so the cluster's own namespace, whose pods
+// replicate, back up and pool connections to it, is admitted on every port,
+// and the namespaces the operator and broker manage it from on the database
+// port
+func (po *PGOperator) bindingNetworkPolicy(cluster *crv1.Pgcluster, bindID string, req BindRequest) *networkingv1.NetworkPolicy {
+	tcp := corev1.ProtocolTCP
+	port := intstr.FromInt(clusterPort(cluster))
+
+	var peers []networkingv1.NetworkPolicyPeer
+	for _, ns := range append([]string{req.AppNamespace}, req.AllowNamespaces...) {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{namespaceNameLabel: ns},
+			},
+		})
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      networkPolicyName(bindID),
+			Namespace: cluster.GetNamespace(),
+			Labels: map[string]string{
+				po.instLabelKey: cluster.Labels[po.instLabelKey],
+				po.bindLabelKey: bindID,
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{"pg-cluster": cluster.GetName()},
+			},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+					From:  peers,
+				},
+				{
+					From: []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}},
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		},
+	}
+}
+
+// checkNetworkPolicy rejects a binding asking for a NetworkPolicy while
+// other bindings of the instance, recorded in recs, have none, as its policy
+// would close the instance to their apps. Likewise, a binding without a
+// policy is rejected while others have one, as its apps would be cut off
+// from the instance. Expired bindings are left to the reaper
+func checkNetworkPolicy(recs []BindingRecord, req BindRequest) error {
+	now := time.Now()
+	for _, rec := range recs {
+		if rec.BindingID == req.BindingID || rec.ExpiresAt != nil && now.After(*rec.ExpiresAt) {
+			continue
+		}
+		if req.AppNamespace != "" && rec.AppNamespace == "" {
+			return ErrConflict{Reason: fmt.Sprintf("binding %s has no network policy and would be cut off from the instance", rec.BindingID)}
+		}
+		if req.AppNamespace == "" && rec.AppNamespace != "" {
+			return ErrConflict{Reason: fmt.Sprintf("binding %s has a network policy, so app_namespace is required to reach the instance", rec.BindingID)}
+		}
+	}
+	return nil
+}
+
+// createNetworkPolicy creates the NetworkPolicy of a binding, leaving one
+// created by an earlier attempt at the same binding in place
+func (po *PGOperator) createNetworkPolicy(cluster *crv1.Pgcluster, bindID string, req BindRequest) error {
+	np := po.bindingNetworkPolicy(cluster, bindID, req)
+	_, err := po.clientset.NetworkingV1().NetworkPolicies(np.GetNamespace()).Create(context.Background(), np, metav1.CreateOptions{})
+	if err != nil && !kerrors.IsAlreadyExists(err) {
+		return err
+	}
+	log.Printf("admitted namespace %s to cluster %s for binding %s\n", req.AppNamespace, cluster.GetName(), bindID)
+
+	return nil
+}
+
+// deleteNetworkPolicy deletes the NetworkPolicy of a binding, if any
+func (po *PGOperator) deleteNetworkPolicy(cluster *crv1.Pgcluster, bindID string) error {
+	err := po.clientset.NetworkingV1().NetworkPolicies(cluster.GetNamespace()).Delete(context.Background(), networkPolicyName(bindID), metav1.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// deleteNetworkPolicies deletes the NetworkPolicies left of the bindings of
+// a deleted cluster, which would otherwise apply to a later cluster of the
+// same name. Failures are logged only, as the cluster is already gone
+func (po *PGOperator) deleteNetworkPolicies(cluster *crv1.Pgcluster) {
+	selector := po.instLabel(cluster.Labels[po.instLabelKey])
+	err := po.clientset.NetworkingV1().NetworkPolicies(cluster.GetNamespace()).DeleteCollection(context.Background(), metav1.DeleteOptions{}, metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		log.Printf("error deleting network policies of cluster %s: %s\n", cluster.GetName(), err)
+	}
+}
@@ -0,0 +1,52 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnitCheckNetworkPolicy(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	open := BindingRecord{BindingID: "open"}
+	fenced := BindingRecord{BindingID: "fenced", AppNamespace: "unitapp"}
+	withPolicy := BindRequest{BindingID: "new", AppNamespace: "unitapp"}
+	withoutPolicy := BindRequest{BindingID: "new"}
+
+	tests := []struct {
+		name     string
+		recs     []BindingRecord
+		req      BindRequest
+		conflict bool
+	}{
+		{"first with policy", nil, withPolicy, false},
+		{"first without policy", nil, withoutPolicy, false},
+		{"policy after policy", []BindingRecord{fenced}, withPolicy, false},
+		{"open after open", []BindingRecord{open}, withoutPolicy, false},
+		{"policy after open", []BindingRecord{open}, withPolicy, true},
+		{"open after policy", []BindingRecord{fenced}, withoutPolicy, true},
+		{"open after expired policy", []BindingRecord{{BindingID: "fenced", AppNamespace: "unitapp", ExpiresAt: &expired}}, withoutPolicy, false},
+		{"policy after expired open", []BindingRecord{{BindingID: "open", ExpiresAt: &expired}}, withPolicy, false},
+		{"rebinding itself", []BindingRecord{{BindingID: "new", AppNamespace: "unitapp"}}, withoutPolicy, false},
+	}
+	for _, tt := range tests {
+		err := checkNetworkPolicy(tt.recs, tt.req)
+		if _, ok := err.(ErrConflict); ok != tt.conflict {
+			t.Errorf("%s: expected conflict %t, got %v", tt.name, tt.conflict, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+	msgs "github.com/crunchydata/postgres-operator/pkg/apiservermsgs"
+)
+
+// Binding passwords are generated by the operator unless a password policy
+// applies, in which case the broker generates them itself, as the operator
+// offers no control over the characters used
+
+// defaultPasswordLength is the length of passwords generated by the
+// operator, and of those of policies not setting one
+const defaultPasswordLength = 16
+
+// scramPasswordType has the operator store the SCRAM-SHA-256 verifier of a
+// password rather than its MD5 hash
+const scramPasswordType = "scram-sha-256"
+
+// CharClass is a class of characters a generated password may be required
+// to contain
+type CharClass string
+
+const (
+	CharLower  CharClass = "lower"
+	CharUpper  CharClass = "upper"
+	CharDigit  CharClass = "digit"
+	CharSymbol CharClass = "symbol"
+)
+
+// charClasses are the characters of each class. Symbols exclude quotes,
+// backslashes and spaces, which are easily mangled by shells and config
+// files the credentials end up in
+var charClasses = map[CharClass]string{
+	CharLower:  "abcdefghijklmnopqrstuvwxyz",
+	CharUpper:  "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	CharDigit:  "0123456789",
+	CharSymbol: "!#%*+,-.:;=?@^_~",
+}
+
+// PasswordPolicy constrains the passwords of binding roles. The zero value
+// leaves them to the operator
+type PasswordPolicy struct {
+	// Length of generated passwords, defaultPasswordLength when zero
+	Length int `json:"length,omitempty"`
+	// Classes a generated password has at least one character of, and
+	// draws all of its characters from. Lower and upper case letters and
+	// digits when empty
+	Classes []CharClass `json:"classes,omitempty"`
+	// SCRAMOnly stores passwords as SCRAM-SHA-256 verifiers, which is
+	// verified after each password change
+	SCRAMOnly bool `json:"scram_only,omitempty"`
+}
+
+// IsZero reports whether the policy leaves passwords to the operator
+func (p PasswordPolicy) IsZero() bool {
+	return p.Length == 0 && len(p.Classes) == 0 && !p.SCRAMOnly
+}
+
+// Validate checks that passwords can be generated following the policy
+func (p PasswordPolicy) Validate() error {
+	for _, c := range p.Classes {
+		if _, ok := charClasses[c]; !ok {
+			return fmt.Errorf("unknown character class %q", c)
+		}
+	}
+	if p.Length < 0 || p.Length > 0 && p.Length < len(p.classes()) {
+		return fmt.Errorf("password length %d cannot hold a character of each of %d classes", p.Length, len(p.classes()))
+	}
+	return nil
+}
+
+func (p PasswordPolicy) length() int {
+	if p.Length == 0 {
+		return defaultPasswordLength
+	}
+	return p.Length
+}
+
+func (p PasswordPolicy) classes() []CharClass {
+	if len(p.Classes) == 0 {
+		return []CharClass{CharLower, CharUpper, CharDigit}
+	}
+	return p.Classes
+}
+
+// generate returns a random password following the policy
+func (p PasswordPolicy) generate() (string, error) {
+	if err := p.Validate(); err != nil {
+		return "", err
+	}
+
+	var all strings.Builder
+	pw := make([]byte, 0, p.length())
+	for _, c := range p.classes() {
+		chars := charClasses[c]
+		all.WriteString(chars)
+		b, err := randomChar(chars)
+		if err != nil {
+			return "", err
+		}
+		pw = append(pw, b)
+	}
+	for len(pw) < p.length() {
+		b, err := randomChar(all.String())
+		if err != nil {
+			return "", err
+		}
+		pw = append(pw, b)
+	}
+
+	// The characters guaranteed for each class would otherwise lead
+	for i := len(pw) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		pw[i], pw[j.Int64()] = pw[j.Int64()], pw[i]
+	}
+
+	return string(pw), nil
+}
+
+func randomChar(chars string) (byte, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+	if err != nil {
+		return 0, err
+	}
+	return chars[i.Int64()], nil
+}
+
+// applyCreate sets the password of a request creating a binding role
+func (p PasswordPolicy) applyCreate(req *msgs.CreateUserRequest) error {
+	req.PasswordLength = defaultPasswordLength
+	if p.IsZero() {
+		return nil
+	}
+
+	pw, err := p.generate()
+	if err != nil {
+		return err
+	}
+	req.Password, req.PasswordLength = pw, len(pw)
+	if p.SCRAMOnly {
+		req.PasswordType = scramPasswordType
+	}
+	return nil
+}
+
+// applyUpdate sets a new password on a request updating a binding role
+func (p PasswordPolicy) applyUpdate(req *msgs.UpdateUserRequest) error {
+	req.PasswordLength = defaultPasswordLength
+	if p.IsZero() {
+		req.RotatePassword = true
+		return nil
+	}
+
+	pw, err := p.generate()
+	if err != nil {
+		return err
+	}
+	req.Password, req.PasswordLength = pw, len(pw)
+	if p.SCRAMOnly {
+		req.PasswordType = scramPasswordType
+	}
+	return nil
+}
+
+// passwordPolicy is the policy the passwords of a binding follow
+func (rec BindingRecord) passwordPolicy() PasswordPolicy {
+	if rec.PasswordPolicy == nil {
+		return PasswordPolicy{}
+	}
+	return *rec.PasswordPolicy
+}
+
+// verifySCRAM checks that the passwords of roles are stored as
+// SCRAM-SHA-256 verifiers, which clients can only authenticate against using
+// SCRAM. The operator may otherwise fall back to the password_encryption of
+// the cluster
+func (po *PGOperator) verifySCRAM(hc *http.Client, cluster *crv1.Pgcluster, roles ...string) error {
+	db, err := po.openDB(hc, cluster)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, role := range roles {
+		var scram bool
+		err := db.QueryRow("SELECT COALESCE(rolpassword LIKE 'SCRAM-SHA-256$%', false) FROM pg_catalog.pg_authid WHERE rolname = $1", role).Scan(&scram)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("role %s does not exist", role)
+		}
+		if err != nil {
+			return ErrBackendUnavailable{err}
+		}
+		if !scram {
+			return fmt.Errorf("password of role %s is not a SCRAM-SHA-256 verifier", role)
+		}
+	}
+	return nil
+}
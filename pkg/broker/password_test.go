@@ -0,0 +1,58 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnitPasswordPolicyGenerate(t *testing.T) {
+	policies := []PasswordPolicy{
+		{},
+		{Length: 3, Classes: []CharClass{CharLower, CharDigit, CharSymbol}},
+		{Length: 48, Classes: []CharClass{CharLower, CharUpper, CharDigit, CharSymbol}},
+	}
+	for _, p := range policies {
+		pw, err := p.generate()
+		if err != nil {
+			t.Fatalf("error generating a password for %+v: %s", p, err)
+		}
+		if len(pw) != p.length() {
+			t.Errorf("expected %d characters for %+v, got %q", p.length(), p, pw)
+		}
+		var all string
+		for _, c := range p.classes() {
+			all += charClasses[c]
+			if !strings.ContainsAny(pw, charClasses[c]) {
+				t.Errorf("expected a %s character for %+v, got %q", c, p, pw)
+			}
+		}
+		if strings.Trim(pw, all) != "" {
+			t.Errorf("expected only characters of %v, got %q", p.classes(), pw)
+		}
+	}
+
+	for _, p := range []PasswordPolicy{
+		{Length: 2, Classes: []CharClass{CharLower, CharUpper, CharDigit}},
+		{Classes: []CharClass{"emoji"}},
+		{Length: -1},
+	} {
+		if _, err := p.generate(); err == nil {
+			t.Errorf("expected an error for %+v", p)
+		}
+	}
+}
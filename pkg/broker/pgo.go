@@ -19,6 +19,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -28,11 +29,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/crunchydata/postgres-operator/cmd/pgo/api"
 	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
 	msgs "github.com/crunchydata/postgres-operator/pkg/apiservermsgs"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
@@ -40,29 +45,71 @@ const (
 	// Could be in New only, but reinforces the DON'T TOUCH nature
 	_INSTANCE_LABEL_KEY = "pgo-osb-instance"
 	_BIND_LABEL_KEY     = "pgo-osb-bindid"
+	_PLAN_LABEL_KEY     = "pgo-osb-plan"
+	_STANDBY_LABEL_KEY  = "pgo-osb-standby-of"
+	_REQUEST_LABEL_KEY  = "pgo-osb-request"
+
+	// Retention settings of a cluster and the state of its deprovisioning
+	_FINAL_BACKUP_LABEL_KEY  = "pgo-osb-final-backup"
+	_BACKUP_DAYS_LABEL_KEY   = "pgo-osb-backup-retention-days"
+	_DELETE_DATA_LABEL_KEY   = "pgo-osb-delete-data"
+	_DEPROVISIONED_LABEL_KEY = "pgo-osb-deprovisioned"
+	_EXPIRES_LABEL_KEY       = "pgo-osb-expires"
+
+	// _PROTECTION_LABEL_KEY blocks deprovisioning when "true".
+	// _FORCE_DELETE_LABEL_KEY is only ever set by administrators, through
+	// the Kubernetes API, to revoke remaining bindings on deprovision
+	_PROTECTION_LABEL_KEY   = "pgo-osb-deletion-protection"
+	_FORCE_DELETE_LABEL_KEY = "pgo-osb-force-delete"
+
+	// _RESTRICT_PUBLIC_LABEL_KEY is "true" for clusters whose public schema
+	// is to be restricted, and restrictPublicApplied once it is
+	_RESTRICT_PUBLIC_LABEL_KEY = "pgo-osb-restrict-public-schema"
+	restrictPublicApplied      = "applied"
+
+	// _LEGACY_ROLES_LABEL_KEY is legacyRolesMigrated once the roles of
+	// bindings made before the registry existed were migrated, which
+	// clusters created since never need
+	_LEGACY_ROLES_LABEL_KEY = "pgo-osb-legacy-roles"
+	legacyRolesMigrated     = "migrated"
 )
 
+// pgBackRestTimeFormat is the layout of recovery targets passed to pgBackRest
+const pgBackRestTimeFormat = "2006-01-02 15:04:05.999999-07:00"
+
 type PGOperator struct {
 	remoteURL    string
 	bindLabelKey string
 	clientVer    string
 	instLabelKey string
+	planLabelKey string
+	stbyLabelKey string
 	kubeClient   *rest.RESTClient
+	clientset    kubernetes.Interface
 	pgoCreds     msgs.BasicAuthCredentials
 	nsLookup     map[string]string
 	nsMutex      sync.RWMutex
+	rotation     RotationPolicy
+
+	clientCASecret string
 }
 
 // NewPGOperator sets up authentication information for a PGO client
-func NewPGOperator(KubeClient *rest.RESTClient, APIServerURL, basicAuthUsername, basicAuthPassword, clientVersion string) (*PGOperator, error) {
+func NewPGOperator(KubeClient *rest.RESTClient, Clientset kubernetes.Interface, APIServerURL, basicAuthUsername, basicAuthPassword, clientVersion string) (*PGOperator, error) {
 	if KubeClient == nil {
 		return nil, errors.New("KubeClient cannot be nil")
 	}
+	if Clientset == nil {
+		return nil, errors.New("Clientset cannot be nil")
+	}
 	po := &PGOperator{
 		bindLabelKey: _BIND_LABEL_KEY,
 		clientVer:    clientVersion,
 		instLabelKey: _INSTANCE_LABEL_KEY,
+		planLabelKey: _PLAN_LABEL_KEY,
+		stbyLabelKey: _STANDBY_LABEL_KEY,
 		kubeClient:   KubeClient,
+		clientset:    Clientset,
 		nsLookup:     map[string]string{},
 		pgoCreds: msgs.BasicAuthCredentials{
 			APIServerURL: APIServerURL,
@@ -98,27 +145,14 @@ func (po *PGOperator) findInstanceNamespace(instID string) (string, error) {
 		return ns, nil
 	} else {
 		po.nsMutex.RUnlock()
-		selector := po.instLabel(instID)
-		log.Print("find cluster " + selector)
-
-		clusterList := &crv1.PgclusterList{}
-		err := po.kubeClient.Get().
-			Resource(crv1.PgclusterResourcePlural).
-			Param("labelSelector", selector).
-			Do(context.Background()).
-			Into(clusterList)
+
+		cluster, err := po.getCluster(instID)
 		if err != nil {
 			return "", err
 		}
-		if l := len(clusterList.Items); l > 1 {
-			log.Printf("Found %d clusters for instance id %s, using first in list", l, instID)
-		} else if l == 0 {
-			log.Printf("Found no clusters for instance id %s", instID)
-			return "", errors.New("cluster for instanceID " + instID + " not found by selector")
-		}
 
 		po.nsMutex.Lock()
-		ns := clusterList.Items[0].GetNamespace()
+		ns := cluster.GetNamespace()
 		po.nsLookup[instID] = ns
 		po.nsMutex.Unlock()
 
@@ -126,6 +160,95 @@ func (po *PGOperator) findInstanceNamespace(instID string) (string, error) {
 	}
 }
 
+// getCluster looks up the cluster for a given instID across all namespaces,
+// bypassing the namespace cache
+func (po *PGOperator) getCluster(instID string) (*crv1.Pgcluster, error) {
+	selector := po.instLabel(instID)
+	log.Print("find cluster " + selector)
+
+	clusterList := &crv1.PgclusterList{}
+	err := po.kubeClient.Get().
+		Resource(crv1.PgclusterResourcePlural).
+		Param("labelSelector", selector).
+		Do(context.Background()).
+		Into(clusterList)
+	if err != nil {
+		return nil, ErrBackendUnavailable{err}
+	}
+	if l := len(clusterList.Items); l > 1 {
+		log.Printf("Found %d clusters for instance id %s, using first in list", l, instID)
+	} else if l == 0 {
+		log.Printf("Found no clusters for instance id %s", instID)
+		return nil, ErrNoInstance{ID: instID}
+	}
+
+	return &clusterList.Items[0], nil
+}
+
+// checkClusterName ensures no cluster named name exists in the namespace,
+// so that collisions are reported before anything is created. The volumes
+// retained after a cluster named name was deleted would be adopted by a new
+// cluster of the same name, so the name is refused until they expire
+func (po *PGOperator) checkClusterName(ns, name string) error {
+	clusterList := &crv1.PgclusterList{}
+	err := po.kubeClient.Get().
+		Namespace(ns).
+		Resource(crv1.PgclusterResourcePlural).
+		Do(context.Background()).
+		Into(clusterList)
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	for _, c := range clusterList.Items {
+		if c.GetName() == name {
+			return ErrConflict{Reason: fmt.Sprintf("cluster %s already exists in namespace %s", name, ns)}
+		}
+	}
+
+	pvcs, err := po.clientset.CoreV1().PersistentVolumeClaims(ns).List(context.Background(), metav1.ListOptions{
+		LabelSelector: "pg-cluster=" + name + "," + po.instLabelKey,
+	})
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	if len(pvcs.Items) > 0 {
+		return ErrConflict{Reason: fmt.Sprintf("volumes of a deleted cluster %s are retained in namespace %s", name, ns)}
+	}
+
+	return nil
+}
+
+// labelCluster adds or replaces labels on a cluster
+func (po *PGOperator) labelCluster(cluster *crv1.Pgcluster, labels map[string]string) error {
+	err := po.kubeClient.Patch(types.MergePatchType).
+		Namespace(cluster.GetNamespace()).
+		Resource(crv1.PgclusterResourcePlural).
+		Name(cluster.GetName()).
+		Body(labelPatch(labels)).
+		Do(context.Background()).
+		Error()
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+
+	return nil
+}
+
+// labelPatch returns a merge patch adding labels to an object
+func labelPatch(labels map[string]string) []byte {
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+	return patch
+}
+
+// forgetInstance removes a deleted instance from the namespace cache
+func (po *PGOperator) forgetInstance(instID string) {
+	po.nsMutex.Lock()
+	delete(po.nsLookup, instID)
+	po.nsMutex.Unlock()
+}
+
 // httpClient provides an http client based on the current state of bound
 // apiserver-keys
 // TODO: Poll cert changes and cache client between
@@ -235,7 +358,11 @@ func (po *PGOperator) createRequestByPlan(planID string, req *msgs.CreateCluster
 }
 
 // CreateBinding creates and/or returns binding information for a cluster
-func (po *PGOperator) CreateBinding(instanceID, bindID, appID string) (BasicCred, error) {
+func (po *PGOperator) CreateBinding(req BindRequest) (BasicCred, error) {
+	instanceID, bindID, appID := req.InstanceID, req.BindingID, req.AppID
+	if req.Isolation == "" {
+		req.Isolation = IsolationShared
+	}
 	log.Printf("CreateBinding called %s\n", instanceID)
 	log.Printf("Binding: %s\n", bindID)
 	if appID != "" {
@@ -243,33 +370,109 @@ func (po *PGOperator) CreateBinding(instanceID, bindID, appID string) (BasicCred
 	}
 	hc, err := po.httpClient()
 	if err != nil {
-		return BasicCred{}, err
+		return BasicCred{}, ErrBackendUnavailable{err}
 	}
 
-	ns, err := po.findInstanceNamespace(instanceID)
+	cluster, err := po.getCluster(instanceID)
 	if err != nil {
 		log.Printf("error finding instance in CreateBinding: %s\n", err)
 		return BasicCred{}, err
 	}
+	if cluster.Status.State != crv1.PgclusterStateInitialized {
+		log.Printf("cluster for instance %s not ready: %s\n", instanceID, cluster.Status.State)
+		return BasicCred{}, ErrConcurrency{ID: instanceID}
+	}
+	if _, ok := cluster.Labels[_DEPROVISIONED_LABEL_KEY]; ok {
+		log.Printf("instance %s is being deprovisioned\n", instanceID)
+		return BasicCred{}, ErrConcurrency{ID: instanceID}
+	}
+	if req.PgBouncer && !cluster.Spec.PgBouncer.Enabled() {
+		return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("instance %s has no pgBouncer", instanceID)}}
+	}
+	// The roles of standbys are created on their source, which they would
+	// otherwise be able to write to
+	if cluster.Spec.Standby && (req.Access != AccessReadOnly || req.Isolation != IsolationShared) {
+		return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("instance %s is a standby, which only takes %s bindings in the %s database", instanceID, AccessReadOnly, IsolationShared)}}
+	}
+	rec, recorded := findBindingRecord(cluster, bindID)
+	if recorded && rec.Access != "" && (rec.Access != req.Access ||
+		rec.Isolation != req.Isolation || rec.KeepOnUnbind != req.KeepOnUnbind || rec.PgBouncer != req.PgBouncer ||
+		rec.AppNamespace != req.AppNamespace || rec.Predecessor != req.PredecessorID || rec.ClientCert != req.ClientCert ||
+		rec.Type != req.Type || rec.Publication != req.Publication || rec.Slot != req.Slot || rec.roleLimits() != req.Limits) {
+		return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("binding %s exists with different parameters", bindID)}
+	}
+	if recorded && rec.ExpiresAt != nil && time.Now().After(*rec.ExpiresAt) {
+		return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("binding %s expired at %s", bindID, rec.ExpiresAt.Format(time.RFC3339))}
+	}
+	var pred BindingRecord
+	if !recorded && req.PredecessorID != "" {
+		var ok bool
+		if pred, ok = findBindingRecord(cluster, req.PredecessorID); !ok {
+			return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("predecessor_binding_id: binding %s does not exist", req.PredecessorID)}}
+		}
+		if pred.Isolation == "" {
+			pred.Isolation = IsolationShared
+		}
+		if pred.Isolation != req.Isolation {
+			return BasicCred{}, ErrInvalidParams{Violations: []string{fmt.Sprintf("predecessor_binding_id: binding %s has %s isolation", pred.BindingID, pred.Isolation)}}
+		}
+		if pred.Successor != "" && pred.Successor != bindID {
+			return BasicCred{}, ErrConflict{Reason: fmt.Sprintf("binding %s was already succeeded by binding %s", pred.BindingID, pred.Successor)}
+		}
+	}
+	if err := checkReplication(cluster, req); err != nil {
+		return BasicCred{}, err
+	}
+	if !recorded {
+		if err := checkNetworkPolicy(bindingRecords(cluster), req); err != nil {
+			return BasicCred{}, err
+		}
+	}
+	if err := req.Limits.Validate(); err != nil {
+		return BasicCred{}, ErrInvalidParams{Violations: []string{err.Error()}}
+	}
+	var ca *clientCA
+	if req.ClientCert {
+		if req.PgBouncer {
+			return BasicCred{}, ErrInvalidParams{Violations: []string{"client certificates cannot be used through pgBouncer"}}
+		}
+		var err error
+		if ca, err = po.checkClientCA(cluster); err != nil {
+			log.Printf("error checking client CA for instance %s: %s\n", instanceID, err)
+			return BasicCred{}, err
+		}
+	}
+	wc, err := po.writableCluster(cluster)
+	if err != nil {
+		return BasicCred{}, err
+	}
+	ns, selector := wc.GetNamespace(), po.instLabel(wc.Labels[po.instLabelKey])
+	if !recorded {
+		if err := po.checkReplicationObjects(hc, wc, req); err != nil {
+			return BasicCred{}, err
+		}
+	}
 
 	nu, err := CompactUUIDString(bindID)
 	if err != nil {
-		return BasicCred{}, fmt.Errorf("unable to process bindID: %s\n", err)
+		return BasicCred{}, ErrInvalidParams{Violations: []string{"binding_id: " + err.Error()}}
 	}
 	newUser := fmt.Sprintf("user%s", strings.ToLower(nu))
 
 	cuReq := msgs.CreateUserRequest{
-		Username:       newUser,
-		Namespace:      ns,
-		Selector:       po.instLabel(instanceID),
-		ManagedUser:    true,
-		ClientVersion:  po.clientVer,
-		PasswordLength: 16,
+		Username:      newUser,
+		Namespace:     ns,
+		Selector:      selector,
+		ManagedUser:   true,
+		ClientVersion: po.clientVer,
+	}
+	if err := req.PasswordPolicy.applyCreate(&cuReq); err != nil {
+		return BasicCred{}, err
 	}
 	cuResp, err := api.CreateUser(hc, &po.pgoCreds, &cuReq)
 	if err != nil {
 		log.Printf("Unable to create user %s: %s\n", newUser, err)
-		return BasicCred{}, err
+		return BasicCred{}, ErrBackendUnavailable{err}
 	}
 	if cuResp.Code != msgs.Ok {
 		log.Printf("Unable to create user %s: %s\n", newUser, cuResp.Msg)
@@ -279,12 +482,12 @@ func (po *PGOperator) CreateBinding(instanceID, bindID, appID string) (BasicCred
 		AllFlag:       false,
 		ClientVersion: po.clientVer,
 		Namespace:     ns,
-		Selector:      po.instLabel(instanceID),
+		Selector:      selector,
 	}
 	suResp, err := api.ShowUser(hc, &po.pgoCreds, suReq)
 	if err != nil {
 		log.Printf("error getting user details: %s\n", err)
-		return BasicCred{}, err
+		return BasicCred{}, ErrBackendUnavailable{err}
 	}
 	if suResp.Status.Code != msgs.Ok {
 		m := suResp.Status.Msg
@@ -306,15 +509,131 @@ func (po *PGOperator) CreateBinding(instanceID, bindID, appID string) (BasicCred
 		credentials[s.Username] = s.Password
 	}
 
-	if pass, ok := credentials[newUser]; !ok {
+	// Bindings rotated with a grace period may have switched roles
+	activeUser := newUser
+	if recorded {
+		activeUser = rec.activeRole()
+	}
+	pass, ok := credentials[activeUser]
+	if !ok {
 		return BasicCred{}, errors.New("Unable to find newly created user in cluster users")
-	} else {
-		if pw, ok := pass.(string); ok {
-			return BasicCred{Username: newUser, Password: pw}, nil
-		} else {
-			return BasicCred{}, errors.New("Unrecognized type for password in API response")
+	}
+	pw, ok := pass.(string)
+	if !ok {
+		return BasicCred{}, errors.New("Unrecognized type for password in API response")
+	}
+
+	// Records made before access levels existed are granted as requested
+	grant := rec
+	if !recorded || rec.Access == "" {
+		grant = BindingRecord{
+			BindingID:    bindID,
+			Role:         newUser,
+			Access:       req.Access,
+			Isolation:    req.Isolation,
+			KeepOnUnbind: req.KeepOnUnbind,
+			PgBouncer:    req.PgBouncer,
+			AppNamespace: req.AppNamespace,
+			AppGUID:      appID,
+			CreatedAt:    time.Now().UTC(),
+			Predecessor:  req.PredecessorID,
+		}
+		if req.Lifetime > 0 {
+			expires := grant.CreatedAt.Add(req.Lifetime)
+			grant.ExpiresAt = &expires
+		}
+		if pred.Role != "" && req.Isolation != IsolationShared {
+			grant.DataName = pred.dataName()
+		}
+		if !req.PasswordPolicy.IsZero() {
+			policy := req.PasswordPolicy
+			grant.PasswordPolicy = &policy
+		}
+		grant.ClientCert = req.ClientCert
+		grant.Type, grant.Publication, grant.Slot = req.Type, req.Publication, req.Slot
+		if !req.Limits.IsZero() {
+			limits := req.Limits
+			grant.Limits = &limits
+		}
+	}
+
+	// Marked ahead of handing over its schema or database, so that
+	// unbinding the predecessor never drops what its successor was given
+	if pred.Role != "" && pred.Successor == "" {
+		pred.Successor = bindID
+		if err := po.recordBinding(cluster, pred); err != nil {
+			log.Printf("error recording binding %s: %s\n", pred.BindingID, err)
+			return BasicCred{}, err
+		}
+	}
+
+	err = po.grantAccess(hc, wc, grant, pred.Role)
+	if err == nil && grant.ClientCert {
+		err = po.allowCertAuth(cluster)
+		if err == nil {
+			err = po.awaitCertAuth(hc, cluster)
 		}
 	}
+	if err != nil {
+		log.Printf("error granting %s access to %s: %s\n", req.Access, newUser, err)
+		if !recorded {
+			if rerr := po.dropFailedReplication(hc, wc, grant); rerr != nil {
+				log.Printf("error dropping replication objects of binding %s: %s\n", bindID, rerr)
+			}
+		}
+		if rerr := po.revokeUsers(hc, ns, selector, []string{newUser}); rerr != nil {
+			log.Printf("error removing user %s: %s\n", newUser, rerr)
+		}
+		return BasicCred{}, err
+	}
+
+	if grant.passwordPolicy().SCRAMOnly {
+		if err := po.verifySCRAM(hc, wc, activeUser); err != nil {
+			log.Printf("error verifying password of %s: %s\n", activeUser, err)
+			if !recorded {
+				if rerr := po.revokeUsers(hc, ns, selector, []string{newUser}); rerr != nil {
+					log.Printf("error removing user %s: %s\n", newUser, rerr)
+				}
+			}
+			return BasicCred{}, err
+		}
+	}
+
+	if !recorded {
+		if err := po.recordBinding(cluster, grant); err != nil {
+			log.Printf("error recording binding %s: %s\n", bindID, err)
+			return BasicCred{}, err
+		}
+	}
+
+	// Created once recorded, so that unbinding a binding which failed here
+	// deletes whatever was created
+	if req.AppNamespace != "" {
+		if err := po.createNetworkPolicy(cluster, bindID, req); err != nil {
+			log.Printf("error creating network policy of binding %s: %s\n", bindID, err)
+			return BasicCred{}, err
+		}
+	}
+
+	cred := BasicCred{Username: activeUser, Password: pw, ExpiresAt: grant.ExpiresAt}
+	if grant.ClientCert {
+		secret, err := po.clientCert(cluster, ca, grant)
+		if err != nil {
+			log.Printf("error issuing client certificate of binding %s: %s\n", bindID, err)
+			return BasicCred{}, err
+		}
+		cred.Password = ""
+		cred.ClientCert = string(secret.Data["tls.crt"])
+		cred.ClientKey = string(secret.Data["tls.key"])
+		cred.ClientCA = string(secret.Data["ca.crt"])
+	}
+	switch grant.Isolation {
+	case IsolationSchema:
+		cred.Schema = grant.dataName()
+	case IsolationDatabase:
+		cred.Database = grant.dataName()
+	}
+	return cred, nil
 }
 
 // ClusterDetail returns the content provided by the operator's Show Cluster
@@ -323,7 +642,7 @@ func (po *PGOperator) ClusterDetail(instanceID string) (ClusterDetails, error) {
 	noInfo := ClusterDetails{}
 	hc, err := po.httpClient()
 	if err != nil {
-		return noInfo, err
+		return noInfo, ErrBackendUnavailable{err}
 	}
 
 	ns, err := po.findInstanceNamespace(instanceID)
@@ -339,6 +658,10 @@ func (po *PGOperator) ClusterDetail(instanceID string) (ClusterDetails, error) {
 		Namespace:     ns,
 	}
 	response, err := api.ShowCluster(hc, &po.pgoCreds, &showClusterRequest)
+	if err != nil {
+		log.Printf("error showing cluster: %s\n", err)
+		return noInfo, ErrBackendUnavailable{err}
+	}
 
 	if response.Status.Code == msgs.Ok {
 		for _, result := range response.Results {
@@ -349,62 +672,220 @@ func (po *PGOperator) ClusterDetail(instanceID string) (ClusterDetails, error) {
 		return noInfo, errors.New("ShowCluster response: " + response.Status.Msg)
 	}
 
-	if len(response.Results) != 1 {
+	if l := len(response.Results); l == 0 {
+		return noInfo, ErrNoInstance{ID: instanceID}
+	} else if l != 1 {
 		//error, should always return a single cluster detail
 		//because we are using a instanceID as the search key
-		return noInfo, errors.New("cluster for instanceID " + instanceID + " not found by ShowCluster")
+		return noInfo, fmt.Errorf("found %d clusters for instanceID %s by ShowCluster", l, instanceID)
 	}
 
 	detail := &response.Results[0]
-	replicaCount, err := strconv.Atoi(detail.Cluster.Spec.Replicas)
-	if err != nil {
-		return noInfo, fmt.Errorf("invalid replica count %s in cluster spec, unable to convert to int: %s",
-			detail.Cluster.Spec.Replicas, err)
+	services := clusterServices(detail)
+	svc, ok := services[serviceRolePrimary]
+	if !ok {
+		return noInfo, fmt.Errorf("no primary service found for cluster %s", detail.Cluster.GetName())
 	}
-	if l := len(detail.Services); (replicaCount == 0 && l != 1) || (replicaCount > 0 && l != 2) {
-		return noInfo, fmt.Errorf("unexpected number of services for cluster: %d", l)
-	}
-	svc := detail.Services[0]
 
 	cDetail := ClusterDetails{
 		Name:        svc.Name,
 		ClusterIP:   svc.ClusterIP,
 		ClusterName: svc.ClusterName,
+		Namespace:   ns,
 		ExternalIP:  svc.ExternalIP,
 		Database:    detail.Cluster.Spec.Database,
+		PlanID:      detail.Cluster.Labels[po.planLabelKey],
+		Ready:       detail.Cluster.Status.State == crv1.PgclusterStateInitialized,
+	}
+	if detail.Cluster.Spec.Standby {
+		cDetail.StandbyOf = detail.Cluster.Labels[po.stbyLabelKey]
+	}
+	_, cDetail.Deprovisioning = detail.Cluster.Labels[_DEPROVISIONED_LABEL_KEY]
+	cDetail.Port = clusterPort(&detail.Cluster)
+	cDetail.Primary = po.serviceDetails(ns, svc, cDetail.Port)
+	if s, ok := services[serviceRoleReplica]; ok {
+		cDetail.Replica = po.serviceDetails(ns, s, cDetail.Port)
+	}
+	if s, ok := services[serviceRolePgBouncer]; ok {
+		cDetail.PgBouncer = po.serviceDetails(ns, s, cDetail.Port)
+	}
+	if tls := detail.Cluster.Spec.TLS; tls.IsTLSEnabled() {
+		cDetail.TLS = true
+		cDetail.TLSOnly = detail.Cluster.Spec.TLSOnly
+		cDetail.CACert = po.caCert(ns, tls.CASecret)
 	}
 
 	return cDetail, nil
 }
 
+// Roles of the Services of a cluster
+const (
+	serviceRolePrimary   = "primary"
+	serviceRoleReplica   = "replica"
+	serviceRolePgBouncer = "pgbouncer"
+)
+
+// clusterServices sorts the Services the operator reports for a cluster by
+// role, going by the names the operator gives them. The Services of the
+// pgBackRest repository and any others are left out
+func clusterServices(detail *msgs.ShowClusterDetail) map[string]msgs.ShowClusterService {
+	name := detail.Cluster.GetName()
+	services := map[string]msgs.ShowClusterService{}
+	for _, s := range detail.Services {
+		switch {
+		case s.BackrestRepo:
+		case s.Pgbouncer || s.Name == name+"-pgbouncer":
+			services[serviceRolePgBouncer] = s
+		case s.Name == name+"-replica":
+			services[serviceRoleReplica] = s
+		case s.Name == name:
+			services[serviceRolePrimary] = s
+		}
+	}
+	return services
+}
+
+// clusterPort returns the PostgreSQL port of a cluster
+func clusterPort(cluster *crv1.Pgcluster) int {
+	port, err := strconv.Atoi(cluster.Spec.Port)
+	if err != nil || port <= 0 {
+		return 5432
+	}
+	return port
+}
+
+// serviceDetails completes what the operator reports of a Service with the
+// ways it is exposed, as far as they can be looked up
+func (po *PGOperator) serviceDetails(ns string, svc msgs.ShowClusterService, port int) ServiceDetails {
+	sd := ServiceDetails{
+		Name:       svc.Name,
+		ClusterIP:  svc.ClusterIP,
+		ExternalIP: svc.ExternalIP,
+	}
+	ctx := context.Background()
+
+	s, err := po.clientset.CoreV1().Services(ns).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("error getting service %s: %s\n", svc.Name, err)
+	} else {
+		for _, ing := range s.Status.LoadBalancer.Ingress {
+			if sd.LoadBalancer = ing.Hostname; sd.LoadBalancer == "" {
+				sd.LoadBalancer = ing.IP
+			}
+			break
+		}
+		for _, p := range s.Spec.Ports {
+			if int(p.Port) == port {
+				sd.NodePort = int(p.NodePort)
+			}
+		}
+	}
+
+	// Routes only exist on OpenShift, where the API answers with the Route
+	raw, err := po.kubeClient.Get().AbsPath("/apis/route.openshift.io/v1/namespaces", ns, "routes", svc.Name).DoRaw(ctx)
+	if err == nil {
+		var route struct {
+			Spec struct {
+				Host string `json:"host"`
+			} `json:"spec"`
+		}
+		if json.Unmarshal(raw, &route) == nil {
+			sd.Route = route.Spec.Host
+		}
+	}
+
+	return sd
+}
+
+// caCert returns the CA certificate held in a cluster's CA Secret, or
+// nothing when it cannot be read, leaving clients to rely on their own trust
+func (po *PGOperator) caCert(ns, secretName string) string {
+	secret, err := po.clientset.CoreV1().Secrets(ns).Get(context.Background(), secretName, metav1.GetOptions{})
+	if err != nil {
+		log.Printf("error reading CA secret %s: %s\n", secretName, err)
+		return ""
+	}
+	return string(secret.Data["ca.crt"])
+}
+
 // CreateCluster implements the PGOperator interface for creating clusters
 func (po *PGOperator) CreateCluster(req CreateRequest) error {
 	log.Printf("CreateCluster called %s\n", req.InstanceID)
 	hc, err := po.httpClient()
 	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+
+	if cluster, err := po.getCluster(req.InstanceID); err == nil {
+		// Clusters created before requests were recorded never match
+		_, deprovisioned := cluster.Labels[_DEPROVISIONED_LABEL_KEY]
+		identical := !deprovisioned && cluster.Labels[po.planLabelKey] == req.PlanID &&
+			cluster.Labels[_REQUEST_LABEL_KEY] == req.digest()
+		return ErrInstanceExists{ID: req.InstanceID, Identical: identical}
+	} else if _, ok := err.(ErrNoInstance); !ok {
+		log.Printf("error checking for existing instance: %s\n", err)
 		return err
 	}
+	if err := po.checkClusterName(req.Namespace, req.Name); err != nil {
+		return err
+	}
+
+	labels := map[string]string{}
+	for k, v := range req.Labels {
+		if strings.HasPrefix(k, "pgo-osb-") {
+			return ErrInvalidParams{Violations: []string{fmt.Sprintf("label %s is reserved by the broker", k)}}
+		}
+		labels[k] = v
+	}
+	labels[po.instLabelKey] = req.InstanceID
+	labels[po.planLabelKey] = req.PlanID
+	labels[_FINAL_BACKUP_LABEL_KEY] = strconv.FormatBool(req.Retention.FinalBackup)
+	labels[_BACKUP_DAYS_LABEL_KEY] = strconv.Itoa(req.Retention.BackupDays)
+	labels[_DELETE_DATA_LABEL_KEY] = strconv.FormatBool(req.Retention.DeleteData)
+	labels[_PROTECTION_LABEL_KEY] = strconv.FormatBool(req.DeletionProtection)
+	labels[_REQUEST_LABEL_KEY] = req.digest()
+	labels[_LEGACY_ROLES_LABEL_KEY] = legacyRolesMigrated
+	if req.RestrictPublicSchema {
+		labels[_RESTRICT_PUBLIC_LABEL_KEY] = "true"
+	}
 
 	r := &msgs.CreateClusterRequest{
 		ClientVersion: po.clientVer,
 		Name:          req.Name,
 		Namespace:     req.Namespace,
-		UserLabels: map[string]string{
-			po.instLabelKey: req.InstanceID,
-		},
-		AutofailFlag: true,
+		UserLabels:    labels,
+		AutofailFlag:  true,
 	}
 	po.createRequestByPlan(req.PlanID, r)
+	applyCreateOptions(req, r)
+	if req.RestoreFrom != "" {
+		src, err := po.getCluster(req.RestoreFrom)
+		if _, ok := err.(ErrNoInstance); ok {
+			return ErrInvalidParams{Violations: []string{fmt.Sprintf("source instance %s does not exist", req.RestoreFrom)}}
+		} else if err != nil {
+			return err
+		}
+		r.PGDataSource = crv1.PGDataSourceSpec{
+			Namespace:   src.GetNamespace(),
+			RestoreFrom: src.GetName(),
+			RestoreOpts: restoreOpts(req.RestoreTarget),
+		}
+	}
+	if req.StandbyOf != "" {
+		if err := po.standbyRequest(hc, req.StandbyOf, r); err != nil {
+			return err
+		}
+	}
 	log.Printf("user labels applied to cluster are: %v", r.UserLabels)
 
 	log.Printf("creation request: %#v\n", r)
 	response, err := api.CreateCluster(hc, &po.pgoCreds, r)
 	if err != nil {
 		log.Println("create cluster error: ", err)
-		return err
+		return ErrBackendUnavailable{err}
 	} else if response.Status.Code != msgs.Ok {
 		log.Println("create cluster non-Ok status: ", response.Msg)
-		return errors.New(response.Msg)
+		return createClusterError(response.Msg)
 	} else {
 		log.Println(response.Result)
 	}
@@ -412,41 +893,352 @@ func (po *PGOperator) CreateCluster(req CreateRequest) error {
 	return nil
 }
 
-// DeleteBinding deletes existing binding users based on instance and bindID
+// applyCreateOptions overrides the plan settings of a cluster creation
+// request with those requested for the instance
+func applyCreateOptions(req CreateRequest, r *msgs.CreateClusterRequest) {
+	if req.StorageSize != "" {
+		r.PVCSize = req.StorageSize
+	}
+	if req.StorageConfig != "" {
+		r.StorageConfig = req.StorageConfig
+	}
+	if req.ImageTag != "" {
+		r.CCPImageTag = req.ImageTag
+	}
+	r.PgbouncerFlag = req.PgBouncer
+	r.TLSSecret = req.TLSSecret
+	r.CASecret = req.CASecret
+	r.TLSOnly = req.TLSOnly
+	r.CustomConfig = req.CustomConfig
+}
+
+// standbyRequest sets up a cluster creation request to follow the cluster
+// of instance srcID as a standby. The standby replays WAL from the source's
+// pgBackRest repository in S3, and needs the passwords of the source's system
+// accounts to take over once promoted
+func (po *PGOperator) standbyRequest(hc *http.Client, srcID string, r *msgs.CreateClusterRequest) error {
+	src, err := po.getCluster(srcID)
+	if _, ok := err.(ErrNoInstance); ok {
+		return ErrInvalidParams{Violations: []string{fmt.Sprintf("source instance %s does not exist", srcID)}}
+	} else if err != nil {
+		return err
+	}
+	if !hasStorageType(src, crv1.BackrestStorageTypeS3) {
+		return ErrInvalidParams{Violations: []string{fmt.Sprintf("source instance %s has no pgBackRest repository in S3 to follow", srcID)}}
+	}
+
+	accounts, err := po.systemAccounts(hc, src)
+	if err != nil {
+		return err
+	}
+	r.PasswordSuperuser = accounts["postgres"]
+	r.PasswordReplication = accounts["primaryuser"]
+	if pw, ok := accounts[src.Spec.User]; ok {
+		r.Username = src.Spec.User
+		r.Password = pw
+	}
+	if r.PasswordSuperuser == "" || r.PasswordReplication == "" {
+		return fmt.Errorf("unable to find system account passwords of instance %s", srcID)
+	}
+
+	repoPath := src.Spec.BackrestRepoPath
+	if repoPath == "" {
+		repoPath = "/backrestrepo/" + src.GetName() + "-backrest-shared-repo"
+	}
+	r.Standby = true
+	r.BackrestStorageType = string(crv1.BackrestStorageTypeS3)
+	r.BackrestRepoPath = repoPath
+	r.BackrestS3Bucket = src.Spec.BackrestS3Bucket
+	r.BackrestS3Endpoint = src.Spec.BackrestS3Endpoint
+	r.BackrestS3Region = src.Spec.BackrestS3Region
+	r.BackrestS3URIStyle = src.Spec.BackrestS3URIStyle
+	r.Database = src.Spec.Database
+	r.UserLabels[po.stbyLabelKey] = srcID
+
+	return nil
+}
+
+// hasStorageType reports whether cluster keeps a pgBackRest repository in
+// storage of type t
+func hasStorageType(cluster *crv1.Pgcluster, t crv1.BackrestStorageType) bool {
+	for _, st := range cluster.Spec.BackrestStorageTypes {
+		if st == t {
+			return true
+		}
+	}
+	return false
+}
+
+// writableCluster returns the cluster the roles of cluster live in, the
+// source of standbys and cluster itself otherwise
+func (po *PGOperator) writableCluster(cluster *crv1.Pgcluster) (*crv1.Pgcluster, error) {
+	srcID, ok := cluster.Labels[po.stbyLabelKey]
+	if !ok || !cluster.Spec.Standby {
+		return cluster, nil
+	}
+
+	src, err := po.getCluster(srcID)
+	if err != nil {
+		log.Printf("error finding source of standby: %s\n", err)
+		return nil, err
+	}
+	return src, nil
+}
+
+// standbyClusters returns the clusters following cluster as standbys
+func (po *PGOperator) standbyClusters(cluster *crv1.Pgcluster) ([]*crv1.Pgcluster, error) {
+	clusterList := &crv1.PgclusterList{}
+	err := po.kubeClient.Get().
+		Resource(crv1.PgclusterResourcePlural).
+		Param("labelSelector", po.stbyLabelKey+"="+cluster.Labels[po.instLabelKey]).
+		Do(context.Background()).
+		Into(clusterList)
+	if err != nil {
+		return nil, ErrBackendUnavailable{err}
+	}
+
+	standbys := make([]*crv1.Pgcluster, len(clusterList.Items))
+	for i := range clusterList.Items {
+		standbys[i] = &clusterList.Items[i]
+	}
+	return standbys, nil
+}
+
+// restoreOpts returns the pgBackRest options for restoring up to target, or
+// to the end of the WAL archive when target is zero
+func restoreOpts(target time.Time) string {
+	if target.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("--type=time --target=%q", target.Format(pgBackRestTimeFormat))
+}
+
+// createClusterError classifies a failed cluster creation based on the
+// message returned by the apiserver
+func createClusterError(msg string) error {
+	lmsg := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lmsg, "exceeded quota"):
+		return ErrQuotaExceeded{Reason: msg}
+	case strings.Contains(lmsg, "already exists"):
+		return ErrConflict{Reason: msg}
+	}
+
+	return errors.New(msg)
+}
+
+// UpdateCluster implements the PGOperator interface for updating clusters.
+// Changing the plan of an existing cluster is not supported
+func (po *PGOperator) UpdateCluster(req UpdateRequest) error {
+	log.Printf("UpdateCluster called %s\n", req.InstanceID)
+	cluster, err := po.getCluster(req.InstanceID)
+	if err != nil {
+		log.Printf("error finding instance in UpdateCluster: %s\n", err)
+		return err
+	}
+
+	current, ok := cluster.Labels[po.planLabelKey]
+	if !ok {
+		// Clusters created before plans were recorded
+		current = req.PreviousPlanID
+	}
+	if req.PlanID != "" && req.PlanID != current {
+		return ErrPlanChangeUnsupported{From: current, To: req.PlanID}
+	}
+
+	if req.DeletionProtection != nil {
+		err := po.labelCluster(cluster, map[string]string{
+			_PROTECTION_LABEL_KEY: strconv.FormatBool(*req.DeletionProtection),
+		})
+		if err != nil {
+			log.Printf("error updating deletion protection: %s\n", err)
+			return err
+		}
+	}
+
+	if req.Promote {
+		return po.promoteStandby(cluster)
+	}
+
+	return nil
+}
+
+// promoteStandby promotes a standby cluster so that it accepts writes
+func (po *PGOperator) promoteStandby(cluster *crv1.Pgcluster) error {
+	if !cluster.Spec.Standby {
+		return ErrInvalidParams{Violations: []string{fmt.Sprintf("cluster %s is not a standby", cluster.GetName())}}
+	}
+	hc, err := po.httpClient()
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+
+	ucReq := &msgs.UpdateClusterRequest{
+		Clustername:   []string{cluster.GetName()},
+		ClientVersion: po.clientVer,
+		Namespace:     cluster.GetNamespace(),
+		Standby:       msgs.UpdateClusterStandbyDisable,
+	}
+	resp, err := api.UpdateCluster(hc, ucReq, &po.pgoCreds)
+	if err != nil {
+		log.Printf("error promoting standby: %s\n", err)
+		return ErrBackendUnavailable{err}
+	}
+	if resp.Status.Code != msgs.Ok {
+		log.Println(resp.Status.Msg)
+		return errors.New("error promoting standby: " + resp.Status.Msg)
+	}
+	log.Printf("promoted standby cluster %s\n", cluster.GetName())
+
+	return nil
+}
+
+// revokeUsers drops the users of bindings which failed to be granted
+func (po *PGOperator) revokeUsers(hc *http.Client, ns, selector string, users []string) error {
+	for _, user := range users {
+		log.Printf("revoking binding user %s\n", user)
+		duReq := msgs.DeleteUserRequest{
+			ClientVersion: po.clientVer,
+			Namespace:     ns,
+			Selector:      selector,
+			Username:      user,
+		}
+		resp, err := api.DeleteUser(hc, &po.pgoCreds, &duReq)
+		if err != nil {
+			return ErrBackendUnavailable{err}
+		}
+		if resp.Status.Code != msgs.Ok {
+			return fmt.Errorf("error revoking user %s: %s", user, resp.Msg)
+		}
+	}
+
+	return nil
+}
+
+// DeleteBinding deletes existing binding users based on instance and bindID.
+// ErrNoInstance and ErrNoBinding are returned when the instance or binding
+// user does not exist so that callers can tell them apart from failures to
+// delete
 func (po *PGOperator) DeleteBinding(instanceID, bindID string) error {
 	log.Printf("DeleteBinding called %s\n", instanceID)
 	hc, err := po.httpClient()
 	if err != nil {
-		return err
+		return ErrBackendUnavailable{err}
 	}
 
-	ns, err := po.findInstanceNamespace(instanceID)
+	cluster, err := po.getCluster(instanceID)
 	if err != nil {
-		log.Printf("error finding instance in ClusterDetails: %s", err)
+		log.Printf("error finding instance in DeleteBinding: %s", err)
 		return err
 	}
+	wc, err := po.writableCluster(cluster)
+	if err != nil {
+		return err
+	}
+	ns, selector := wc.GetNamespace(), po.instLabel(wc.Labels[po.instLabelKey])
 
 	u, err := CompactUUIDString(bindID)
 	if err != nil {
-		return fmt.Errorf("unable to process bindID: %s\n", err)
+		// Binding users are only ever created for valid IDs
+		log.Printf("unable to process bindID: %s\n", err)
+		return ErrNoBinding{InstanceID: instanceID, BindID: bindID}
 	}
 	user := fmt.Sprintf("user%s", strings.ToLower(u))
 
-	duReq := msgs.DeleteUserRequest{
+	suReq := &msgs.ShowUserRequest{
 		AllFlag:       false,
 		ClientVersion: po.clientVer,
 		Namespace:     ns,
-		Selector:      po.instLabel(instanceID),
-		Username:      user,
+		Selector:      selector,
 	}
-	resp, err := api.DeleteUser(hc, &po.pgoCreds, &duReq)
+	suResp, err := api.ShowUser(hc, &po.pgoCreds, suReq)
 	if err != nil {
+		log.Printf("error getting user details: %s\n", err)
+		return ErrBackendUnavailable{err}
+	}
+	if suResp.Status.Code != msgs.Ok {
+		m := suResp.Status.Msg
+		log.Println(m)
+		return errors.New("error fetching users: " + m)
+	}
+	existing := map[string]bool{}
+	for _, s := range suResp.Results {
+		existing[s.Username] = true
+	}
+	rec, recorded := findBindingRecord(cluster, bindID)
+	if !existing[user] && !recorded {
+		log.Printf("user for binding %s not found\n", bindID)
+		return ErrNoBinding{InstanceID: instanceID, BindID: bindID}
+	}
+	if !recorded {
+		rec = BindingRecord{BindingID: bindID, Role: user}
+	}
+
+	return po.removeBinding(hc, cluster, wc, rec, recorded, existing)
+}
+
+// removeBinding deletes a binding of cluster: its NetworkPolicy, client
+// certificate and record, and its roles, which exist on wc when existing
+// says so, once released
+func (po *PGOperator) removeBinding(hc *http.Client, cluster, wc *crv1.Pgcluster, rec BindingRecord, recorded bool, existing map[string]bool) error {
+	bindID := rec.BindingID
+	if recorded && rec.AppNamespace != "" {
+		if err := po.deleteNetworkPolicy(cluster, bindID); err != nil {
+			log.Printf("error deleting network policy of binding %s: %s\n", bindID, err)
+			return err
+		}
+	}
+	if recorded && rec.ClientCert {
+		if err := po.deleteClientCert(cluster, bindID); err != nil {
+			log.Printf("error deleting client certificate of binding %s: %s\n", bindID, err)
+			return err
+		}
+	}
+	if !existing[rec.Role] {
+		// The role was dropped outside of the broker
+		log.Printf("user for binding %s already removed\n", bindID)
+		return po.forgetBinding(cluster, bindID)
+	}
+
+	user := rec.Role
+	if !existing[rec.AlternateRole] {
+		rec.AlternateRole = ""
+	}
+	if err := po.releaseRole(hc, wc, rec); err != nil {
+		log.Printf("error releasing user %s: %s\n", user, err)
 		return err
 	}
-	if resp.Status.Code == msgs.Ok {
-		log.Printf("Deleted user for binding %s\n", bindID)
-	} else {
-		return fmt.Errorf("response error to delete user: %s", resp.Msg)
+
+	users := []string{user}
+	if rec.AlternateRole != "" {
+		users = append([]string{rec.AlternateRole}, users...)
+	}
+	ns, selector := wc.GetNamespace(), po.instLabel(wc.Labels[po.instLabelKey])
+	for _, u := range users {
+		duReq := msgs.DeleteUserRequest{
+			AllFlag:       false,
+			ClientVersion: po.clientVer,
+			Namespace:     ns,
+			Selector:      selector,
+			Username:      u,
+		}
+		resp, err := api.DeleteUser(hc, &po.pgoCreds, &duReq)
+		if err != nil {
+			return ErrBackendUnavailable{err}
+		}
+		if resp.Status.Code != msgs.Ok {
+			return fmt.Errorf("response error to delete user: %s", resp.Msg)
+		}
+		for _, r := range resp.Results {
+			if r.Error {
+				return fmt.Errorf("error deleting user %s: %s", r.Username, r.ErrorMessage)
+			}
+		}
+	}
+	log.Printf("Deleted user for binding %s\n", bindID)
+
+	if recorded {
+		return po.forgetBinding(cluster, bindID)
 	}
 
 	return nil
@@ -454,22 +1246,39 @@ func (po *PGOperator) DeleteBinding(instanceID, bindID string) error {
 
 // DeleteCluster implements the PGOperator interface for deleting clusters
 // It also ensures all bindings are deleted prior to attempting to delete
-// the cluster so that a clear error can be returned
-func (po *PGOperator) DeleteCluster(instanceID string) error {
+// the cluster so that a clear error can be returned. Clusters retaining a
+// final backup are only marked for deletion, which the janitor completes
+// once the backup has been taken
+func (po *PGOperator) DeleteCluster(req DeleteRequest) error {
+	instanceID := req.InstanceID
 	log.Printf("DeleteCluster called %s\n", instanceID)
 	hc, err := po.httpClient()
 	if err != nil {
-		return err
+		return ErrBackendUnavailable{err}
 	}
-	selector := po.instLabel(instanceID)
 
-	ns, err := po.findInstanceNamespace(instanceID)
+	cluster, err := po.getCluster(instanceID)
 	if err != nil {
 		log.Printf("error finding instance in DeleteCluster: %s\n", err)
-		return ErrNoInstance{ID: instanceID}
+		return err
+	}
+	ns := cluster.GetNamespace()
+	if cluster.Labels[_PROTECTION_LABEL_KEY] == "true" {
+		return ErrDeletionProtected{ID: instanceID}
+	}
+	ret := retention(cluster)
+	if ret.FinalBackup && !req.AcceptsIncomplete {
+		return ErrAsyncRequired{ID: instanceID}
+	}
+	if _, ok := cluster.Labels[_DEPROVISIONED_LABEL_KEY]; ok {
+		log.Printf("final backup of instance %s already in progress\n", instanceID)
+		return nil
 	}
 
-	// Ensure no bound users exist
+	// Ensure no bindings exist, unless an administrator has asked for them
+	// to be revoked. Roles of bindings created before the registry existed
+	// are recognized by name. Standbys hold replicated copies of the roles
+	// of their source, so only recorded bindings count for them
 	suReq := &msgs.ShowUserRequest{
 		AllFlag:       false,
 		ClientVersion: po.clientVer,
@@ -479,7 +1288,7 @@ func (po *PGOperator) DeleteCluster(instanceID string) error {
 	suResp, err := api.ShowUser(hc, &po.pgoCreds, suReq)
 	if err != nil {
 		log.Printf("error getting user details: %s\n", err)
-		return err
+		return ErrBackendUnavailable{err}
 	}
 	if suResp.Status.Code != msgs.Ok {
 		m := suResp.Status.Msg
@@ -490,35 +1299,59 @@ func (po *PGOperator) DeleteCluster(instanceID string) error {
 		log.Println("no users found, expected default users")
 		return errors.New("unexpected user state: no default users " + instanceID)
 	}
-	users := suResp.Results
-	for _, s := range users {
-		if strings.Compare("user", s.Username[:4]) == 0 {
+	recs := bindingRecords(cluster)
+	existing := map[string]bool{}
+	var names []string
+	for _, s := range suResp.Results {
+		existing[s.Username] = true
+		names = append(names, s.Username)
+	}
+	var legacy []string
+	if !cluster.Spec.Standby {
+		legacy = legacyRoles(names, recs, "")
+	}
+	remaining := len(legacy) > 0
+	for _, rec := range recs {
+		remaining = remaining || existing[rec.Role]
+	}
+	if remaining {
+		if cluster.Labels[_FORCE_DELETE_LABEL_KEY] != "true" {
 			return ErrBindingsRemain
 		}
+		// Revoked as unbinding would, so that a final backup holds what
+		// deprovisioning after unbinding everything would leave
+		if err := po.revokeBindings(hc, cluster, recs, legacy, existing); err != nil {
+			return err
+		}
 	}
 
-	// Proceed with deletion
-	deleteData := false
-	deleteBackups := false
-	log.Printf("deleting cluster %s with delete-data %t\n", selector, deleteData)
+	if !ret.FinalBackup {
+		return po.deleteCluster(hc, cluster, ret)
+	}
 
-	deleteClusterRequest := msgs.DeleteClusterRequest{
-		Clustername:   "all",
-		Selector:      selector,
-		ClientVersion: po.clientVer,
-		Namespace:     ns,
-		DeleteData:    deleteData,
-		DeleteBackups: deleteBackups,
+	// The janitor deletes the cluster once the backup completes
+	return po.startFinalBackup(hc, cluster)
+}
+
+// revokeBindings removes the recorded bindings and the legacy binding roles
+// of a cluster being deprovisioned by force, whose roles are existing
+func (po *PGOperator) revokeBindings(hc *http.Client, cluster *crv1.Pgcluster, recs []BindingRecord, legacy []string, existing map[string]bool) error {
+	wc, err := po.writableCluster(cluster)
+	if err != nil {
+		return err
 	}
-	response, err := api.DeleteCluster(hc, &deleteClusterRequest, &po.pgoCreds)
 
-	if response.Status.Code == msgs.Ok {
-		for _, result := range response.Results {
-			log.Println(result)
+	for _, rec := range recs {
+		if err := po.removeBinding(hc, cluster, wc, rec, true, existing); err != nil {
+			log.Printf("error revoking binding %s: %s\n", rec.BindingID, err)
+			return err
 		}
-	} else {
-		log.Print(response.Status.Msg)
 	}
-
-	return err
+	for _, role := range legacy {
+		if err := po.removeBinding(hc, cluster, wc, BindingRecord{Role: role}, false, existing); err != nil {
+			log.Printf("error revoking user %s: %s\n", role, err)
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,83 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"testing"
+	"time"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+	msgs "github.com/crunchydata/postgres-operator/pkg/apiservermsgs"
+)
+
+func TestUnitApplyCreateOptions(t *testing.T) {
+	plan := msgs.CreateClusterRequest{PVCSize: "10Gi", StorageConfig: "osbsmall", CCPImageTag: "centos8-13.3-4.7.0"}
+
+	// Options left empty keep the settings of the plan
+	r := plan
+	applyCreateOptions(CreateRequest{}, &r)
+	if r.PVCSize != plan.PVCSize || r.StorageConfig != plan.StorageConfig || r.CCPImageTag != plan.CCPImageTag {
+		t.Errorf("expected the plan settings to be kept, got %+v", r)
+	}
+
+	r = plan
+	applyCreateOptions(CreateRequest{
+		StorageSize:   "5Gi",
+		StorageConfig: "osbmedium",
+		PgBouncer:     true,
+		TLSSecret:     "unit-tls",
+		CASecret:      "unit-ca",
+		TLSOnly:       true,
+	}, &r)
+	if r.PVCSize != "5Gi" || r.StorageConfig != "osbmedium" || r.CCPImageTag != plan.CCPImageTag {
+		t.Errorf("expected the storage to be overridden, got %+v", r)
+	}
+	if !r.PgbouncerFlag || r.TLSSecret != "unit-tls" || r.CASecret != "unit-ca" || !r.TLSOnly {
+		t.Errorf("expected pgBouncer and TLS to be requested, got %+v", r)
+	}
+}
+
+func TestUnitRestoreOpts(t *testing.T) {
+	if opts := restoreOpts(time.Time{}); opts != "" {
+		t.Errorf("expected no options without a target, got %q", opts)
+	}
+	target := time.Date(2021, 6, 9, 14, 15, 11, 0, time.UTC)
+	if opts, exp := restoreOpts(target), `--type=time --target="2021-06-09 14:15:11+00:00"`; opts != exp {
+		t.Errorf("expected %q, got %q", exp, opts)
+	}
+}
+
+func TestUnitCreateClusterError(t *testing.T) {
+	if _, ok := createClusterError("pods exceeded quota: compute-resources").(ErrQuotaExceeded); !ok {
+		t.Errorf("expected a quota error")
+	}
+	if _, ok := createClusterError("Cluster unitinstance Already Exists").(ErrConflict); !ok {
+		t.Errorf("expected a conflict")
+	}
+	err := createClusterError("no storage class")
+	if _, ok := err.(ErrConflict); ok || err.Error() != "no storage class" {
+		t.Errorf("expected the message as a plain error, got %#v", err)
+	}
+}
+
+func TestUnitClusterPort(t *testing.T) {
+	for port, exp := range map[string]int{"": 5432, "abc": 5432, "-1": 5432, "5433": 5433} {
+		cluster := &crv1.Pgcluster{Spec: crv1.PgclusterSpec{Port: port}}
+		if got := clusterPort(cluster); got != exp {
+			t.Errorf("expected port %d for %q, got %d", exp, port, got)
+		}
+	}
+}
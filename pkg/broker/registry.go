@@ -0,0 +1,196 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The binding registry records each binding of an instance as an annotation
+// on its Pgcluster, keyed by binding ID and holding a JSON BindingRecord, so
+// that bindings are known without inferring them from role names
+
+// bindingAnnotationPrefix is followed by the binding ID in registry keys
+const bindingAnnotationPrefix = "pgo-osb.crunchydata.com/binding-"
+
+// legacyBindingRolePattern matches the roles created for bindings before the
+// registry existed, which are still treated as bindings when unrecorded
+const legacyBindingRolePattern = "^user[0-9a-f]{32}$"
+
+var legacyBindingRole = regexp.MustCompile(legacyBindingRolePattern)
+
+// adoptedRolesAnnotation holds the JSON list of the owner binding roles whose
+// objects were handed to the owner group, which is done once for each role
+const adoptedRolesAnnotation = "pgo-osb.crunchydata.com/adopted-roles"
+
+// bindingRecords returns the bindings recorded on a cluster, oldest first
+func bindingRecords(cluster *crv1.Pgcluster) []BindingRecord {
+	var recs []BindingRecord
+	for k, v := range cluster.Annotations {
+		if !strings.HasPrefix(k, bindingAnnotationPrefix) {
+			continue
+		}
+
+		rec := BindingRecord{}
+		if err := json.Unmarshal([]byte(v), &rec); err != nil {
+			log.Printf("invalid binding record %s on cluster %s: %s\n", k, cluster.GetName(), err)
+			continue
+		}
+		rec.BindingID = strings.TrimPrefix(k, bindingAnnotationPrefix)
+		recs = append(recs, rec)
+	}
+
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].CreatedAt.Before(recs[j].CreatedAt)
+	})
+
+	return recs
+}
+
+// recordedRoles returns the roles of the bindings recs, including their
+// alternate roles
+func recordedRoles(recs []BindingRecord) map[string]bool {
+	roles := map[string]bool{}
+	for _, rec := range recs {
+		roles[rec.Role] = true
+		if rec.AlternateRole != "" {
+			roles[rec.AlternateRole] = true
+		}
+	}
+	return roles
+}
+
+// roleRecords returns the records of the bindings whose roles exist on
+// cluster: its own and those of its standbys, which are created on it
+func roleRecords(cluster *crv1.Pgcluster, standbys []*crv1.Pgcluster) []BindingRecord {
+	recs := bindingRecords(cluster)
+	for _, stby := range standbys {
+		recs = append(recs, bindingRecords(stby)...)
+	}
+	return recs
+}
+
+// findBindingRecord returns the record of a binding, if any
+func findBindingRecord(cluster *crv1.Pgcluster, bindID string) (BindingRecord, bool) {
+	for _, rec := range bindingRecords(cluster) {
+		if rec.BindingID == bindID {
+			return rec, true
+		}
+	}
+	return BindingRecord{}, false
+}
+
+// recordBinding adds a binding to the registry of a cluster
+func (po *PGOperator) recordBinding(cluster *crv1.Pgcluster, rec BindingRecord) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return po.annotateCluster(cluster, map[string]interface{}{
+		bindingAnnotationPrefix + rec.BindingID: string(v),
+	})
+}
+
+// forgetBinding removes a binding from the registry of a cluster
+func (po *PGOperator) forgetBinding(cluster *crv1.Pgcluster, bindID string) error {
+	return po.annotateCluster(cluster, map[string]interface{}{
+		bindingAnnotationPrefix + bindID: nil,
+	})
+}
+
+// adoptedRoles returns the owner binding roles recorded as adopted on a
+// cluster
+func adoptedRoles(cluster *crv1.Pgcluster) map[string]bool {
+	adopted := map[string]bool{}
+	v, ok := cluster.Annotations[adoptedRolesAnnotation]
+	if !ok {
+		return adopted
+	}
+
+	var roles []string
+	if err := json.Unmarshal([]byte(v), &roles); err != nil {
+		log.Printf("invalid adopted roles on cluster %s: %s\n", cluster.GetName(), err)
+	}
+	for _, r := range roles {
+		adopted[r] = true
+	}
+	return adopted
+}
+
+// recordAdoptedRoles updates the roles recorded as adopted on a cluster,
+// adding those in add and removing those in remove
+func (po *PGOperator) recordAdoptedRoles(cluster *crv1.Pgcluster, add, remove []string) error {
+	adopted := adoptedRoles(cluster)
+	for _, r := range add {
+		adopted[r] = true
+	}
+	for _, r := range remove {
+		delete(adopted, r)
+	}
+
+	roles := []string{}
+	for r := range adopted {
+		roles = append(roles, r)
+	}
+	sort.Strings(roles)
+	v, err := json.Marshal(roles)
+	if err != nil {
+		return err
+	}
+	return po.annotateCluster(cluster, map[string]interface{}{adoptedRolesAnnotation: string(v)})
+}
+
+// annotateCluster sets annotations on a cluster, removing those set to nil
+func (po *PGOperator) annotateCluster(cluster *crv1.Pgcluster, annotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = po.kubeClient.Patch(types.MergePatchType).
+		Namespace(cluster.GetNamespace()).
+		Resource(crv1.PgclusterResourcePlural).
+		Name(cluster.GetName()).
+		Body(patch).
+		Do(context.Background()).
+		Error()
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+
+	return nil
+}
+
+// ListBindings returns the bindings recorded for an instance
+func (po *PGOperator) ListBindings(instanceID string) ([]BindingRecord, error) {
+	cluster, err := po.getCluster(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return bindingRecords(cluster), nil
+}
@@ -0,0 +1,77 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+)
+
+// recordOn adds rec to the registry annotations of cluster
+func recordOn(cluster *crv1.Pgcluster, rec BindingRecord) {
+	v, _ := json.Marshal(rec)
+	if cluster.Annotations == nil {
+		cluster.Annotations = map[string]string{}
+	}
+	cluster.Annotations[bindingAnnotationPrefix+rec.BindingID] = string(v)
+}
+
+func TestUnitBindingRecords(t *testing.T) {
+	cluster := &crv1.Pgcluster{}
+	now := time.Now().UTC()
+	recordOn(cluster, BindingRecord{BindingID: "b", Role: bindingRole("b"), CreatedAt: now})
+	recordOn(cluster, BindingRecord{BindingID: "a", Role: bindingRole("a"), AlternateRole: alternateRole(bindingRole("a")), CreatedAt: now.Add(-time.Hour)})
+	cluster.Annotations[bindingAnnotationPrefix+"c"] = "{"
+	cluster.Annotations[adoptedRolesAnnotation] = `["` + bindingRole("a") + `"]`
+
+	recs := bindingRecords(cluster)
+	if len(recs) != 2 || recs[0].BindingID != "a" || recs[1].BindingID != "b" {
+		t.Fatalf("expected the valid records oldest first, got %+v", recs)
+	}
+	if rec, ok := findBindingRecord(cluster, "b"); !ok || rec.Role != bindingRole("b") {
+		t.Errorf("expected to find binding b, got %+v", rec)
+	}
+	if _, ok := findBindingRecord(cluster, "c"); ok {
+		t.Errorf("expected an invalid record not to be found")
+	}
+
+	roles := recordedRoles(recs)
+	for _, r := range []string{bindingRole("a"), alternateRole(bindingRole("a")), bindingRole("b")} {
+		if !roles[r] {
+			t.Errorf("expected role %s to be recorded, got %v", r, roles)
+		}
+	}
+	if len(roles) != 3 {
+		t.Errorf("expected 3 recorded roles, got %v", roles)
+	}
+
+	// The records of standbys are those of roles on their source
+	standby := &crv1.Pgcluster{}
+	recordOn(standby, BindingRecord{BindingID: "d", Role: bindingRole("d"), CreatedAt: now})
+	if recs := roleRecords(cluster, []*crv1.Pgcluster{standby}); len(recs) != 3 || recs[2].BindingID != "d" {
+		t.Errorf("expected the standby's record along with the cluster's, got %+v", recs)
+	}
+
+	if adopted := adoptedRoles(cluster); len(adopted) != 1 || !adopted[bindingRole("a")] {
+		t.Errorf("expected role a to be adopted, got %v", adopted)
+	}
+	if adopted := adoptedRoles(standby); len(adopted) != 0 {
+		t.Errorf("expected no adopted roles, got %v", adopted)
+	}
+}
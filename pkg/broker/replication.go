@@ -0,0 +1,193 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+	"github.com/lib/pq"
+)
+
+// Monitoring and replication bindings connect to the instance database like
+// app bindings, but are not given its access groups. Replication slots keep
+// the WAL their consumer has not confirmed yet, so the slot of a binding is
+// dropped along with it, whether it is unbound or reaped
+
+// slotPlugin is the output plugin of the slots of replication bindings,
+// which streams the changes of publications
+const slotPlugin = "pgoutput"
+
+// bindingTypeStmts grant the role of a monitoring or replication binding
+// its privileges instead of an access group. Replication roles read the
+// tables they copy ahead of streaming them, as readonly roles do
+func bindingTypeStmts(cluster *crv1.Pgcluster, rec BindingRecord) []string {
+	db, r := pq.QuoteIdentifier(cluster.Spec.Database), pq.QuoteIdentifier(rec.Role)
+	stmts := []string{
+		fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", db, r),
+		fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO %s", db, r),
+	}
+
+	switch rec.Type {
+	case BindingMonitoring:
+		stmts = append(stmts, fmt.Sprintf("GRANT pg_monitor TO %s", r))
+	case BindingReplication:
+		stmts = append(stmts,
+			fmt.Sprintf("ALTER ROLE %s REPLICATION", r),
+			fmt.Sprintf("GRANT %s TO %s", pq.QuoteIdentifier(readOnlyGroup), r))
+		if rec.Publication != "" {
+			stmts = append(stmts, publicationStmt(rec.Publication))
+		}
+	}
+
+	return stmts
+}
+
+// publicationStmt creates a publication of all tables of the current
+// database, unless the binding was recorded with it before
+func publicationStmt(name string) string {
+	return fmt.Sprintf(`DO $$ BEGIN
+  IF NOT EXISTS (SELECT FROM pg_catalog.pg_publication WHERE pubname = %s) THEN
+    CREATE PUBLICATION %s FOR ALL TABLES;
+  END IF;
+END $$`, pq.QuoteLiteral(name), pq.QuoteIdentifier(name))
+}
+
+// createSlot creates a logical replication slot in the current database,
+// unless the binding was recorded with it before. Slot functions cannot run in a transaction which wrote
+// anything, so this follows the grants rather than joining them
+func createSlot(db *sql.DB, name string) error {
+	var walLevel string
+	if err := db.QueryRow("SHOW wal_level").Scan(&walLevel); err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	if walLevel != "logical" {
+		return ErrInvalidParams{Violations: []string{fmt.Sprintf("replication slots require wal_level logical, the instance has %s", walLevel)}}
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT FROM pg_catalog.pg_replication_slots WHERE slot_name = $1)", name).Scan(&exists)
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	if exists {
+		return nil
+	}
+	if _, err := db.Exec("SELECT pg_catalog.pg_create_logical_replication_slot($1, $2)", name, slotPlugin); err != nil {
+		return fmt.Errorf("error creating replication slot %s: %s", name, err)
+	}
+	log.Printf("created replication slot %s\n", name)
+
+	return nil
+}
+
+// dropReplication drops the slot and publication of a replication binding.
+// The slot cannot be dropped while its consumer is streaming from it, so the
+// consumer is disconnected first
+func dropReplication(db *sql.DB, rec BindingRecord) error {
+	if rec.Slot != "" {
+		_, err := db.Exec("SELECT pg_catalog.pg_terminate_backend(active_pid) FROM pg_catalog.pg_replication_slots WHERE slot_name = $1 AND active", rec.Slot)
+		if err == nil {
+			_, err = db.Exec("SELECT pg_catalog.pg_drop_replication_slot(slot_name) FROM pg_catalog.pg_replication_slots WHERE slot_name = $1", rec.Slot)
+		}
+		if err != nil {
+			return fmt.Errorf("error dropping replication slot %s: %s", rec.Slot, err)
+		}
+	}
+	if rec.Publication != "" {
+		if _, err := db.Exec("DROP PUBLICATION IF EXISTS " + pq.QuoteIdentifier(rec.Publication)); err != nil {
+			return fmt.Errorf("error dropping publication %s: %s", rec.Publication, err)
+		}
+	}
+
+	return nil
+}
+
+// checkReplicationObjects rejects the publication and slot of a new
+// replication binding when they exist already. They were then created
+// outside the broker, and would be dropped along with the binding
+func (po *PGOperator) checkReplicationObjects(hc *http.Client, wc *crv1.Pgcluster, req BindRequest) error {
+	if req.Type != BindingReplication || req.Publication == "" && req.Slot == "" {
+		return nil
+	}
+	db, err := po.openDB(hc, wc)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var pub, slot bool
+	err = db.QueryRow(`SELECT
+  EXISTS (SELECT FROM pg_catalog.pg_publication WHERE pubname = $1),
+  EXISTS (SELECT FROM pg_catalog.pg_replication_slots WHERE slot_name = $2)`, req.Publication, req.Slot).Scan(&pub, &slot)
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	if pub {
+		return ErrConflict{Reason: fmt.Sprintf("publication %s exists and does not belong to a binding", req.Publication)}
+	}
+	if slot {
+		return ErrConflict{Reason: fmt.Sprintf("replication slot %s exists and does not belong to a binding", req.Slot)}
+	}
+	return nil
+}
+
+// dropFailedReplication drops the publication and slot of a replication
+// binding which failed to be created, which checkReplicationObjects found
+// not to exist beforehand
+func (po *PGOperator) dropFailedReplication(hc *http.Client, wc *crv1.Pgcluster, rec BindingRecord) error {
+	if rec.Type != BindingReplication || rec.Publication == "" && rec.Slot == "" {
+		return nil
+	}
+	db, err := po.openDB(hc, wc)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return dropReplication(db, rec)
+}
+
+// checkReplication rejects the publication and slot of a replication
+// binding when another binding of cluster already has them, as unbinding
+// either binding would drop them from under the other. pgBouncer looks up
+// the passwords of ordinary roles only
+func checkReplication(cluster *crv1.Pgcluster, req BindRequest) error {
+	if req.Type != BindingReplication {
+		return nil
+	}
+	if req.PgBouncer {
+		return ErrInvalidParams{Violations: []string{"pgBouncer does not authenticate replication roles"}}
+	}
+	if cluster.Spec.Standby && (req.Publication != "" || req.Slot != "") {
+		return ErrInvalidParams{Violations: []string{"publications and replication slots cannot be created on a standby"}}
+	}
+	for _, rec := range bindingRecords(cluster) {
+		if rec.BindingID == req.BindingID {
+			continue
+		}
+		if req.Publication != "" && rec.Publication == req.Publication {
+			return ErrConflict{Reason: fmt.Sprintf("publication %s belongs to binding %s", req.Publication, rec.BindingID)}
+		}
+		if req.Slot != "" && rec.Slot == req.Slot {
+			return ErrConflict{Reason: fmt.Sprintf("replication slot %s belongs to binding %s", req.Slot, rec.BindingID)}
+		}
+	}
+	return nil
+}
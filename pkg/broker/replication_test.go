@@ -0,0 +1,131 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+)
+
+// grantedOwner reports whether any of stmts gives role the owner group
+func grantedOwner(stmts []string, role string) bool {
+	for _, stmt := range stmts {
+		if strings.HasPrefix(stmt, `GRANT "pgo_osb_owner" TO "`+role+`"`) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUnitMonitoringNeverOwner(t *testing.T) {
+	cluster := &crv1.Pgcluster{Spec: crv1.PgclusterSpec{Database: "userdb", User: "testuser"}}
+
+	// Binding the monitoring role
+	mon := BindingRecord{Role: bindingRole("a"), Access: AccessReadOnly, Type: BindingMonitoring}
+	names := []string{mon.Role}
+	stmts := append(accessGroupStmts(cluster), legacyRoleStmts(legacyRoles(names, nil, mon.Role))...)
+	stmts = append(stmts, bindingTypeStmts(cluster, mon)...)
+	if grantedOwner(stmts, mon.Role) {
+		t.Fatalf("expected the monitoring role not to join the owner group when bound, got %v", stmts)
+	}
+	if !strings.Contains(strings.Join(stmts, "\n"), `GRANT pg_monitor TO "`+mon.Role+`"`) {
+		t.Fatalf("expected the monitoring role to be granted pg_monitor, got %v", stmts)
+	}
+
+	// Binding again, once the monitoring binding is recorded
+	next := BindingRecord{Role: bindingRole("b"), Access: AccessReadOnly}
+	names = append(names, next.Role)
+	stmts = append(accessGroupStmts(cluster), legacyRoleStmts(legacyRoles(names, []BindingRecord{mon}, next.Role))...)
+	stmts = append(stmts, grantStmts(cluster, next.Role, next.Access)...)
+	if grantedOwner(stmts, mon.Role) {
+		t.Fatalf("expected the monitoring role not to join the owner group on a later bind, got %v", stmts)
+	}
+
+	// Unbinding the other binding
+	stmts = append(accessGroupStmts(cluster), legacyRoleStmts(legacyRoles(names, []BindingRecord{mon, next}, ""))...)
+	if grantedOwner(stmts, mon.Role) {
+		t.Fatalf("expected the monitoring role not to join the owner group on unbind, got %v", stmts)
+	}
+}
+
+func TestUnitStandbyMonitoringNeverOwner(t *testing.T) {
+	source := &crv1.Pgcluster{Spec: crv1.PgclusterSpec{Database: "userdb", User: "testuser"}}
+	standby := &crv1.Pgcluster{Spec: crv1.PgclusterSpec{Database: "userdb", User: "testuser", Standby: true}}
+
+	// The monitoring role of the standby is created on the source, and
+	// recorded on the standby
+	mon := BindingRecord{BindingID: "a", Role: bindingRole("a"), Access: AccessReadOnly, Type: BindingMonitoring}
+	recordOn(standby, mon)
+
+	// Binding the source afterwards
+	next := BindingRecord{BindingID: "b", Role: bindingRole("b"), Access: AccessOwner}
+	names := []string{mon.Role, next.Role}
+	recs := roleRecords(source, []*crv1.Pgcluster{standby})
+	if roles := legacyRoles(names, recs, next.Role); len(roles) != 0 {
+		t.Fatalf("expected the standby's role not to be legacy, got %v", roles)
+	}
+	stmts := append(accessGroupStmts(source), legacyRoleStmts(legacyRoles(names, recs, next.Role))...)
+	stmts = append(stmts, grantStmts(source, next.Role, next.Access)...)
+	if grantedOwner(stmts, mon.Role) {
+		t.Fatalf("expected the standby's monitoring role not to join the owner group of the source, got %v", stmts)
+	}
+
+	// Without the standby's records, its role would pass for a legacy one
+	if roles := legacyRoles(names, roleRecords(source, nil), next.Role); len(roles) != 1 || roles[0] != mon.Role {
+		t.Fatalf("expected the unrecorded role to be legacy, got %v", roles)
+	}
+}
+
+func TestUnitCheckReplication(t *testing.T) {
+	cluster := &crv1.Pgcluster{}
+	recordOn(cluster, BindingRecord{BindingID: "a", Type: BindingReplication, Publication: "unit_pub", Slot: "unit_slot"})
+
+	tests := []struct {
+		name string
+		req  BindRequest
+		err  error
+	}{
+		{"app binding", BindRequest{BindingID: "b", PgBouncer: true}, nil},
+		{"other objects", BindRequest{BindingID: "b", Type: BindingReplication, Publication: "other_pub", Slot: "other_slot"}, nil},
+		{"rebinding itself", BindRequest{BindingID: "a", Type: BindingReplication, Publication: "unit_pub", Slot: "unit_slot"}, nil},
+		{"taken publication", BindRequest{BindingID: "b", Type: BindingReplication, Publication: "unit_pub"}, ErrConflict{}},
+		{"taken slot", BindRequest{BindingID: "b", Type: BindingReplication, Slot: "unit_slot"}, ErrConflict{}},
+		{"through pgBouncer", BindRequest{BindingID: "b", Type: BindingReplication, PgBouncer: true}, ErrInvalidParams{}},
+	}
+	for _, tt := range tests {
+		err := checkReplication(cluster, tt.req)
+		if fmt.Sprintf("%T", err) != fmt.Sprintf("%T", tt.err) {
+			t.Errorf("%s: expected %T, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	cluster.Spec.Standby = true
+	if _, ok := checkReplication(cluster, BindRequest{BindingID: "b", Type: BindingReplication, Slot: "other_slot"}).(ErrInvalidParams); !ok {
+		t.Errorf("expected slots to be refused on a standby")
+	}
+}
+
+func TestUnitPublicationStmt(t *testing.T) {
+	stmt := publicationStmt("unit's pub")
+	for _, exp := range []string{`pubname = 'unit''s pub'`, `CREATE PUBLICATION "unit's pub" FOR ALL TABLES`} {
+		if !strings.Contains(stmt, exp) {
+			t.Errorf("expected %q in %s", exp, stmt)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	api "github.com/crunchydata/postgres-operator/cmd/pgo/api"
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+	msgs "github.com/crunchydata/postgres-operator/pkg/apiservermsgs"
+	"github.com/lib/pq"
+)
+
+// A role has a single password, so rotating the password of a binding role
+// invalidates the credentials in use at once. Rotations with a grace period
+// hand out the credentials of a second role acting as the binding role
+// instead, alternating between the two, and leave the previous one valid
+// until the period ends
+
+// alternateRole is the name of the role alternating with a binding role
+func alternateRole(role string) string {
+	return role + "_alt"
+}
+
+// SetRotationPolicy sets the schedule the janitor rotates binding passwords
+// on
+func (po *PGOperator) SetRotationPolicy(p RotationPolicy) {
+	po.rotation = p
+}
+
+// RotateBinding gives a binding a new password. With a grace period, the
+// binding switches roles, so that its previous password stays valid until
+// the period ends
+func (po *PGOperator) RotateBinding(req RotateRequest) (BindingRecord, error) {
+	log.Printf("RotateBinding called %s\n", req.InstanceID)
+	hc, err := po.httpClient()
+	if err != nil {
+		return BindingRecord{}, ErrBackendUnavailable{err}
+	}
+
+	cluster, err := po.getCluster(req.InstanceID)
+	if err != nil {
+		log.Printf("error finding instance in RotateBinding: %s\n", err)
+		return BindingRecord{}, err
+	}
+	if cluster.Status.State != crv1.PgclusterStateInitialized {
+		return BindingRecord{}, ErrConcurrency{ID: req.InstanceID}
+	}
+	if _, ok := cluster.Labels[_DEPROVISIONED_LABEL_KEY]; ok {
+		return BindingRecord{}, ErrConcurrency{ID: req.InstanceID}
+	}
+	rec, ok := findBindingRecord(cluster, req.BindingID)
+	if !ok {
+		return BindingRecord{}, ErrNoBinding{InstanceID: req.InstanceID, BindID: req.BindingID}
+	}
+
+	return po.rotateBinding(hc, cluster, rec, req.Grace)
+}
+
+// rotateBinding rotates the password of a recorded binding and records the
+// outcome
+func (po *PGOperator) rotateBinding(hc *http.Client, cluster *crv1.Pgcluster, rec BindingRecord, grace time.Duration) (BindingRecord, error) {
+	now := time.Now().UTC()
+	if rec.ExpiresAt != nil && now.After(*rec.ExpiresAt) {
+		return BindingRecord{}, ErrConflict{Reason: fmt.Sprintf("binding %s expired at %s", rec.BindingID, rec.ExpiresAt.Format(time.RFC3339))}
+	}
+	if rec.ClientCert {
+		return BindingRecord{}, ErrConflict{Reason: fmt.Sprintf("binding %s authenticates with a client certificate", rec.BindingID)}
+	}
+	if rec.GraceUntil != nil && now.Before(*rec.GraceUntil) {
+		return BindingRecord{}, ErrConflict{Reason: fmt.Sprintf("binding %s keeps its previous password until %s",
+			rec.BindingID, rec.GraceUntil.Format(time.RFC3339))}
+	}
+	wc, err := po.writableCluster(cluster)
+	if err != nil {
+		return BindingRecord{}, err
+	}
+	if rec.GraceUntil != nil {
+		if err := po.endGrace(hc, wc, &rec); err != nil {
+			return BindingRecord{}, err
+		}
+	}
+
+	role := rec.activeRole()
+	if grace > 0 {
+		if rec.AlternateRole == "" {
+			rec.AlternateRole = alternateRole(rec.Role)
+			if err := po.createAlternate(hc, wc, rec); err != nil {
+				log.Printf("error creating alternate role of binding %s: %s\n", rec.BindingID, err)
+				return BindingRecord{}, err
+			}
+		}
+		role = rec.inactiveRole()
+	}
+	if err := po.rotatePassword(hc, wc, role, rec.passwordPolicy()); err != nil {
+		log.Printf("error rotating password of %s: %s\n", role, err)
+		return BindingRecord{}, err
+	}
+	if rec.ExpiresAt != nil {
+		// Setting a password may reset when it is valid until
+		if err := po.limitValidity(hc, wc, *rec.ExpiresAt, role); err != nil {
+			log.Printf("error limiting validity of %s: %s\n", role, err)
+			return BindingRecord{}, err
+		}
+	}
+
+	rec.ActiveRole = ""
+	if role != rec.Role {
+		rec.ActiveRole = role
+	}
+	rec.RotatedAt = &now
+	if grace > 0 {
+		until := now.Add(grace)
+		rec.GraceUntil = &until
+		if err := po.applyConnLimits(hc, wc, rec); err != nil {
+			log.Printf("error dividing connection limit of binding %s: %s\n", rec.BindingID, err)
+			return BindingRecord{}, err
+		}
+	}
+	if err := po.recordBinding(cluster, rec); err != nil {
+		log.Printf("error recording binding %s: %s\n", rec.BindingID, err)
+		return BindingRecord{}, err
+	}
+	log.Printf("rotated password of binding %s\n", rec.BindingID)
+
+	return rec, nil
+}
+
+// endGrace invalidates the previous password of a binding rotated with a
+// grace period by rotating it to one nobody is given
+func (po *PGOperator) endGrace(hc *http.Client, wc *crv1.Pgcluster, rec *BindingRecord) error {
+	if role := rec.inactiveRole(); role != "" {
+		if err := po.rotatePassword(hc, wc, role, rec.passwordPolicy()); err != nil {
+			log.Printf("error ending grace period of binding %s: %s\n", rec.BindingID, err)
+			return err
+		}
+	}
+	rec.GraceUntil = nil
+	return po.applyConnLimits(hc, wc, *rec)
+}
+
+// rotatePassword gives a role a new password following policy, which the
+// operator stores in the Secret it keeps the password of managed users in
+func (po *PGOperator) rotatePassword(hc *http.Client, wc *crv1.Pgcluster, role string, policy PasswordPolicy) error {
+	uuReq := msgs.UpdateUserRequest{
+		ClientVersion: po.clientVer,
+		Namespace:     wc.GetNamespace(),
+		Selector:      po.instLabel(wc.Labels[po.instLabelKey]),
+		Username:      role,
+		ManagedUser:   true,
+	}
+	if err := policy.applyUpdate(&uuReq); err != nil {
+		return err
+	}
+	resp, err := api.UpdateUser(hc, &po.pgoCreds, &uuReq)
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	if resp.Status.Code != msgs.Ok {
+		return fmt.Errorf("error updating user %s: %s", role, resp.Msg)
+	}
+	for _, r := range resp.Results {
+		if r.Error {
+			return fmt.Errorf("error updating user %s: %s", r.Username, r.ErrorMessage)
+		}
+	}
+
+	if policy.SCRAMOnly {
+		return po.verifySCRAM(hc, wc, role)
+	}
+	return nil
+}
+
+// createAlternate creates the alternate role of a binding, which acts as the
+// binding role in every session
+func (po *PGOperator) createAlternate(hc *http.Client, wc *crv1.Pgcluster, rec BindingRecord) error {
+	cuReq := msgs.CreateUserRequest{
+		Username:      rec.AlternateRole,
+		Namespace:     wc.GetNamespace(),
+		Selector:      po.instLabel(wc.Labels[po.instLabelKey]),
+		ManagedUser:   true,
+		ClientVersion: po.clientVer,
+	}
+	if err := rec.passwordPolicy().applyCreate(&cuReq); err != nil {
+		return err
+	}
+	cuResp, err := api.CreateUser(hc, &po.pgoCreds, &cuReq)
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	if cuResp.Code != msgs.Ok {
+		// Left behind by an earlier attempt, the grants below still apply
+		log.Printf("Unable to create user %s: %s\n", rec.AlternateRole, cuResp.Msg)
+	}
+
+	db, err := po.openDB(hc, wc)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return execAll(db, alternateStmts(wc, rec))
+}
+
+// alternateStmts let the alternate role of a binding act as its role. The
+// settings of a role only apply to the role logging in, so those of the
+// binding role are repeated
+func alternateStmts(cluster *crv1.Pgcluster, rec BindingRecord) []string {
+	a, r := pq.QuoteIdentifier(rec.AlternateRole), pq.QuoteIdentifier(rec.Role)
+
+	// Owner bindings of the instance database act as the owner group, a
+	// member of which the binding role is
+	actAs := rec.Role
+	if rec.Access == AccessOwner && (rec.Isolation == "" || rec.Isolation == IsolationShared) {
+		actAs = ownerGroup
+	}
+	stmts := []string{
+		fmt.Sprintf("GRANT %s TO %s", r, a),
+		fmt.Sprintf("ALTER ROLE %s SET role = %s", a, pq.QuoteLiteral(actAs)),
+	}
+	if rec.Access != "" {
+		// Bindings with access levels are not given the operator's grants
+		stmts = append(stmts, fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", pq.QuoteIdentifier(cluster.Spec.Database), a))
+	}
+	if rec.Access == AccessReadOnly && rec.Type == "" {
+		stmts = append(stmts, fmt.Sprintf("ALTER ROLE %s SET default_transaction_read_only = on", a))
+	}
+	if rec.Type == BindingReplication {
+		// Walsenders check the attribute of the role logging in
+		stmts = append(stmts, fmt.Sprintf("ALTER ROLE %s REPLICATION", a))
+	}
+	if rec.Isolation == IsolationSchema {
+		stmts = append(stmts, fmt.Sprintf("ALTER ROLE %s SET search_path = %s", a, pq.QuoteIdentifier(rec.dataName())))
+	}
+	if rec.ExpiresAt != nil {
+		stmts = append(stmts, validUntilStmt(rec.AlternateRole, *rec.ExpiresAt))
+	}
+	limits := rec.roleLimits()
+	limits.ConnectionLimit = 0
+	stmts = append(stmts, limitStmts(rec.AlternateRole, limits)...)
+
+	return stmts
+}
+
+// rotateDue ends the grace periods which are over and, when scheduled,
+// rotates the passwords of bindings older than the rotation interval
+func (po *PGOperator) rotateDue() error {
+	hc, err := po.httpClient()
+	if err != nil {
+		return err
+	}
+
+	clusters, err := po.activeClusters()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, cluster := range clusters {
+		for _, rec := range bindingRecords(cluster) {
+			if rec.ExpiresAt != nil && now.After(*rec.ExpiresAt) || rec.ClientCert {
+				// Left to the reaper, or without a password
+				continue
+			}
+			if rec.GraceUntil != nil && !now.Before(*rec.GraceUntil) {
+				wc, err := po.writableCluster(cluster)
+				if err == nil {
+					err = po.endGrace(hc, wc, &rec)
+				}
+				if err == nil {
+					err = po.recordBinding(cluster, rec)
+				}
+				if err != nil {
+					log.Printf("janitor: error ending grace period of binding %s: %s\n", rec.BindingID, err)
+					continue
+				}
+			}
+
+			last := rec.CreatedAt
+			if rec.RotatedAt != nil {
+				last = *rec.RotatedAt
+			}
+			if po.rotation.Interval == 0 || rec.GraceUntil != nil || now.Sub(last) < po.rotation.Interval {
+				continue
+			}
+			if _, err := po.rotateBinding(hc, cluster, rec, po.rotation.Grace); err != nil {
+				log.Printf("janitor: error rotating binding %s: %s\n", rec.BindingID, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,688 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	api "github.com/crunchydata/postgres-operator/cmd/pgo/api"
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+	msgs "github.com/crunchydata/postgres-operator/pkg/apiservermsgs"
+
+	"github.com/lib/pq"
+)
+
+// Group roles holding the privileges of each access level. Binding roles
+// are made members of the group of their level, which lets privileges on
+// objects created later be granted once through default privileges. The
+// owner group also owns the objects created through owner bindings
+const (
+	readOnlyGroup  = "pgo_osb_readonly"
+	readWriteGroup = "pgo_osb_readwrite"
+	ownerGroup     = "pgo_osb_owner"
+)
+
+// accessGroups maps access levels to their group role
+var accessGroups = map[AccessLevel]string{
+	AccessReadOnly:  readOnlyGroup,
+	AccessReadWrite: readWriteGroup,
+	AccessOwner:     ownerGroup,
+}
+
+// systemAccounts returns the passwords of the system accounts of cluster,
+// keyed by username, along with that of the cluster's default user
+func (po *PGOperator) systemAccounts(hc *http.Client, cluster *crv1.Pgcluster) (map[string]string, error) {
+	suReq := &msgs.ShowUserRequest{
+		ClientVersion:      po.clientVer,
+		Namespace:          cluster.GetNamespace(),
+		Selector:           po.instLabel(cluster.Labels[po.instLabelKey]),
+		ShowSystemAccounts: true,
+	}
+	suResp, err := api.ShowUser(hc, &po.pgoCreds, suReq)
+	if err != nil {
+		log.Printf("error getting system account details: %s\n", err)
+		return nil, ErrBackendUnavailable{err}
+	}
+	if suResp.Status.Code != msgs.Ok {
+		log.Println(suResp.Status.Msg)
+		return nil, errors.New("error fetching system accounts: " + suResp.Status.Msg)
+	}
+
+	accounts := make(map[string]string, len(suResp.Results))
+	for _, u := range suResp.Results {
+		accounts[u.Username] = u.Password
+	}
+	return accounts, nil
+}
+
+// openDB connects to the instance database of cluster as the superuser.
+// The broker is expected to run inside the Kubernetes cluster, where the
+// primary is reachable through its Service
+func (po *PGOperator) openDB(hc *http.Client, cluster *crv1.Pgcluster) (*sql.DB, error) {
+	return po.openDatabase(hc, cluster, cluster.Spec.Database)
+}
+
+// openDatabase connects to the named database of cluster as the superuser
+func (po *PGOperator) openDatabase(hc *http.Client, cluster *crv1.Pgcluster, name string) (*sql.DB, error) {
+	accounts, err := po.systemAccounts(hc, cluster)
+	if err != nil {
+		return nil, err
+	}
+	pw, ok := accounts["postgres"]
+	if !ok {
+		return nil, fmt.Errorf("unable to find superuser password of cluster %s", cluster.GetName())
+	}
+
+	port := cluster.Spec.Port
+	if port == "" {
+		port = "5432"
+	}
+	sslmode := "disable"
+	if cluster.Spec.TLS.IsTLSEnabled() {
+		sslmode = "require"
+	}
+	dsn := fmt.Sprintf("host=%s port=%s dbname=%s user=postgres password=%s sslmode=%s connect_timeout=10",
+		dsnValue(cluster.GetName()+"."+cluster.GetNamespace()+".svc"), dsnValue(port),
+		dsnValue(name), dsnValue(pw), sslmode)
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		log.Printf("error connecting to cluster %s: %s\n", cluster.GetName(), err)
+		return nil, ErrBackendUnavailable{err}
+	}
+	return db, nil
+}
+
+// dsnValue quotes a value for use in a libpq keyword/value connection string
+func dsnValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// execAll runs statements in a single transaction
+func execAll(db *sql.DB, stmts []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error executing %q: %s", stmt, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// createGroupStmt creates a NOLOGIN role unless it exists
+func createGroupStmt(group string) string {
+	return fmt.Sprintf(`DO $$ BEGIN
+  IF NOT EXISTS (SELECT FROM pg_catalog.pg_roles WHERE rolname = %s) THEN
+    CREATE ROLE %s NOLOGIN;
+  END IF;
+END $$`, pq.QuoteLiteral(group), pq.QuoteIdentifier(group))
+}
+
+// accessGroupStmts sets up the access groups in the database of cluster.
+// The statements are idempotent and run ahead of every grant, so privileges
+// on tables created outside of owner bindings are picked up as well.
+// The owner group may create in the public schema, which the cluster's
+// default user joins to keep the privileges it has through PUBLIC should the
+// public schema be restricted
+func accessGroupStmts(cluster *crv1.Pgcluster) []string {
+	db := pq.QuoteIdentifier(cluster.Spec.Database)
+	ro := pq.QuoteIdentifier(readOnlyGroup)
+	rw := pq.QuoteIdentifier(readWriteGroup)
+	owner := pq.QuoteIdentifier(ownerGroup)
+
+	stmts := []string{
+		createGroupStmt(readOnlyGroup),
+		createGroupStmt(readWriteGroup),
+		createGroupStmt(ownerGroup),
+		fmt.Sprintf("GRANT %s TO %s", ro, rw),
+		fmt.Sprintf("GRANT %s TO %s", rw, owner),
+		fmt.Sprintf("GRANT CONNECT, TEMPORARY ON DATABASE %s TO %s", db, ro),
+		fmt.Sprintf("GRANT CREATE ON DATABASE %s TO %s", db, owner),
+		fmt.Sprintf("GRANT USAGE ON SCHEMA public TO %s", ro),
+		fmt.Sprintf("GRANT CREATE ON SCHEMA public TO %s", owner),
+		fmt.Sprintf("GRANT SELECT ON ALL TABLES IN SCHEMA public TO %s", ro),
+		fmt.Sprintf("GRANT SELECT ON ALL SEQUENCES IN SCHEMA public TO %s", ro),
+		fmt.Sprintf("GRANT INSERT, UPDATE, DELETE, TRUNCATE ON ALL TABLES IN SCHEMA public TO %s", rw),
+		fmt.Sprintf("GRANT USAGE, UPDATE ON ALL SEQUENCES IN SCHEMA public TO %s", rw),
+	}
+
+	stmts = append(stmts, defaultPrivilegeStmts(ownerGroup)...)
+	if cluster.Spec.User != "" {
+		stmts = append(stmts, fmt.Sprintf("GRANT %s TO %s", owner, pq.QuoteIdentifier(cluster.Spec.User)))
+		stmts = append(stmts, defaultPrivilegeStmts(cluster.Spec.User)...)
+	}
+
+	return stmts
+}
+
+// legacyRolesQuery selects the roles named like binding roles
+const legacyRolesQuery = "SELECT rolname FROM pg_catalog.pg_roles WHERE rolname ~ $1"
+
+// legacyRoles returns the roles among names which were created for bindings
+// before the registry existed, those without a binding record. Recorded
+// roles, whatever their access level, type or isolation, are only granted
+// what their record calls for, and newRole is about to be granted its own
+func legacyRoles(names []string, recs []BindingRecord, newRole string) []string {
+	recorded := recordedRoles(recs)
+	var roles []string
+	for _, n := range names {
+		if n != newRole && !recorded[n] && legacyBindingRole.MatchString(n) {
+			roles = append(roles, n)
+		}
+	}
+	return roles
+}
+
+// legacyRoleStmts make legacy binding roles, which were given the operator's
+// grants, members of the owner group, to keep the privileges they have
+// through PUBLIC should the public schema be restricted
+func legacyRoleStmts(roles []string) []string {
+	var stmts []string
+	for _, r := range roles {
+		stmts = append(stmts, fmt.Sprintf("GRANT %s TO %s", pq.QuoteIdentifier(ownerGroup), pq.QuoteIdentifier(r)))
+		stmts = append(stmts, defaultPrivilegeStmts(r)...)
+	}
+	return stmts
+}
+
+// queryRoles returns the role names selected by query
+func queryRoles(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, ErrBackendUnavailable{err}
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+	}
+	return names, rows.Err()
+}
+
+// migrateLegacyRoles makes the legacy binding roles of cluster members of
+// the owner group. The bindings of its standbys are recorded on them. This is done once, on the first grant or release after
+// upgrading the broker, so that roles of bindings in progress elsewhere are
+// never mistaken for legacy ones afterwards. newRole is left out, having no
+// record yet
+func (po *PGOperator) migrateLegacyRoles(db *sql.DB, cluster *crv1.Pgcluster, newRole string) error {
+	if cluster.Labels[_LEGACY_ROLES_LABEL_KEY] == legacyRolesMigrated {
+		return nil
+	}
+
+	names, err := queryRoles(db, legacyRolesQuery, legacyBindingRolePattern)
+	if err != nil {
+		return err
+	}
+	standbys, err := po.standbyClusters(cluster)
+	if err != nil {
+		return err
+	}
+	if roles := legacyRoles(names, roleRecords(cluster, standbys), newRole); len(roles) > 0 {
+		log.Printf("migrating legacy binding roles %v of cluster %s\n", roles, cluster.GetName())
+		if err := execAll(db, legacyRoleStmts(roles)); err != nil {
+			return err
+		}
+	}
+	return po.labelCluster(cluster, map[string]string{_LEGACY_ROLES_LABEL_KEY: legacyRolesMigrated})
+}
+
+// setUpAccessGroups sets up the access groups in the database of cluster
+// and migrates its legacy binding roles ahead of granting or releasing role
+func (po *PGOperator) setUpAccessGroups(db *sql.DB, cluster *crv1.Pgcluster, role string) error {
+	if err := execAll(db, accessGroupStmts(cluster)); err != nil {
+		return err
+	}
+	return po.migrateLegacyRoles(db, cluster, role)
+}
+
+// ownerRolesQuery selects the binding roles which are members of the owner
+// group
+const ownerRolesQuery = `SELECT m.rolname FROM pg_catalog.pg_auth_members a
+  JOIN pg_catalog.pg_roles m ON m.oid = a.member
+  JOIN pg_catalog.pg_roles g ON g.oid = a.roleid
+  WHERE g.rolname = $1 AND m.rolname ~ $2`
+
+// adoptStmts hand the objects of owner binding roles to the owner group
+func adoptStmts(roles []string) []string {
+	var stmts []string
+	for _, r := range roles {
+		stmts = append(stmts, reassignStmt(r, ownerGroup))
+	}
+	return stmts
+}
+
+// adoptOwnerObjects hands the objects created by owner binding roles before
+// the owner group owned them to the group. This is done once for each role,
+// those adopted being recorded on cluster
+func (po *PGOperator) adoptOwnerObjects(db *sql.DB, cluster *crv1.Pgcluster) error {
+	names, err := queryRoles(db, ownerRolesQuery, ownerGroup, legacyBindingRolePattern)
+	if err != nil {
+		return err
+	}
+
+	adopted := adoptedRoles(cluster)
+	var pending []string
+	for _, r := range names {
+		if !adopted[r] {
+			pending = append(pending, r)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := execAll(db, adoptStmts(pending)); err != nil {
+		return err
+	}
+	return po.recordAdoptedRoles(cluster, pending, nil)
+}
+
+// restrictPublicSchemaStmts leave creating objects in the public schema to
+// the owner group and the roles granted CREATE explicitly. They affect every
+// role of the database, so they only run once, on the first grant of
+// instances provisioned with them or of a readonly binding, which would
+// otherwise create objects through PUBLIC. The roles of bindings recorded
+// before access levels existed keep the operator's grants, CREATE included
+func restrictPublicSchemaStmts(recs []BindingRecord) []string {
+	stmts := []string{"REVOKE CREATE ON SCHEMA public FROM PUBLIC"}
+	for _, rec := range recs {
+		if rec.Access == "" {
+			stmts = append(stmts, fmt.Sprintf("GRANT CREATE ON SCHEMA public TO %s", pq.QuoteIdentifier(rec.Role)))
+		}
+	}
+	return stmts
+}
+
+// restrictsPublicSchema reports whether granting rec restricts the public
+// schema of cluster
+func restrictsPublicSchema(cluster *crv1.Pgcluster, rec BindingRecord) bool {
+	switch cluster.Labels[_RESTRICT_PUBLIC_LABEL_KEY] {
+	case "true":
+		return true
+	case restrictPublicApplied:
+		return false
+	}
+	return rec.Access == AccessReadOnly
+}
+
+// defaultPrivilegeStmts grants the access groups their privileges on the
+// objects role creates in the future
+func defaultPrivilegeStmts(role string) []string {
+	alter := "ALTER DEFAULT PRIVILEGES FOR ROLE " + pq.QuoteIdentifier(role) + " IN SCHEMA public "
+	ro := pq.QuoteIdentifier(readOnlyGroup)
+	rw := pq.QuoteIdentifier(readWriteGroup)
+
+	return []string{
+		alter + "GRANT SELECT ON TABLES TO " + ro,
+		alter + "GRANT SELECT ON SEQUENCES TO " + ro,
+		alter + "GRANT INSERT, UPDATE, DELETE, TRUNCATE ON TABLES TO " + rw,
+		alter + "GRANT USAGE, UPDATE ON SEQUENCES TO " + rw,
+	}
+}
+
+// grantStmts replaces the operator's default grants of a binding role with
+// the membership of its access group
+func grantStmts(cluster *crv1.Pgcluster, role string, access AccessLevel) []string {
+	r := pq.QuoteIdentifier(role)
+	stmts := []string{
+		fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", pq.QuoteIdentifier(cluster.Spec.Database), r),
+		fmt.Sprintf("GRANT %s TO %s", pq.QuoteIdentifier(accessGroups[access]), r),
+	}
+
+	switch access {
+	case AccessReadOnly:
+		stmts = append(stmts, fmt.Sprintf("ALTER ROLE %s SET default_transaction_read_only = on", r))
+	case AccessOwner:
+		// Sessions act as the owner group, so that the objects they create
+		// belong to the group and remain usable by the roles of later
+		// bindings once this one is unbound
+		stmts = append(stmts, fmt.Sprintf("ALTER ROLE %s SET role = %s", r, pq.QuoteLiteral(ownerGroup)))
+	}
+
+	return stmts
+}
+
+// releaseStmts prepare a binding role for being dropped. Objects it still
+// owns are handed to the owner group so they outlive the binding, and its
+// privileges, including default privileges, are removed
+func releaseStmts(role string) []string {
+	r := pq.QuoteIdentifier(role)
+	return []string{
+		fmt.Sprintf("REASSIGN OWNED BY %s TO %s", r, pq.QuoteIdentifier(ownerGroup)),
+		fmt.Sprintf("DROP OWNED BY %s", r),
+	}
+}
+
+// isolatedSchemaStmts confine a binding role to the schema of the binding,
+// which it owns and searches first
+func isolatedSchemaStmts(cluster *crv1.Pgcluster, role, schema string) []string {
+	r, sc := pq.QuoteIdentifier(role), pq.QuoteIdentifier(schema)
+	return []string{
+		fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", pq.QuoteIdentifier(cluster.Spec.Database), r),
+		fmt.Sprintf("GRANT CONNECT, TEMPORARY ON DATABASE %s TO %s", pq.QuoteIdentifier(cluster.Spec.Database), r),
+		fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s AUTHORIZATION %s", sc, r),
+		fmt.Sprintf("ALTER ROLE %s SET search_path = %s", r, sc),
+	}
+}
+
+// handOverStmts give the role of a successor binding what the role of its
+// predecessor owns in the current database, including the database itself.
+// The predecessor acts as its successor until it is unbound, keeping access
+// to what it handed over
+func handOverStmts(predRole, role string) []string {
+	p, r := pq.QuoteIdentifier(predRole), pq.QuoteIdentifier(role)
+	return []string{
+		reassignStmt(predRole, role),
+		fmt.Sprintf("GRANT %s TO %s", r, p),
+		fmt.Sprintf("ALTER ROLE %s SET role = %s", p, pq.QuoteLiteral(role)),
+	}
+}
+
+// reassignStmt gives to what from owns in the current database
+func reassignStmt(from, to string) string {
+	return fmt.Sprintf("REASSIGN OWNED BY %s TO %s", pq.QuoteIdentifier(from), pq.QuoteIdentifier(to))
+}
+
+// validUntilStmt keeps role from logging in after expires
+func validUntilStmt(role string, expires time.Time) string {
+	return fmt.Sprintf("ALTER ROLE %s VALID UNTIL %s", pq.QuoteIdentifier(role), pq.QuoteLiteral(expires.UTC().Format(time.RFC3339)))
+}
+
+// grantAccess grants the role of a binding the privileges of its access
+// level or type in the database of cluster, or sets up the schema or
+// database it is isolated to. An isolated successor is handed the schema or
+// database of predRole, the role of its predecessor, when given
+func (po *PGOperator) grantAccess(hc *http.Client, cluster *crv1.Pgcluster, rec BindingRecord, predRole string) error {
+	if _, ok := accessGroups[rec.Access]; !ok {
+		return ErrInvalidParams{Violations: []string{fmt.Sprintf("unknown access level %q", rec.Access)}}
+	}
+	switch rec.Type {
+	case "", BindingMonitoring, BindingReplication:
+	default:
+		return ErrInvalidParams{Violations: []string{fmt.Sprintf("unknown binding type %q", rec.Type)}}
+	}
+
+	db, err := po.openDB(hc, cluster)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	role := rec.Role
+	if err := po.setUpAccessGroups(db, cluster, role); err != nil {
+		return err
+	}
+	var stmts []string
+	restrict := restrictsPublicSchema(cluster, rec)
+	if restrict {
+		stmts = append(stmts, restrictPublicSchemaStmts(bindingRecords(cluster))...)
+	}
+	switch rec.Isolation {
+	case "", IsolationShared:
+		if rec.Type != "" {
+			stmts = append(stmts, bindingTypeStmts(cluster, rec)...)
+		} else {
+			stmts = append(stmts, grantStmts(cluster, role, rec.Access)...)
+		}
+	case IsolationSchema:
+		if predRole != "" {
+			stmts = append(stmts, handOverStmts(predRole, role)...)
+		}
+		stmts = append(stmts, isolatedSchemaStmts(cluster, role, rec.dataName())...)
+	case IsolationDatabase:
+		stmts = append(stmts, fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s",
+			pq.QuoteIdentifier(cluster.Spec.Database), pq.QuoteIdentifier(role)))
+		if predRole != "" {
+			stmts = append(stmts, handOverStmts(predRole, role)...)
+		}
+	default:
+		return ErrInvalidParams{Violations: []string{fmt.Sprintf("unknown isolation %q", rec.Isolation)}}
+	}
+	if rec.ExpiresAt != nil {
+		stmts = append(stmts, validUntilStmt(role, *rec.ExpiresAt))
+	}
+	if rec.ClientCert {
+		stmts = append(stmts, certAuthStmts(role)...)
+	}
+	stmts = append(stmts, limitStmts(role, rec.roleLimits())...)
+	if err := execAll(db, stmts); err != nil {
+		return err
+	}
+	if err := po.adoptOwnerObjects(db, cluster); err != nil {
+		return err
+	}
+	if restrict {
+		// Left alone from now on, should PUBLIC be granted CREATE again
+		if err := po.labelCluster(cluster, map[string]string{_RESTRICT_PUBLIC_LABEL_KEY: restrictPublicApplied}); err != nil {
+			return err
+		}
+	}
+
+	if rec.Slot != "" {
+		if err := createSlot(db, rec.Slot); err != nil {
+			return err
+		}
+	}
+	if rec.Isolation == IsolationDatabase {
+		if err := createRoleDatabase(db, rec.dataName(), role); err != nil {
+			return err
+		}
+		if predRole != "" {
+			// The objects in the database were left to its previous owner
+			rdb, err := po.openDatabase(hc, cluster, rec.dataName())
+			if err != nil {
+				return err
+			}
+			defer rdb.Close()
+			if err := execAll(rdb, []string{reassignStmt(predRole, role)}); err != nil {
+				return err
+			}
+		}
+	}
+	if rec.PgBouncer {
+		dbName := cluster.Spec.Database
+		if rec.Isolation == IsolationDatabase {
+			dbName = rec.dataName()
+		}
+		return po.registerPgBouncer(hc, cluster, db, dbName)
+	}
+	return nil
+}
+
+// limitValidity applies the expiry of a binding to some of its roles
+func (po *PGOperator) limitValidity(hc *http.Client, cluster *crv1.Pgcluster, expires time.Time, roles ...string) error {
+	db, err := po.openDB(hc, cluster)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var stmts []string
+	for _, role := range roles {
+		stmts = append(stmts, validUntilStmt(role, expires))
+	}
+	return execAll(db, stmts)
+}
+
+// pgBouncerAuthStmts install the function pgBouncer looks up passwords
+// with, as the operator does in the databases existing when pgBouncer is
+// added. It only returns the passwords of ordinary login roles
+var pgBouncerAuthStmts = []string{
+	"CREATE SCHEMA IF NOT EXISTS pgbouncer",
+	"REVOKE ALL PRIVILEGES ON SCHEMA pgbouncer FROM PUBLIC, pgbouncer",
+	"GRANT USAGE ON SCHEMA pgbouncer TO pgbouncer",
+	`CREATE OR REPLACE FUNCTION pgbouncer.get_auth(username TEXT)
+RETURNS TABLE(username TEXT, password TEXT) AS
+$$
+  SELECT rolname::TEXT, rolpassword::TEXT
+  FROM pg_catalog.pg_authid
+  WHERE pg_authid.rolname = $1
+    AND pg_authid.rolcanlogin
+    AND NOT pg_authid.rolsuper
+    AND NOT pg_authid.rolreplication
+    AND pg_authid.rolname <> 'pgbouncer'
+    AND (pg_authid.rolvaliduntil IS NULL OR pg_authid.rolvaliduntil >= CURRENT_TIMESTAMP)
+$$
+LANGUAGE SQL STABLE SECURITY DEFINER`,
+	"REVOKE ALL ON FUNCTION pgbouncer.get_auth(username TEXT) FROM PUBLIC, pgbouncer",
+	"GRANT EXECUTE ON FUNCTION pgbouncer.get_auth(username TEXT) TO pgbouncer",
+}
+
+// registerPgBouncer makes sure pgBouncer can authenticate roles connecting
+// to the named database, which lacks the lookup function when it was created
+// after pgBouncer, like the databases of isolated bindings
+func (po *PGOperator) registerPgBouncer(hc *http.Client, cluster *crv1.Pgcluster, db *sql.DB, dbName string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT FROM pg_catalog.pg_roles WHERE rolname = 'pgbouncer')").Scan(&exists)
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	if !exists {
+		return ErrInvalidParams{Violations: []string{fmt.Sprintf("pgBouncer is not set up in cluster %s", cluster.GetName())}}
+	}
+
+	if dbName != cluster.Spec.Database {
+		if db, err = po.openDatabase(hc, cluster, dbName); err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+	return execAll(db, pgBouncerAuthStmts)
+}
+
+// createRoleDatabase creates the named database of a binding, owned by its
+// role and closed to everyone else. CREATE DATABASE cannot run in a
+// transaction
+func createRoleDatabase(db *sql.DB, name, role string) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT FROM pg_catalog.pg_database WHERE datname = $1)", name).Scan(&exists)
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+
+	n, r := pq.QuoteIdentifier(name), pq.QuoteIdentifier(role)
+	stmts := []string{
+		fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM PUBLIC", n),
+		fmt.Sprintf("GRANT ALL ON DATABASE %s TO %s", n, r),
+	}
+	if !exists {
+		stmts = append([]string{fmt.Sprintf("CREATE DATABASE %s OWNER %s", n, r)}, stmts...)
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("error executing %q: %s", stmt, err)
+		}
+	}
+	return nil
+}
+
+// releaseRole removes what would keep the role of a binding from being
+// dropped in the database of cluster. The schema or database of an isolated
+// binding is dropped, unless rec keeps it, in which case it is handed to the
+// owner group along with everything in it, or it was handed to a successor
+func (po *PGOperator) releaseRole(hc *http.Client, cluster *crv1.Pgcluster, rec BindingRecord) error {
+	db, err := po.openDB(hc, cluster)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if rec.Type == BindingReplication {
+		if err := dropReplication(db, rec); err != nil {
+			return err
+		}
+	}
+
+	// The schema or database of a binding with a successor was handed over
+	handedOver := rec.Successor != ""
+	if rec.Isolation == IsolationDatabase && !handedOver {
+		if err := po.releaseRoleDatabase(hc, cluster, db, rec); err != nil {
+			return err
+		}
+	}
+
+	if err := po.setUpAccessGroups(db, cluster, ""); err != nil {
+		return err
+	}
+	var stmts []string
+	if rec.Isolation == IsolationSchema && !rec.KeepOnUnbind && !handedOver {
+		stmts = append(stmts, fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", pq.QuoteIdentifier(rec.dataName())))
+	}
+	if rec.AlternateRole != "" {
+		stmts = append(stmts, releaseStmts(rec.AlternateRole)...)
+	}
+	if err := execAll(db, append(stmts, releaseStmts(rec.Role)...)); err != nil {
+		return err
+	}
+
+	if adoptedRoles(cluster)[rec.Role] {
+		return po.recordAdoptedRoles(cluster, nil, []string{rec.Role})
+	}
+	return nil
+}
+
+// releaseRoleDatabase drops the database of a binding isolated to one, or
+// hands over what the binding's role owns in it when it is kept
+func (po *PGOperator) releaseRoleDatabase(hc *http.Client, cluster *crv1.Pgcluster, db *sql.DB, rec BindingRecord) error {
+	name := rec.dataName()
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT FROM pg_catalog.pg_database WHERE datname = $1)", name).Scan(&exists)
+	if err != nil {
+		return ErrBackendUnavailable{err}
+	}
+	if !exists {
+		return nil
+	}
+
+	if !rec.KeepOnUnbind {
+		_, err := db.Exec("SELECT pg_catalog.pg_terminate_backend(pid) FROM pg_catalog.pg_stat_activity WHERE datname = $1", name)
+		if err == nil {
+			_, err = db.Exec("DROP DATABASE " + pq.QuoteIdentifier(name))
+		}
+		if err != nil {
+			return fmt.Errorf("error dropping database %s: %s", name, err)
+		}
+		return nil
+	}
+
+	rdb, err := po.openDatabase(hc, cluster, name)
+	if err != nil {
+		return err
+	}
+	defer rdb.Close()
+
+	// The owner group exists once access groups were set up for the grant
+	return execAll(rdb, releaseStmts(rec.Role))
+}
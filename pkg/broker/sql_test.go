@@ -0,0 +1,198 @@
+package broker
+
+/*
+ Copyright 2017-2021 Crunchy Data Solutions, Inc.
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	crv1 "github.com/crunchydata/postgres-operator/pkg/apis/crunchydata.com/v1"
+)
+
+func TestUnitAccessGroupStmts(t *testing.T) {
+	cluster := &crv1.Pgcluster{Spec: crv1.PgclusterSpec{Database: "userdb", User: "testuser"}}
+	stmts := accessGroupStmts(cluster)
+	for _, stmt := range stmts {
+		if strings.Contains(stmt, "FROM PUBLIC") {
+			t.Errorf("expected the privileges of PUBLIC to be left alone, got %q", stmt)
+		}
+		if strings.Contains(stmt, "REASSIGN OWNED") {
+			t.Errorf("expected objects to be adopted apart from the group setup, got %q", stmt)
+		}
+	}
+
+	joined := strings.Join(stmts, "\n")
+	for _, want := range []string{
+		`GRANT "pgo_osb_owner" TO "testuser"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "pgo_osb_owner" IN SCHEMA public GRANT SELECT ON TABLES TO "pgo_osb_readonly"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "testuser" IN SCHEMA public GRANT INSERT, UPDATE, DELETE, TRUNCATE ON TABLES TO "pgo_osb_readwrite"`,
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("expected %q among the access group statements", want)
+		}
+	}
+}
+
+func TestUnitLegacyRoles(t *testing.T) {
+	legacy, recorded, created := bindingRole("a"), bindingRole("b"), bindingRole("c")
+	recs := []BindingRecord{{Role: recorded, AlternateRole: alternateRole(recorded), Access: AccessReadOnly}}
+	names := []string{"testuser", legacy, recorded, alternateRole(recorded), created}
+
+	if roles := legacyRoles(names, recs, created); !reflect.DeepEqual(roles, []string{legacy}) {
+		t.Errorf("expected only the unrecorded role to be legacy, got %v", roles)
+	}
+
+	expected := []string{
+		`GRANT "pgo_osb_owner" TO "` + legacy + `"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "` + legacy + `" IN SCHEMA public GRANT SELECT ON TABLES TO "pgo_osb_readonly"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "` + legacy + `" IN SCHEMA public GRANT SELECT ON SEQUENCES TO "pgo_osb_readonly"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "` + legacy + `" IN SCHEMA public GRANT INSERT, UPDATE, DELETE, TRUNCATE ON TABLES TO "pgo_osb_readwrite"`,
+		`ALTER DEFAULT PRIVILEGES FOR ROLE "` + legacy + `" IN SCHEMA public GRANT USAGE, UPDATE ON SEQUENCES TO "pgo_osb_readwrite"`,
+	}
+	if stmts := legacyRoleStmts([]string{legacy}); !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected legacy roles to join the owner group, got %v", stmts)
+	}
+}
+
+// bindingRole is the role name of a binding whose ID is c repeated
+func bindingRole(c string) string {
+	return "user" + strings.Repeat(c, 32)
+}
+
+func TestUnitGrantStmts(t *testing.T) {
+	cluster := &crv1.Pgcluster{Spec: crv1.PgclusterSpec{Database: "userdb", User: "testuser"}}
+
+	expected := []string{
+		`REVOKE ALL ON DATABASE "userdb" FROM "user_a"`,
+		`GRANT "pgo_osb_owner" TO "user_a"`,
+		`ALTER ROLE "user_a" SET role = 'pgo_osb_owner'`,
+	}
+	if stmts := grantStmts(cluster, "user_a", AccessOwner); !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected owner bindings to act as the owner group, got %v", stmts)
+	}
+
+	expected = []string{
+		`REVOKE ALL ON DATABASE "userdb" FROM "user_a"`,
+		`GRANT "pgo_osb_readonly" TO "user_a"`,
+		`ALTER ROLE "user_a" SET default_transaction_read_only = on`,
+	}
+	if stmts := grantStmts(cluster, "user_a", AccessReadOnly); !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected readonly bindings to default to read only transactions, got %v", stmts)
+	}
+}
+
+func TestUnitReleaseStmts(t *testing.T) {
+	expected := []string{
+		`REASSIGN OWNED BY "user_a" TO "pgo_osb_owner"`,
+		`DROP OWNED BY "user_a"`,
+	}
+	if stmts := releaseStmts("user_a"); !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected the objects of a released role to be handed to the owner group, got %v", stmts)
+	}
+}
+
+func TestUnitAdoptStmts(t *testing.T) {
+	expected := []string{
+		`REASSIGN OWNED BY "user_a" TO "pgo_osb_owner"`,
+		`REASSIGN OWNED BY "user_b" TO "pgo_osb_owner"`,
+	}
+	if stmts := adoptStmts([]string{"user_a", "user_b"}); !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected the objects of each role to be handed to the owner group, got %v", stmts)
+	}
+
+	cluster := &crv1.Pgcluster{}
+	if adopted := adoptedRoles(cluster); len(adopted) != 0 {
+		t.Errorf("expected no adopted roles without the annotation, got %v", adopted)
+	}
+	cluster.Annotations = map[string]string{adoptedRolesAnnotation: `["user_a","user_b"]`}
+	expectedRoles := map[string]bool{"user_a": true, "user_b": true}
+	if adopted := adoptedRoles(cluster); !reflect.DeepEqual(adopted, expectedRoles) {
+		t.Errorf("expected the recorded roles to be adopted, got %v", adopted)
+	}
+}
+
+func TestUnitIsolatedNeverOwner(t *testing.T) {
+	cluster := &crv1.Pgcluster{Spec: crv1.PgclusterSpec{Database: "userdb", User: "testuser"}}
+	schema := BindingRecord{Role: bindingRole("a"), Access: AccessOwner, Isolation: IsolationSchema}
+	database := BindingRecord{Role: bindingRole("b"), Access: AccessOwner, Isolation: IsolationDatabase}
+	names := []string{schema.Role, database.Role}
+
+	// Binding again after the isolated bindings
+	next := BindingRecord{Role: bindingRole("c"), Access: AccessReadOnly}
+	names = append(names, next.Role)
+	recs := []BindingRecord{schema, database}
+	stmts := append(accessGroupStmts(cluster), legacyRoleStmts(legacyRoles(names, recs, next.Role))...)
+	stmts = append(stmts, grantStmts(cluster, next.Role, next.Access)...)
+	for _, rec := range recs {
+		if grantedOwner(stmts, rec.Role) {
+			t.Errorf("expected the %s isolated role to stay out of the owner group, got %v", rec.Isolation, stmts)
+		}
+	}
+
+	// Unbinding the later binding
+	stmts = append(accessGroupStmts(cluster), legacyRoleStmts(legacyRoles(names, append(recs, next), ""))...)
+	stmts = append(stmts, releaseStmts(next.Role)...)
+	for _, rec := range recs {
+		if grantedOwner(stmts, rec.Role) {
+			t.Errorf("expected the %s isolated role to stay out of the owner group on unbind, got %v", rec.Isolation, stmts)
+		}
+	}
+
+	expected := []string{
+		`CREATE SCHEMA IF NOT EXISTS "` + schema.Role + `" AUTHORIZATION "` + schema.Role + `"`,
+		`ALTER ROLE "` + schema.Role + `" SET search_path = "` + schema.Role + `"`,
+	}
+	stmts = isolatedSchemaStmts(cluster, schema.Role, schema.dataName())
+	if !reflect.DeepEqual(stmts[2:], expected) {
+		t.Errorf("expected the role to own its schema, got %v", stmts)
+	}
+}
+
+func TestUnitRestrictPublicSchema(t *testing.T) {
+	cluster := &crv1.Pgcluster{}
+	owner := BindingRecord{Role: bindingRole("a"), Access: AccessOwner}
+	readOnly := BindingRecord{Role: bindingRole("b"), Access: AccessReadOnly}
+	monitoring := BindingRecord{Role: bindingRole("c"), Access: AccessReadOnly, Type: BindingMonitoring}
+
+	if restrictsPublicSchema(cluster, owner) {
+		t.Errorf("expected owner bindings to leave the public schema alone")
+	}
+	for _, rec := range []BindingRecord{readOnly, monitoring} {
+		if !restrictsPublicSchema(cluster, rec) {
+			t.Errorf("expected the first readonly binding to restrict the public schema")
+		}
+	}
+
+	cluster.Labels = map[string]string{_RESTRICT_PUBLIC_LABEL_KEY: "true"}
+	if !restrictsPublicSchema(cluster, owner) {
+		t.Errorf("expected instances provisioned with it to restrict the public schema on the first bind")
+	}
+	cluster.Labels[_RESTRICT_PUBLIC_LABEL_KEY] = restrictPublicApplied
+	if restrictsPublicSchema(cluster, readOnly) {
+		t.Errorf("expected the public schema to be restricted once")
+	}
+
+	// Bindings recorded before access levels existed keep CREATE
+	early := BindingRecord{Role: bindingRole("d")}
+	expected := []string{
+		"REVOKE CREATE ON SCHEMA public FROM PUBLIC",
+		`GRANT CREATE ON SCHEMA public TO "` + early.Role + `"`,
+	}
+	if stmts := restrictPublicSchemaStmts([]BindingRecord{owner, early, readOnly}); !reflect.DeepEqual(stmts, expected) {
+		t.Errorf("expected CREATE to be kept by roles without an access level only, got %v", stmts)
+	}
+}
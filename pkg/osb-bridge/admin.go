@@ -0,0 +1,163 @@
+package bridge
+
+/*
+Copyright 2018-2021 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crunchydata/pgo-osb/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// adminPrefix is the root of the admin API, which is served separately from
+// the OSB API and intended for broker operators only
+const adminPrefix = "/admin/v1/"
+
+// AdminHandler returns the handler of the admin API. Every request must
+// carry token as a bearer token.
+//
+//	GET /admin/v1/instances/{instance_id}/bindings
+//	  lists the bindings recorded for an instance
+//	POST /admin/v1/instances/{instance_id}/bindings/{binding_id}/rotate
+//	  rotates the password of a binding, keeping the previous one valid for
+//	  the optional "grace_period" of the JSON body, e.g. {"grace_period": "1h"}
+func (b *BusinessLogic) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPrefix+"instances/", b.adminInstances)
+
+	return adminAuth(token, mux)
+}
+
+// adminAuth rejects requests not carrying token as a bearer token
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeAdminJSON(w, http.StatusUnauthorized, adminErrorBody("Unauthorized", "a valid bearer token is required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminInstances routes requests for /admin/v1/instances/{instance_id}/...
+func (b *BusinessLogic) adminInstances(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminPrefix+"instances/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] != "" && parts[1] == "bindings":
+		if r.Method != http.MethodGet {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, adminErrorBody("MethodNotAllowed", r.Method+" is not supported"))
+			return
+		}
+		b.adminListBindings(w, parts[0])
+	case len(parts) == 4 && parts[0] != "" && parts[1] == "bindings" && parts[2] != "" && parts[3] == "rotate":
+		if r.Method != http.MethodPost {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, adminErrorBody("MethodNotAllowed", r.Method+" is not supported"))
+			return
+		}
+		b.adminRotateBinding(w, r, parts[0], parts[2])
+	default:
+		writeAdminJSON(w, http.StatusNotFound, adminErrorBody("NotFound", "no such admin resource"))
+	}
+}
+
+func (b *BusinessLogic) adminListBindings(w http.ResponseWriter, instanceID string) {
+	recs, err := b.Broker.ListBindings(instanceID)
+	if err != nil {
+		log.Printf("admin: error listing bindings: %s\n", err)
+		writeAdminError(w, err)
+		return
+	}
+	if recs == nil {
+		recs = []broker.BindingRecord{}
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"instance_id": instanceID,
+		"bindings":    recs,
+	})
+}
+
+func (b *BusinessLogic) adminRotateBinding(w http.ResponseWriter, r *http.Request, instanceID, bindID string) {
+	var body struct {
+		GracePeriod string `json:"grace_period"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAdminError(w, broker.ErrInvalidParams{Violations: []string{"invalid JSON body: " + err.Error()}})
+			return
+		}
+	}
+	req := broker.RotateRequest{InstanceID: instanceID, BindingID: bindID}
+	if body.GracePeriod != "" {
+		grace, err := time.ParseDuration(body.GracePeriod)
+		if err != nil || grace < 0 {
+			writeAdminError(w, broker.ErrInvalidParams{Violations: []string{"grace_period: must be a duration such as 30m or 24h"}})
+			return
+		}
+		req.Grace = grace
+	}
+
+	rec, err := b.Broker.RotateBinding(req)
+	if err != nil {
+		log.Printf("admin: error rotating binding: %s\n", err)
+		writeAdminError(w, err)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"instance_id": instanceID,
+		"binding":     rec,
+	})
+}
+
+// writeAdminError responds with the status and body an OSB request would
+// receive for the error
+func writeAdminError(w http.ResponseWriter, err error) {
+	e, ok := osbError(err, http.StatusNotFound).(osb.HTTPStatusCodeError)
+	if !ok {
+		writeAdminJSON(w, http.StatusInternalServerError, adminErrorBody("InternalError", err.Error()))
+		return
+	}
+
+	code := ""
+	if e.ErrorMessage != nil {
+		code = *e.ErrorMessage
+	}
+	writeAdminJSON(w, e.StatusCode, adminErrorBody(code, *e.Description))
+}
+
+func adminErrorBody(code, description string) map[string]string {
+	body := map[string]string{"description": description}
+	if code != "" {
+		body["error"] = code
+	}
+	return body
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("admin: error writing response: %s\n", err)
+	}
+}
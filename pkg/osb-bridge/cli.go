@@ -17,7 +17,9 @@ limitations under the License.
 
 import (
 	"flag"
+	"time"
 
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
@@ -25,17 +27,30 @@ import (
 // line. Users should add their own options here and add flags for them in
 // AddFlags.
 type Options struct {
-	CatalogPath           string
-	PGO_OSB_GUID          string
-	PGO_USERNAME          string
-	PGO_PASSWORD          string
-	PGO_APISERVER_URL     string
-	PGO_APISERVER_VERSION string
-	Async                 bool
+	CatalogPath             string
+	PGO_OSB_GUID            string
+	PGO_USERNAME            string
+	PGO_PASSWORD            string
+	PGO_APISERVER_URL       string
+	PGO_APISERVER_VERSION   string
+	Async                   bool
+	NamespaceFrom           string
+	FixedNamespace          string
+	ClusterNameFrom         string
+	NamespacePolicy         string
+	PlanConfig              string
+	JanitorInterval         time.Duration
+	ClusterDomain           string
+	NodePortHost            string
+	NetworkPolicyNamespaces string
+	RotationInterval        time.Duration
+	RotationGrace           time.Duration
+	ClientCASecret          string
 
 	// Unflagged configs
 	Simulated     bool
 	KubeAPIClient *rest.RESTClient
+	KubeClientset kubernetes.Interface
 }
 
 // AddFlags is a hook called to initialize the CLI flags for broker options.
@@ -49,5 +64,17 @@ func AddFlags(o *Options) {
 	flag.StringVar(&o.PGO_PASSWORD, "PGO_PASSWORD", "", "The pgo basic auth password to authenticate with ")
 	flag.StringVar(&o.PGO_OSB_GUID, "PGO_OSB_GUID", "", "The service broker guid to use for this broker instance")
 	flag.BoolVar(&o.Async, "async", false, "Indicates whether the broker is handling the requests asynchronously.")
+	flag.StringVar(&o.NamespaceFrom, "namespace-from", "", "Derives the namespace when PGO_NAMESPACE is omitted: 'context' for the platform namespace of the request, 'fixed' for --fixed-namespace, 'policy' for the single namespace assigned by --namespace-policy")
+	flag.StringVar(&o.FixedNamespace, "fixed-namespace", "", "The namespace to provision into when deriving namespaces with --namespace-from=fixed")
+	flag.StringVar(&o.NamespacePolicy, "namespace-policy", "", "Path to a YAML file mapping tenants to the namespaces they may provision into")
+	flag.StringVar(&o.PlanConfig, "plan-config", "", "Path to a YAML file adjusting the settings of the plans offered")
+	flag.DurationVar(&o.JanitorInterval, "janitor-interval", time.Hour, "How often to finish deprovisioning after final backups and purge expired volumes, 0 to disable")
+	flag.StringVar(&o.ClusterDomain, "cluster-domain", defaultClusterDomain, "The DNS domain of the Kubernetes cluster, used in Service DNS names returned to bindings")
+	flag.StringVar(&o.NodePortHost, "node-port-host", "", "The host bindings reach NodePort Services at, required by the node-port endpoint strategy")
+	flag.StringVar(&o.NetworkPolicyNamespaces, "network-policy-namespaces", "", "Comma-separated namespaces the operator and broker connect to instances from, admitted by the NetworkPolicies of bindings")
+	flag.DurationVar(&o.RotationInterval, "rotation-interval", 0, "Age after which the janitor rotates the password of a binding, 0 to disable")
+	flag.DurationVar(&o.RotationGrace, "rotation-grace", 0, "How long the previous password of a binding stays valid after a scheduled rotation, shorter than --rotation-interval")
+	flag.StringVar(&o.ClientCASecret, "client-ca-secret", "", "Secret, as namespace/name, holding the tls.crt and tls.key of the CA issuing client certificates to bindings requesting them")
+	flag.StringVar(&o.ClusterNameFrom, "cluster-name-from", "", "Derives the cluster name when PGO_CLUSTERNAME is omitted: 'instance-id' or 'instance-name' (from the request context)")
 
 }
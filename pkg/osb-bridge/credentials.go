@@ -0,0 +1,260 @@
+package bridge
+
+/*
+Copyright 2018-2021 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crunchydata/pgo-osb/pkg/broker"
+)
+
+// Formats of the credentials returned by Bind
+const (
+	// credsFormatOSB returns the keys the broker has always returned
+	credsFormatOSB = "osb"
+	// credsFormatServiceBinding returns keys following the servicebinding.io
+	// conventions for PostgreSQL, along with connection string variants
+	credsFormatServiceBinding = "servicebinding"
+	// credsFormatAll returns the keys of both formats
+	credsFormatAll = "all"
+)
+
+// connInfo describes how a binding connects to its instance
+type connInfo struct {
+	Host         string
+	InternalHost string
+	// ReplicaHost serves reads only, empty for clusters without replicas
+	ReplicaHost string
+	ReplicaPort int
+	Port        int
+	Database    string
+	Schema      string
+	Username    string
+	Password    string
+	ReadOnly    bool
+	TLS         bool
+	CACert      string
+	// ExpiresAt is set for bindings with a limited lifetime
+	ExpiresAt *time.Time
+	// ClientCert and ClientKey replace the password of bindings
+	// authenticating with a client certificate, issued by ClientCA
+	ClientCert string
+	ClientKey  string
+	ClientCA   string
+	// Limits are those set on the role of the binding
+	Limits broker.RoleLimits
+	// Endpoints adds the endpoints of the binding to the osb credentials
+	Endpoints bool
+}
+
+// endpoint is an endpoint of a binding as described by OSB 2.14, which
+// platforms may use to let bound apps through their network policies
+type endpoint struct {
+	Host     string   `json:"host"`
+	Ports    []string `json:"ports"`
+	Protocol string   `json:"protocol"`
+}
+
+// endpoints lists the hosts and ports the binding connects to
+func (ci connInfo) endpoints() []endpoint {
+	eps := []endpoint{{Host: ci.Host, Ports: []string{strconv.Itoa(ci.Port)}, Protocol: "tcp"}}
+	if ci.ReplicaHost != "" {
+		eps = append(eps, endpoint{Host: ci.ReplicaHost, Ports: []string{strconv.Itoa(ci.ReplicaPort)}, Protocol: "tcp"})
+	}
+	return eps
+}
+
+// sslMode is the libpq sslmode clients should connect with, verifying the
+// server certificate against the CA when it is known
+func (ci connInfo) sslMode() string {
+	switch {
+	case ci.TLS && ci.CACert != "":
+		return "verify-ca"
+	case ci.TLS:
+		return "require"
+	default:
+		return "disable"
+	}
+}
+
+func (ci connInfo) hostPort() string {
+	return net.JoinHostPort(ci.Host, strconv.Itoa(ci.Port))
+}
+
+// uri is a PostgreSQL connection URI for libpq and most drivers
+func (ci connInfo) uri() string {
+	return (&url.URL{
+		Scheme: "postgresql",
+		Host:   ci.hostPort(),
+		User:   ci.userinfo(),
+		Path:   ci.Database,
+	}).String()
+}
+
+// userinfo holds the credentials of a connection URI, which have no
+// password for client certificate bindings
+func (ci connInfo) userinfo() *url.Userinfo {
+	if ci.Password == "" {
+		return url.User(ci.Username)
+	}
+	return url.UserPassword(ci.Username, ci.Password)
+}
+
+// jdbcURL is a connection URL for the PostgreSQL JDBC driver, which takes
+// credentials as query parameters
+func (ci connInfo) jdbcURL() string {
+	q := url.Values{}
+	q.Set("user", ci.Username)
+	if ci.Password != "" {
+		q.Set("password", ci.Password)
+	}
+	q.Set("sslmode", ci.sslMode())
+	if ci.Schema != "" {
+		q.Set("currentSchema", ci.Schema)
+	}
+	return "jdbc:postgresql://" + ci.hostPort() + "/" + url.PathEscape(ci.Database) + "?" + q.Encode()
+}
+
+// dsn is a libpq keyword/value connection string
+func (ci connInfo) dsn() string {
+	kv := []string{
+		"host=" + dsnQuote(ci.Host),
+		"port=" + strconv.Itoa(ci.Port),
+		"dbname=" + dsnQuote(ci.Database),
+		"user=" + dsnQuote(ci.Username),
+	}
+	if ci.Password != "" {
+		kv = append(kv, "password="+dsnQuote(ci.Password))
+	}
+	kv = append(kv, "sslmode="+ci.sslMode())
+	return strings.Join(kv, " ")
+}
+
+// dsnQuote quotes a value of a keyword/value connection string
+func dsnQuote(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// credentials returns the credentials of a binding in format
+func (ci connInfo) credentials(format string) map[string]interface{} {
+	creds := map[string]interface{}{}
+	if format != credsFormatOSB {
+		creds = ci.serviceBindingCredentials()
+	}
+	if format == credsFormatServiceBinding {
+		return creds
+	}
+
+	creds["username"] = ci.Username
+	creds["password"] = ci.Password
+	creds["uri"] = ci.uri()
+	creds["db_port"] = ci.Port
+	creds["db_name"] = ci.Database
+	creds["db_host"] = ci.Host
+	creds["internal_host"] = ci.InternalHost
+	// The bind responses of the OSB client in use have no endpoints, which
+	// are only added to the credentials on request
+	if ci.Endpoints {
+		creds["endpoints"] = ci.endpoints()
+	}
+	if ci.Schema != "" {
+		creds["schema"] = ci.Schema
+	}
+	if ci.ReadOnly {
+		creds["read_only"] = true
+	}
+	// Nor do they have expires_at
+	if ci.ExpiresAt != nil {
+		creds["expires_at"] = ci.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if ci.ClientCert != "" {
+		delete(creds, "password")
+		creds["client_cert"] = ci.ClientCert
+		creds["client_key"] = ci.ClientKey
+		creds["client_ca"] = ci.ClientCA
+	}
+	// Nor metadata, which the limits of the binding would be reported in
+	if limits := ci.limits("_"); len(limits) > 0 {
+		creds["limits"] = limits
+	}
+	return creds
+}
+
+// serviceBindingCredentials returns the credentials of the servicebinding
+// format, whose values are all strings as they are projected into files
+func (ci connInfo) serviceBindingCredentials() map[string]interface{} {
+	creds := map[string]interface{}{
+		"type":     "postgresql",
+		"provider": "crunchydata",
+		"host":     ci.Host,
+		"port":     strconv.Itoa(ci.Port),
+		"database": ci.Database,
+		"username": ci.Username,
+		"password": ci.Password,
+		"uri":      ci.uri(),
+		"jdbc-url": ci.jdbcURL(),
+		"dsn":      ci.dsn(),
+		"sslmode":  ci.sslMode(),
+	}
+	if ci.CACert != "" {
+		creds["ca.crt"] = ci.CACert
+	}
+	if ci.ReplicaHost != "" {
+		creds["replica-host"] = ci.ReplicaHost
+	}
+	if ci.Schema != "" {
+		creds["schema"] = ci.Schema
+	}
+	if ci.ReadOnly {
+		creds["read-only"] = "true"
+	}
+	if ci.ExpiresAt != nil {
+		creds["expires-at"] = ci.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if ci.ClientCert != "" {
+		delete(creds, "password")
+		creds["tls.crt"] = ci.ClientCert
+		creds["tls.key"] = ci.ClientKey
+	}
+	for k, limit := range ci.limits("-") {
+		creds[k] = limit
+	}
+	return creds
+}
+
+// limits describes the limits set on the role of the binding, keyed by
+// their setting names with words separated by sep
+func (ci connInfo) limits(sep string) map[string]interface{} {
+	l := ci.Limits
+	limits := map[string]interface{}{}
+	if l.ConnectionLimit > 0 {
+		limits["connection"+sep+"limit"] = strconv.Itoa(l.ConnectionLimit)
+	}
+	if l.StatementTimeout > 0 {
+		limits["statement"+sep+"timeout"] = l.StatementTimeout.String()
+	}
+	if l.IdleInTransactionTimeout > 0 {
+		limits[strings.Join([]string{"idle", "in", "transaction", "session", "timeout"}, sep)] = l.IdleInTransactionTimeout.String()
+	}
+	if l.WorkMem > 0 {
+		limits["work"+sep+"mem"] = formatWorkMem(l.WorkMem)
+	}
+	return limits
+}
@@ -0,0 +1,102 @@
+package bridge
+
+/*
+Copyright 2018-2021 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+
+	"github.com/crunchydata/pgo-osb/pkg/broker"
+)
+
+// Strategies for choosing the host and port bindings connect to
+const (
+	// endpointAuto uses the external IP of the Service when it has one and
+	// its ClusterIP otherwise, as the broker always did
+	endpointAuto = "auto"
+	// endpointServiceDNS uses the DNS name of the Service, which survives
+	// the Service being recreated
+	endpointServiceDNS = "service-dns"
+	endpointClusterIP  = "cluster-ip"
+	// endpointLoadBalancer uses the load balancer of a LoadBalancer Service
+	endpointLoadBalancer = "load-balancer"
+	// endpointNodePort uses the node port of a NodePort Service on the host
+	// given by --node-port-host
+	endpointNodePort = "node-port"
+	// endpointRoute uses an OpenShift Route named after the Service, which
+	// is reached through the router's TLS port
+	endpointRoute = "route"
+)
+
+var endpointStrategies = []string{
+	endpointAuto,
+	endpointServiceDNS,
+	endpointClusterIP,
+	endpointLoadBalancer,
+	endpointNodePort,
+	endpointRoute,
+}
+
+// routePort is the port OpenShift routers accept TLS connections on
+const routePort = 443
+
+// defaultClusterDomain is the DNS domain of most Kubernetes clusters
+const defaultClusterDomain = "cluster.local"
+
+// endpointResolver turns Services into the host and port clients use
+type endpointResolver struct {
+	clusterDomain string
+	nodePortHost  string
+}
+
+// resolve returns the host and port of svc of a cluster with strategy,
+// failing with broker.ErrInvalidParams when svc is not exposed that way
+func (er endpointResolver) resolve(detail broker.ClusterDetails, svc broker.ServiceDetails, strategy string) (string, int, error) {
+	unavailable := func(reason string) (string, int, error) {
+		return "", 0, broker.ErrInvalidParams{Violations: []string{
+			fmt.Sprintf("%s: %s is not available, %s", paramEndpoint, strategy, reason),
+		}}
+	}
+
+	switch strategy {
+	case endpointServiceDNS:
+		return fmt.Sprintf("%s.%s.svc.%s", svc.Name, detail.Namespace, er.clusterDomain), detail.Port, nil
+	case endpointClusterIP:
+		return svc.ClusterIP, detail.Port, nil
+	case endpointLoadBalancer:
+		if svc.LoadBalancer == "" {
+			return unavailable(fmt.Sprintf("service %s has no load balancer", svc.Name))
+		}
+		return svc.LoadBalancer, detail.Port, nil
+	case endpointNodePort:
+		if svc.NodePort == 0 {
+			return unavailable(fmt.Sprintf("service %s has no node port", svc.Name))
+		}
+		if er.nodePortHost == "" {
+			return unavailable("the broker has no --node-port-host")
+		}
+		return er.nodePortHost, svc.NodePort, nil
+	case endpointRoute:
+		if svc.Route == "" {
+			return unavailable(fmt.Sprintf("service %s has no route", svc.Name))
+		}
+		return svc.Route, routePort, nil
+	default:
+		if svc.ExternalIP != "" {
+			return svc.ExternalIP, detail.Port, nil
+		}
+		return svc.ClusterIP, detail.Port, nil
+	}
+}
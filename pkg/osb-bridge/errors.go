@@ -0,0 +1,94 @@
+package bridge
+
+/*
+Copyright 2018-2021 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"net/http"
+
+	"github.com/crunchydata/pgo-osb/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// Error codes returned in the "error" field of OSB error responses. Codes
+// not defined by the OSB specification are specific to this broker
+const (
+	errCodeBindingsRemain     = "BindingsRemain"
+	errCodeConcurrency        = "ConcurrencyError"
+	errCodeDeletionProtected  = "DeletionProtected"
+	errCodeInvalidParameters  = "InvalidParameters"
+	errCodePlanChange         = "PlanChangeNotSupported"
+	errCodeQuotaExceeded      = "QuotaExceeded"
+	errCodeServiceUnavailable = "ServiceUnavailable"
+)
+
+// osbError translates errors returned by the broker into the
+// osb.HTTPStatusCodeError understood by the REST layer. Errors without a
+// translation are returned unchanged and result in a 500.
+//
+// notFound is the status to use when the instance or binding does not exist,
+// as the OSB spec differs by operation (e.g. 410 Gone for Deprovision)
+func osbError(err error, notFound int) error {
+	if err == broker.ErrBindingsRemain {
+		return httpError(http.StatusUnprocessableEntity, errCodeBindingsRemain, err)
+	}
+
+	switch err.(type) {
+	case broker.ErrNoInstance, broker.ErrNoBinding:
+		return httpError(notFound, "", err)
+	case broker.ErrInstanceExists, broker.ErrConflict:
+		return httpError(http.StatusConflict, "", err)
+	case broker.ErrForbidden:
+		return httpError(http.StatusForbidden, "", err)
+	case broker.ErrInvalidParams:
+		return httpError(http.StatusBadRequest, errCodeInvalidParameters, err)
+	case broker.ErrBackendUnavailable:
+		return httpError(http.StatusServiceUnavailable, errCodeServiceUnavailable, err)
+	case broker.ErrConcurrency:
+		return httpError(http.StatusUnprocessableEntity, errCodeConcurrency, err)
+	case broker.ErrQuotaExceeded:
+		return httpError(http.StatusUnprocessableEntity, errCodeQuotaExceeded, err)
+	case broker.ErrPlanChangeUnsupported:
+		return httpError(http.StatusUnprocessableEntity, errCodePlanChange, err)
+	case broker.ErrDeletionProtected:
+		return httpError(http.StatusUnprocessableEntity, errCodeDeletionProtected, err)
+	case broker.ErrAsyncRequired:
+		return httpError(http.StatusUnprocessableEntity, osb.AsyncErrorMessage, err)
+	}
+
+	return err
+}
+
+// httpError builds an osb.HTTPStatusCodeError with the given error code,
+// using the message of cause as the description
+func httpError(status int, code string, cause error) osb.HTTPStatusCodeError {
+	e := osb.HTTPStatusCodeError{
+		StatusCode:    status,
+		ResponseError: cause,
+	}
+	if code != "" {
+		e.ErrorMessage = strPtr(code)
+	}
+	if cause != nil {
+		e.Description = strPtr(cause.Error())
+	}
+
+	return e
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -16,10 +16,12 @@ limitations under the License.
 */
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"net/url"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/crunchydata/pgo-osb/pkg/broker"
@@ -32,6 +34,10 @@ import (
 // Verify BusinessLogic implements the interface
 var _ osblib.Interface = &BusinessLogic{}
 
+// operationDeprovision is the operation of deprovisions awaiting a final
+// backup
+const operationDeprovision = "deprovision"
+
 // BusinessLogic provides an implementation of the osblib.BusinessLogic
 // interface.
 type BusinessLogic struct {
@@ -47,6 +53,12 @@ type BusinessLogic struct {
 	PGO_PASSWORD          string
 	Broker                broker.Executor
 	kubeAPIClient         *rest.RESTClient
+	naming                namingRules
+	policy                *namespacePolicy
+	plans                 []planDef
+	endpoints             endpointResolver
+	// networkPolicyNamespaces are admitted by the NetworkPolicies of bindings
+	networkPolicyNamespaces []string
 }
 
 // NewBusinessLogic is a hook that is called with the Options the program is run
@@ -67,6 +79,50 @@ func NewBusinessLogic(o Options) (*BusinessLogic, error) {
 		PGO_USERNAME:          o.PGO_USERNAME,
 		PGO_PASSWORD:          o.PGO_PASSWORD,
 		kubeAPIClient:         o.KubeAPIClient,
+		endpoints: endpointResolver{
+			clusterDomain: o.ClusterDomain,
+			nodePortHost:  o.NodePortHost,
+		},
+	}
+
+	if logic.endpoints.clusterDomain == "" {
+		logic.endpoints.clusterDomain = defaultClusterDomain
+	}
+	for _, ns := range strings.Split(o.NetworkPolicyNamespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			logic.networkPolicyNamespaces = append(logic.networkPolicyNamespaces, ns)
+		}
+	}
+
+	plans := planDefs
+	if o.PlanConfig != "" {
+		cfg, err := loadPlanConfig(o.PlanConfig)
+		if err == nil {
+			plans, err = cfg.apply(planDefs)
+		}
+		if err != nil {
+			log.Printf("error loading plan configuration: %s", err)
+			return nil, err
+		}
+	}
+	if err := logic.setPlans(plans); err != nil {
+		return nil, err
+	}
+
+	naming, err := newNamingRules(o)
+	if err != nil {
+		log.Printf("error in naming options: %s", err)
+		return nil, err
+	}
+	logic.naming = naming
+
+	if o.NamespacePolicy != "" {
+		policy, err := loadNamespacePolicy(o.NamespacePolicy)
+		if err != nil {
+			log.Printf("error loading namespace policy: %s", err)
+			return nil, err
+		}
+		logic.policy = policy
 	}
 
 	if o.Simulated {
@@ -80,6 +136,7 @@ func NewBusinessLogic(o Options) (*BusinessLogic, error) {
 
 		r, err := broker.NewPGOperator(
 			logic.kubeAPIClient,
+			o.KubeClientset,
 			logic.PGO_APISERVER_URL,
 			logic.PGO_USERNAME,
 			logic.PGO_PASSWORD,
@@ -91,6 +148,32 @@ func NewBusinessLogic(o Options) (*BusinessLogic, error) {
 		logic.Broker = r
 	}
 
+	if o.RotationInterval > 0 {
+		if o.RotationGrace < 0 || o.RotationGrace >= o.RotationInterval {
+			return nil, fmt.Errorf("rotation grace period %s is not shorter than the rotation interval %s", o.RotationGrace, o.RotationInterval)
+		}
+		rs, ok := logic.Broker.(broker.RotationScheduler)
+		if !ok {
+			return nil, fmt.Errorf("scheduled rotation is not supported by the broker")
+		}
+		rs.SetRotationPolicy(broker.RotationPolicy{Interval: o.RotationInterval, Grace: o.RotationGrace})
+	}
+
+	if o.ClientCASecret != "" {
+		if !strings.Contains(o.ClientCASecret, "/") {
+			return nil, fmt.Errorf("client CA secret %q is not of the form namespace/name", o.ClientCASecret)
+		}
+		ci, ok := logic.Broker.(broker.ClientCertIssuer)
+		if !ok {
+			return nil, fmt.Errorf("client certificates are not supported by the broker")
+		}
+		ci.SetClientCA(o.ClientCASecret)
+	}
+
+	if j, ok := logic.Broker.(broker.Janitor); ok && o.JanitorInterval > 0 {
+		go broker.RunJanitor(context.Background(), j, o.JanitorInterval)
+	}
+
 	return logic, nil
 }
 
@@ -102,26 +185,6 @@ func truePtr() *bool {
 func (b *BusinessLogic) GetCatalog(c *osblib.RequestContext) (*osblib.CatalogResponse, error) {
 	log.Println("GetCatalog called")
 	response := &osblib.CatalogResponse{}
-	paramSchemas := &osb.Schemas{
-		ServiceInstance: &osb.ServiceInstanceSchema{
-			Create: &osb.InputParametersSchema{
-				Parameters: map[string]interface{}{
-					"type":    "object",
-					"$schema": "http://json-schema.org/draft-04/schema#",
-					"properties": map[string]interface{}{
-						"PGO_CLUSTERNAME": map[string]interface{}{
-							"type":    "string",
-							"default": "Clear",
-						},
-						"PGO_NAMESPACE": map[string]interface{}{
-							"type":    "string",
-							"default": "Clear",
-						},
-					},
-				},
-			},
-		},
-	}
 
 	osbResponse := &osb.CatalogResponse{
 		Services: []osb.Service{
@@ -134,57 +197,7 @@ func (b *BusinessLogic) GetCatalog(c *osblib.RequestContext) (*osblib.CatalogRes
 					"displayName": "pgo osb service",
 					"imageUrl":    "https://avatars2.githubusercontent.com/u/19862012?s=200&v=4",
 				},
-				Plans: []osb.Plan{
-					{
-						Name:        "default",
-						ID:          "86064792-7ea2-467b-af93-ac9694d96d5c",
-						Description: "The default plan for the pgo osb service",
-						Free:        truePtr(),
-						Schemas:     paramSchemas,
-					},
-					{
-						Name:        "standalone_sm",
-						ID:          "885a1cb6-ca42-43e9-a725-8195918e1343",
-						Description: "Small postgres server, no replicas",
-						Free:        truePtr(),
-						Schemas:     paramSchemas,
-					},
-					{
-						Name:        "standalone_md",
-						ID:          "dc951396-bb28-45a4-b040-cfe3bebc6121",
-						Description: "Medium postgres server, no replicas",
-						Free:        truePtr(),
-						Schemas:     paramSchemas,
-					},
-					{
-						Name:        "standalone_lg",
-						ID:          "04349656-4dc9-4b67-9b15-52a93d64d566",
-						Description: "Large postgres server, no replicas",
-						Free:        truePtr(),
-						Schemas:     paramSchemas,
-					},
-					{
-						Name:        "ha_sm",
-						ID:          "877432f8-07eb-4e57-b984-d025a71d2282",
-						Description: "Small postgres server with replicas",
-						Free:        truePtr(),
-						Schemas:     paramSchemas,
-					},
-					{
-						Name:        "ha_md",
-						ID:          "89bcdf8a-e637-4bb3-b7ce-aca083cc1e69",
-						Description: "Medium postgres server with replicas",
-						Free:        truePtr(),
-						Schemas:     paramSchemas,
-					},
-					{
-						Name:        "ha_lg",
-						ID:          "470ca1a0-2763-41f1-a4cf-985acdb549ab",
-						Description: "Large postgres server with replicas",
-						Free:        truePtr(),
-						Schemas:     paramSchemas,
-					},
-				},
+				Plans: b.catalogPlans(),
 			},
 		},
 	}
@@ -213,30 +226,89 @@ func (b *BusinessLogic) Provision(request *osb.ProvisionRequest, c *osblib.Reque
 
 	// Since handling request.Parameters is being delegated to the
 	// encapsulating type, direct access beyond here should raise suspicion
-	rp := NewProvReqParams(request.Parameters)
-	if rp.ClusterName == "" {
-		return nil, fmt.Errorf("Missing required parameter: PGO_CLUSTERNAME")
+	t := newTenant(request.Context, request.OrganizationGUID, request.SpaceGUID, request.OriginatingIdentity, c)
+	plan := b.findPlan(request.PlanID)
+	rp, err := NewProvReqParams(plan, b.provisionSchema(plan), request.Parameters)
+	if err == nil && !b.async {
+		err = rp.synchronous(request.Parameters)
+	}
+	if err == nil {
+		err = b.naming.apply(rp, request.InstanceID, request.Context, b.policy.defaultNamespace(t))
+	}
+	if err != nil {
+		log.Printf("invalid Provision parameters: %s\n", err)
+		return nil, osbError(err, http.StatusNotFound)
 	}
-	if rp.Namespace == "" {
-		return nil, fmt.Errorf("Missing required parameter: PGO_NAMESPACE")
+	if err := b.policy.allow(t, rp.Namespace); err != nil {
+		log.Printf("Provision rejected by namespace policy: %s\n", err)
+		return nil, osbError(err, http.StatusNotFound)
+	}
+	if rp.RestoreFrom != "" {
+		if err := b.checkSourceInstance(t, paramRestoreFrom, rp.RestoreFrom); err != nil {
+			log.Printf("Provision rejected restore source: %s\n", err)
+			return nil, osbError(err, http.StatusNotFound)
+		}
+	}
+	if rp.StandbyOf != "" {
+		if err := b.checkSourceInstance(t, paramStandbyOf, rp.StandbyOf); err != nil {
+			log.Printf("Provision rejected standby source: %s\n", err)
+			return nil, osbError(err, http.StatusNotFound)
+		}
 	}
 
 	log.Println("provision PGO_CLUSTERNAME=" + rp.ClusterName)
 	log.Println("provision PGO_NAMESPACE=" + rp.Namespace)
 
-	err := b.Broker.CreateCluster(broker.CreateRequest{
+	err = b.Broker.CreateCluster(broker.CreateRequest{
 		InstanceID: request.InstanceID,
 		Name:       rp.ClusterName,
 		Namespace:  rp.Namespace,
 		PlanID:     request.PlanID,
+
+		StorageSize:   rp.StorageSize,
+		StorageConfig: rp.StorageConfig,
+		ImageTag:      rp.ImageTag,
+		PgBouncer:     rp.PgBouncer,
+		TLSSecret:     rp.TLSSecret,
+		CASecret:      rp.CASecret,
+		TLSOnly:       rp.TLSOnly,
+		CustomConfig:  rp.CustomConfig,
+		Labels:        rp.Labels,
+		RestoreFrom:   rp.RestoreFrom,
+		RestoreTarget: rp.RestoreTarget,
+		StandbyOf:     rp.StandbyOf,
+		Retention:     rp.Retention,
+
+		DeletionProtection:   rp.Protection,
+		RestrictPublicSchema: rp.RestrictPublic,
 	})
+	if ie, ok := err.(broker.ErrInstanceExists); ok && ie.Identical {
+		// Repeated requests succeed without creating anything
+		return &osblib.ProvisionResponse{Exists: true}, nil
+	}
 	if err != nil {
 		log.Printf("error during Provision: %s", err)
-		return nil, err
+		return nil, osbError(err, http.StatusNotFound)
 	}
 	return &response, nil
 }
 
+// checkSourceInstance ensures the instance named by param, whose data is to
+// be copied, exists and that the tenant is permitted to use its namespace,
+// and therefore read its data
+func (b *BusinessLogic) checkSourceInstance(t tenant, param, instanceID string) error {
+	detail, err := b.Broker.ClusterDetail(instanceID)
+	if _, ok := err.(broker.ErrNoInstance); ok {
+		return broker.ErrInvalidParams{Violations: []string{
+			fmt.Sprintf("%s: instance %s does not exist", param, instanceID),
+		}}
+	} else if err != nil {
+		return err
+	}
+
+	return b.policy.allow(t, detail.Namespace)
+}
+
 func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *osblib.RequestContext) (*osblib.DeprovisionResponse, error) {
 	log.Printf("Deprovision called request=%#v", request)
 	log.Printf("Deprovision called broker request context=%#v", c)
@@ -247,27 +319,59 @@ func (b *BusinessLogic) Deprovision(request *osb.DeprovisionRequest, c *osblib.R
 	response := &osblib.DeprovisionResponse{}
 
 	log.Printf("Deprovision instanceID=%s\n", request.InstanceID)
-	err := b.Broker.DeleteCluster(request.InstanceID)
+	err := b.Broker.DeleteCluster(broker.DeleteRequest{
+		InstanceID:        request.InstanceID,
+		AcceptsIncomplete: request.AcceptsIncomplete && b.async,
+	})
 	if err != nil {
-		if _, ok := err.(broker.ErrNoInstance); ok {
-			log.Printf("Cannot find instance %s: suppressing error until HTTP 410 (Gone) can be provided", request.InstanceID)
-			return response, nil
-		} else {
-			log.Printf("error deleting cluster: %s\n", err)
-			return nil, err
-		}
+		log.Printf("error deleting cluster: %s\n", err)
+		return nil, osbError(err, http.StatusGone)
 	}
 
 	if request.AcceptsIncomplete {
 		response.Async = b.async
 	}
+	// Clusters awaiting a final backup are deleted later by the janitor,
+	// which LastOperation reports the progress of
+	if detail, err := b.Broker.ClusterDetail(request.InstanceID); err == nil && detail.Deprovisioning {
+		response.Async = true
+		key := osb.OperationKey(operationDeprovision)
+		response.OperationKey = &key
+	}
 
 	return response, nil
 }
 
 func (b *BusinessLogic) LastOperation(request *osb.LastOperationRequest, c *osblib.RequestContext) (*osblib.LastOperationResponse, error) {
-	log.Println("LastOperation called")
-	return nil, nil
+	log.Printf("LastOperation called instanceID=%s\n", request.InstanceID)
+
+	// Clusters exist from the moment they are provisioned, so a missing
+	// cluster means a deprovision has completed
+	detail, err := b.Broker.ClusterDetail(request.InstanceID)
+	if err != nil {
+		log.Printf("error getting cluster info: %s\n", err)
+		return nil, osbError(err, http.StatusGone)
+	}
+
+	response := &osblib.LastOperationResponse{}
+	var desc string
+	switch {
+	case detail.Deprovisioning:
+		response.State = osb.StateInProgress
+		desc = fmt.Sprintf("cluster %s is being deleted after a final backup", detail.ClusterName)
+	case !detail.Ready:
+		response.State = osb.StateInProgress
+		desc = fmt.Sprintf("cluster %s is being initialized", detail.ClusterName)
+	case detail.StandbyOf != "":
+		response.State = osb.StateSucceeded
+		desc = fmt.Sprintf("cluster %s is a standby of instance %s", detail.ClusterName, detail.StandbyOf)
+	default:
+		response.State = osb.StateSucceeded
+		desc = fmt.Sprintf("cluster %s is ready", detail.ClusterName)
+	}
+	response.Description = &desc
+
+	return response, nil
 }
 
 func (b *BusinessLogic) Bind(request *osb.BindRequest, c *osblib.RequestContext) (*osblib.BindResponse, error) {
@@ -275,48 +379,128 @@ func (b *BusinessLogic) Bind(request *osb.BindRequest, c *osblib.RequestContext)
 	log.Printf("Bind called request instanceID=%s\n", request.InstanceID)
 	log.Printf("Bind called broker ctx=%#v\n", c)
 
+	plan := b.findPlan(request.PlanID)
+	param, err := NewBindReqParams(plan, b.bindSchema(plan), request.Parameters)
+	if err != nil {
+		log.Printf("invalid Bind parameters: %s\n", err)
+		return nil, osbError(err, http.StatusNotFound)
+	}
+
 	clusterDetail, err := b.Broker.ClusterDetail(request.InstanceID)
 	if err != nil {
 		log.Printf("error getting cluster info: %s\n", err)
-		return nil, err
+		return nil, osbError(err, http.StatusNotFound)
+	}
+	if param.Predecessor != "" {
+		// The bind requests of the OSB client in use have no
+		// predecessor_binding_id, so it is taken from the parameters
+		pred, err := b.findBinding(request.InstanceID, param.Predecessor)
+		if err == nil {
+			err = param.inherit(pred, request.Parameters)
+		}
+		if err != nil {
+			log.Printf("invalid Bind predecessor: %s\n", err)
+			return nil, osbError(err, http.StatusNotFound)
+		}
+	}
+	if clusterDetail.StandbyOf != "" {
+		if err := param.standby(request.Parameters); err != nil {
+			log.Printf("invalid Bind parameters for standby: %s\n", err)
+			return nil, osbError(err, http.StatusNotFound)
+		}
+	}
+	// Resolved ahead of creating the binding, which is pointless when the
+	// instance cannot be reached the requested way
+	svc := clusterDetail.Primary
+	if param.PgBouncer {
+		if clusterDetail.PgBouncer.Name == "" {
+			err := broker.ErrInvalidParams{Violations: []string{paramPgBouncerBind + ": the instance has no pgBouncer"}}
+			return nil, osbError(err, http.StatusNotFound)
+		}
+		svc = clusterDetail.PgBouncer
+	}
+	host, port, err := b.endpoints.resolve(clusterDetail, svc, param.Endpoint)
+	if err != nil {
+		log.Printf("error resolving endpoint: %s\n", err)
+		return nil, osbError(err, http.StatusNotFound)
+	}
+	replicaHost, replicaPort := "", 0
+	if clusterDetail.Replica.Name != "" {
+		// Replicas are not necessarily exposed like the primary
+		replicaHost, replicaPort, _ = b.endpoints.resolve(clusterDetail, clusterDetail.Replica, param.Endpoint)
+	}
+	appNamespace := ""
+	if param.NetworkPolicy {
+		if appNamespace = contextString(request.Context, "namespace"); appNamespace == "" {
+			err := broker.ErrInvalidParams{Violations: []string{paramNetworkPolicy + ": the request context has no namespace"}}
+			return nil, osbError(err, http.StatusNotFound)
+		}
 	}
 
 	appID := ""
 	if request.AppGUID != nil {
 		appID = *request.AppGUID
 	}
-	bindCreds, err := b.Broker.CreateBinding(request.InstanceID, request.BindingID, appID)
+	bindCreds, err := b.Broker.CreateBinding(broker.BindRequest{
+		InstanceID:   request.InstanceID,
+		BindingID:    request.BindingID,
+		AppID:        appID,
+		Access:       param.Access,
+		Isolation:    param.Isolation,
+		KeepOnUnbind: param.KeepOnUnbind,
+		PgBouncer:    param.PgBouncer,
+
+		AppNamespace:    appNamespace,
+		AllowNamespaces: b.networkPolicyNamespaces,
+
+		Lifetime:       param.Lifetime,
+		PredecessorID:  param.Predecessor,
+		PasswordPolicy: plan.PasswordPolicy,
+		ClientCert:     param.ClientCert,
+
+		Type:        param.Type,
+		Publication: param.Publication,
+		Slot:        param.Slot,
+		Limits:      param.Limits,
+	})
 	if err != nil {
 		log.Printf("error getting binding info: %s\n", err)
-		return nil, err
+		return nil, osbError(err, http.StatusNotFound)
 	}
 
 	if os.Getenv("CRUNCHY_DEBUG") == "true" {
 		log.Printf("credentials: %#v\n", bindCreds)
 	}
 
-	port := 5432
-	dbName := clusterDetail.Database
-	host := clusterDetail.ExternalIP
-	if host == "" {
-		host = clusterDetail.ClusterIP
+	ci := connInfo{
+		Host:         host,
+		InternalHost: svc.ClusterIP,
+		ReplicaHost:  replicaHost,
+		ReplicaPort:  replicaPort,
+		Port:         port,
+		Database:     clusterDetail.Database,
+		Schema:       bindCreds.Schema,
+		Username:     bindCreds.Username,
+		Password:     bindCreds.Password,
+		// Standbys only serve reads until promoted, readonly roles never write
+		ReadOnly:  clusterDetail.StandbyOf != "" || param.Access == broker.AccessReadOnly,
+		TLS:       clusterDetail.TLS,
+		CACert:    clusterDetail.CACert,
+		ExpiresAt: bindCreds.ExpiresAt,
+
+		ClientCert: bindCreds.ClientCert,
+		ClientKey:  bindCreds.ClientKey,
+		ClientCA:   bindCreds.ClientCA,
+
+		Limits:    param.Limits,
+		Endpoints: param.IncludeEndpoints,
+	}
+	if bindCreds.Database != "" {
+		ci.Database = bindCreds.Database
 	}
 	response := osblib.BindResponse{
 		BindResponse: osb.BindResponse{
-			Credentials: map[string]interface{}{
-				"username":      bindCreds.Username,
-				"password":      bindCreds.Password,
-				"db_port":       port,
-				"db_name":       dbName,
-				"db_host":       host,
-				"internal_host": clusterDetail.ClusterIP,
-				"uri": (&url.URL{
-					Scheme: "postgresql",
-					Host:   fmt.Sprintf("%s:%d", host, port),
-					User:   url.UserPassword(bindCreds.Username, bindCreds.Password),
-					Path:   dbName,
-				}).String(),
-			},
+			Credentials: ci.credentials(param.CredentialsFormat),
 		},
 	}
 
@@ -331,19 +515,70 @@ func (b *BusinessLogic) Bind(request *osb.BindRequest, c *osblib.RequestContext)
 	return &response, nil
 }
 
+// findBinding looks up the record of a binding of an instance
+func (b *BusinessLogic) findBinding(instanceID, bindID string) (broker.BindingRecord, error) {
+	recs, err := b.Broker.ListBindings(instanceID)
+	if err != nil {
+		return broker.BindingRecord{}, err
+	}
+	for _, rec := range recs {
+		if rec.BindingID == bindID {
+			return rec, nil
+		}
+	}
+
+	return broker.BindingRecord{}, broker.ErrInvalidParams{Violations: []string{
+		fmt.Sprintf("%s: binding %s does not exist", paramPredecessor, bindID),
+	}}
+}
+
 func (b *BusinessLogic) Unbind(request *osb.UnbindRequest, c *osblib.RequestContext) (*osblib.UnbindResponse, error) {
 	log.Printf("Unbind called req=%#v\n", request)
 	err := b.Broker.DeleteBinding(request.InstanceID, request.BindingID)
-
 	if err != nil {
+		// Failures other than a missing binding result in a 500, which
+		// platforms treat as a failed unbind to be retried rather than a
+		// revoked credential
 		log.Printf("error during unbind: %s\n", err)
+		return nil, osbError(err, http.StatusGone)
 	}
 
 	return &osblib.UnbindResponse{}, nil
 }
 
 func (b *BusinessLogic) Update(request *osb.UpdateInstanceRequest, c *osblib.RequestContext) (*osblib.UpdateInstanceResponse, error) {
-	log.Println("Update called")
+	log.Printf("Update called req=%#v\n", request)
+
+	b.Lock()
+	defer b.Unlock()
+
+	planID := ""
+	if request.PlanID != nil {
+		planID = *request.PlanID
+	}
+	if err := validateParams(b.updateSchema(b.findPlan(planID)), request.Parameters); err != nil {
+		log.Printf("invalid Update parameters: %s\n", err)
+		return nil, osbError(err, http.StatusNotFound)
+	}
+
+	promote, _ := request.Parameters[paramPromote].(bool)
+	ureq := broker.UpdateRequest{
+		InstanceID: request.InstanceID,
+		PlanID:     planID,
+		Promote:    promote,
+	}
+	if p, ok := request.Parameters[paramProtection].(bool); ok {
+		ureq.DeletionProtection = &p
+	}
+	if request.PreviousValues != nil {
+		ureq.PreviousPlanID = request.PreviousValues.PlanID
+	}
+	err := b.Broker.UpdateCluster(ureq)
+	if err != nil {
+		log.Printf("error during Update: %s\n", err)
+		return nil, osbError(err, http.StatusNotFound)
+	}
+
 	response := osblib.UpdateInstanceResponse{}
 	if request.AcceptsIncomplete {
 		response.Async = b.async
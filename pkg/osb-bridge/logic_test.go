@@ -17,12 +17,20 @@ limitations under the License.
 
 import (
 	"crypto/md5"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/crunchydata/pgo-osb/pkg/broker"
 
@@ -49,6 +57,30 @@ func nuuid(t *testing.T) string {
 	return id.String()
 }
 
+// provisionInstance provisions the cluster name in unitnamespace with the
+// plan planID and any further params, failing the test if it cannot
+func provisionInstance(t *testing.T, bl *BusinessLogic, planID, name string, params map[string]interface{}) *osb.ProvisionRequest {
+	t.Helper()
+
+	preq := &osb.ProvisionRequest{
+		InstanceID: nuuid(t),
+		PlanID:     planID,
+		ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+		Parameters: map[string]interface{}{
+			"PGO_NAMESPACE":   "unitnamespace",
+			"PGO_CLUSTERNAME": name,
+		},
+	}
+	for k, v := range params {
+		preq.Parameters[k] = v
+	}
+	if _, err := bl.Provision(preq, nil); err != nil {
+		t.Fatalf("error provisioning: %s", err)
+	}
+
+	return preq
+}
+
 func TestUnitCatalog(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 
@@ -237,8 +269,12 @@ func TestUnitBindingNoInstance(t *testing.T) {
 	if err == nil {
 		t.Fatal("NoInstance error expected, got nil")
 	}
-	if _, ok := err.(broker.ErrNoInstance); !ok {
-		t.Fatalf("NoInstance error expected, got: %T - %s", err, err)
+	e, ok := osb.IsHTTPError(err)
+	if !ok || e.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected HTTP 404 for unknown instance, got: %T - %s", err, err)
+	}
+	if _, ok := e.ResponseError.(broker.ErrNoInstance); !ok {
+		t.Fatalf("NoInstance error expected, got: %T - %s", e.ResponseError, e.ResponseError)
 	}
 }
 
@@ -277,18 +313,22 @@ func TestUnitBindingBasic(t *testing.T) {
 	h := md5.New()
 	io.WriteString(h, breq.BindingID)
 	expUser := fmt.Sprintf("user_%x", h.Sum(nil))
+	// Passwords are generated following the password policy of the plan
+	password, _ := bindResp.Credentials["password"].(string)
+	if len(password) != standardPasswordPolicy.Length {
+		t.Fatalf("expected a %d character password, got %q", standardPasswordPolicy.Length, password)
+	}
 	expect := &osblib.BindResponse{
 		BindResponse: osb.BindResponse{
 			Credentials: map[string]interface{}{
 				"username":      expUser,
-				"password":      broker.MockStatic.Password,
+				"password":      password,
 				"db_port":       5432,
 				"db_name":       "userdb",
 				"db_host":       broker.MockStatic.ExternalIP,
 				"internal_host": broker.MockStatic.ClusterIP,
-				"uri": fmt.Sprintf("postgresql://%s:%s@%s:%d/%s",
-					expUser,
-					broker.MockStatic.Password,
+				"uri": fmt.Sprintf("postgresql://%s@%s:%d/%s",
+					url.UserPassword(expUser, password),
 					broker.MockStatic.ExternalIP,
 					5432,
 					"userdb"),
@@ -302,3 +342,1980 @@ func TestUnitBindingBasic(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestUnitUnbindBasic(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", nil)
+
+	breq := &osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+	}
+	_, err := bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+
+	ureq := &osb.UnbindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  breq.BindingID,
+	}
+	_, err = bl.Unbind(ureq, nil)
+	if err != nil {
+		t.Fatalf("error unbinding: %s", err)
+	}
+
+	// A repeated unbind must report the binding as gone
+	_, err = bl.Unbind(ureq, nil)
+	if !osb.IsGoneError(err) {
+		t.Fatalf("expected HTTP 410 Gone on repeated unbind, got: %v", err)
+	}
+}
+
+func TestUnitUnbindNoInstance(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	ureq := &osb.UnbindRequest{
+		InstanceID: nuuid(t),
+		BindingID:  nuuid(t),
+	}
+	_, err := bl.Unbind(ureq, nil)
+	if !osb.IsGoneError(err) {
+		t.Fatalf("expected HTTP 410 Gone for unknown instance, got: %v", err)
+	}
+}
+
+// httpStatus returns the status code of an osb.HTTPStatusCodeError, or zero
+// for any other error
+func httpStatus(err error) int {
+	if e, ok := osb.IsHTTPError(err); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+func TestUnitProvisionConflict(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	req := &osb.ProvisionRequest{
+		InstanceID: nuuid(t),
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+		ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+		Parameters: map[string]interface{}{
+			"PGO_NAMESPACE":   "demo",
+			"PGO_CLUSTERNAME": "unitinstance",
+		},
+	}
+
+	_, err := bl.Provision(req, nil)
+	if err != nil {
+		t.Fatalf("error provisioning: %s", err)
+	}
+
+	resp, err := bl.Provision(req, nil)
+	if err != nil {
+		t.Fatalf("error repeating identical provision: %s", err)
+	}
+	if !resp.Exists {
+		t.Fatalf("expected identical provision to report an existing instance")
+	}
+
+	req.Parameters["deletion_protection"] = true
+	_, err = bl.Provision(req, nil)
+	if s := httpStatus(err); s != http.StatusConflict {
+		t.Fatalf("expected HTTP 409 on provision with different parameters, got: %v", err)
+	}
+
+	delete(req.Parameters, "deletion_protection")
+	req.PlanID = "885a1cb6-ca42-43e9-a725-8195918e1343"
+	_, err = bl.Provision(req, nil)
+	if s := httpStatus(err); s != http.StatusConflict {
+		t.Fatalf("expected HTTP 409 on provision with a different plan, got: %v", err)
+	}
+}
+
+func TestUnitDeprovisionGone(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	dreq := &osb.DeprovisionRequest{
+		InstanceID: nuuid(t),
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+		ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+	}
+	_, err := bl.Deprovision(dreq, nil)
+	if !osb.IsGoneError(err) {
+		t.Fatalf("expected HTTP 410 Gone for unknown instance, got: %v", err)
+	}
+}
+
+func TestUnitDeprovisionBindingsRemain(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", nil)
+
+	_, err := bl.Bind(&osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+	}, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+
+	dreq := &osb.DeprovisionRequest{
+		InstanceID: preq.InstanceID,
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+		ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+	}
+	_, err = bl.Deprovision(dreq, nil)
+	e, ok := osb.IsHTTPError(err)
+	if !ok || e.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected HTTP 422 while bindings remain, got: %v", err)
+	}
+	if e.ErrorMessage == nil || *e.ErrorMessage != "BindingsRemain" {
+		t.Errorf("expected BindingsRemain error code, got: %v", e.ErrorMessage)
+	}
+}
+
+func TestUnitErrorTranslation(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{broker.ErrNoInstance{ID: "a"}, http.StatusGone, ""},
+		{broker.ErrNoBinding{InstanceID: "a", BindID: "b"}, http.StatusGone, ""},
+		{broker.ErrInstanceExists{ID: "a"}, http.StatusConflict, ""},
+		{broker.ErrConflict{Reason: "name taken"}, http.StatusConflict, ""},
+		{broker.ErrInvalidParams{Violations: []string{"x"}}, http.StatusBadRequest, "InvalidParameters"},
+		{broker.ErrBackendUnavailable{Err: fmt.Errorf("refused")}, http.StatusServiceUnavailable, "ServiceUnavailable"},
+		{broker.ErrConcurrency{ID: "a"}, http.StatusUnprocessableEntity, "ConcurrencyError"},
+		{broker.ErrQuotaExceeded{Reason: "full"}, http.StatusUnprocessableEntity, "QuotaExceeded"},
+		{broker.ErrPlanChangeUnsupported{From: "a", To: "b"}, http.StatusUnprocessableEntity, "PlanChangeNotSupported"},
+		{broker.ErrBindingsRemain, http.StatusUnprocessableEntity, "BindingsRemain"},
+	}
+
+	for _, c := range cases {
+		e, ok := osb.IsHTTPError(osbError(c.err, http.StatusGone))
+		if !ok {
+			t.Errorf("%T: expected HTTP error", c.err)
+			continue
+		}
+		if e.StatusCode != c.status {
+			t.Errorf("%T: expected status %d, got %d", c.err, c.status, e.StatusCode)
+		}
+		if c.code == "" && e.ErrorMessage != nil {
+			t.Errorf("%T: expected no error code, got %s", c.err, *e.ErrorMessage)
+		} else if c.code != "" && (e.ErrorMessage == nil || *e.ErrorMessage != c.code) {
+			t.Errorf("%T: expected error code %s, got %v", c.err, c.code, e.ErrorMessage)
+		}
+		if e.Description == nil || *e.Description != c.err.Error() {
+			t.Errorf("%T: expected description from error, got %v", c.err, e.Description)
+		}
+	}
+
+	if err := fmt.Errorf("unexpected"); osbError(err, http.StatusGone) != err {
+		t.Error("expected untranslated errors to be returned unchanged")
+	}
+}
+
+func TestUnitBindingConcurrency(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", nil)
+
+	bl.Broker.(*broker.Mock).SetBusy(preq.InstanceID, true)
+	_, err := bl.Bind(&osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+	}, nil)
+	if s := httpStatus(err); s != http.StatusUnprocessableEntity {
+		t.Fatalf("expected HTTP 422 while instance busy, got: %v", err)
+	}
+}
+
+func TestUnitProvisionQuota(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	bl.Broker.(*broker.Mock).InstanceLimit = 1
+	for i := 0; i < 2; i++ {
+		_, err := bl.Provision(&osb.ProvisionRequest{
+			InstanceID: nuuid(t),
+			PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+			ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+			Parameters: map[string]interface{}{
+				"PGO_NAMESPACE":   "demo",
+				"PGO_CLUSTERNAME": fmt.Sprintf("unitinstance%d", i),
+			},
+		}, nil)
+		if i == 0 && err != nil {
+			t.Fatalf("error provisioning: %s", err)
+		} else if i == 1 && httpStatus(err) != http.StatusUnprocessableEntity {
+			t.Fatalf("expected HTTP 422 beyond instance limit, got: %v", err)
+		}
+	}
+}
+
+func TestUnitUpdatePlanChange(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "885a1cb6-ca42-43e9-a725-8195918e1343", "unitinstance", nil)
+
+	samePlan := preq.PlanID
+	_, err := bl.Update(&osb.UpdateInstanceRequest{
+		InstanceID: preq.InstanceID,
+		ServiceID:  preq.ServiceID,
+		PlanID:     &samePlan,
+	}, nil)
+	if err != nil {
+		t.Fatalf("error updating without plan change: %s", err)
+	}
+
+	otherPlan := "470ca1a0-2763-41f1-a4cf-985acdb549ab"
+	_, err = bl.Update(&osb.UpdateInstanceRequest{
+		InstanceID: preq.InstanceID,
+		ServiceID:  preq.ServiceID,
+		PlanID:     &otherPlan,
+	}, nil)
+	if s := httpStatus(err); s != http.StatusUnprocessableEntity {
+		t.Fatalf("expected HTTP 422 on plan change, got: %v", err)
+	}
+}
+
+func TestUnitProvisionInvalidParams(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	req := &osb.ProvisionRequest{
+		InstanceID: nuuid(t),
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+		ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+		Parameters: map[string]interface{}{
+			"PGO_NAMESPACE":          42.0,
+			"PGO_CLUSTERNAME":        "Not_A_DNS_Name",
+			"PGO_UNKNOWN":            "x",
+			"restrict_public_schema": "yes",
+		},
+	}
+
+	_, err := bl.Provision(req, nil)
+	e, ok := osb.IsHTTPError(err)
+	if !ok || e.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for invalid parameters, got: %v", err)
+	}
+	ip, ok := e.ResponseError.(broker.ErrInvalidParams)
+	if !ok {
+		t.Fatalf("expected ErrInvalidParams, got: %T", e.ResponseError)
+	}
+	if l := len(ip.Violations); l != 4 {
+		t.Errorf("expected four violations, got %d: %v", l, ip.Violations)
+	}
+}
+
+func TestUnitBindInvalidParams(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	_, err := bl.Bind(&osb.BindRequest{
+		InstanceID: nuuid(t),
+		BindingID:  nuuid(t),
+		Parameters: map[string]interface{}{
+			"unexpected": true,
+		},
+	}, nil)
+	if s := httpStatus(err); s != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for unknown bind parameter, got: %v", err)
+	}
+}
+
+func TestUnitSchemaValidation(t *testing.T) {
+	schema := objectSchema(map[string]interface{}{
+		"name": map[string]interface{}{
+			"type":      "string",
+			"pattern":   "^[a-z]+$",
+			"maxLength": 5,
+		},
+		"count": map[string]interface{}{
+			"type":    "integer",
+			"minimum": 1,
+			"maximum": 3,
+		},
+		"mode": map[string]interface{}{
+			"type": "string",
+			"enum": []interface{}{"a", "b"},
+		},
+		"tags": map[string]interface{}{
+			"type":  "array",
+			"items": map[string]interface{}{"type": "string"},
+		},
+	}, "name")
+
+	cases := []struct {
+		params     map[string]interface{}
+		violations int
+	}{
+		{map[string]interface{}{"name": "abc"}, 0},
+		{map[string]interface{}{"name": "abc", "count": 2.0, "mode": "b", "tags": []interface{}{"x"}}, 0},
+		{map[string]interface{}{}, 1},
+		{map[string]interface{}{"name": "abcdef"}, 1},
+		{map[string]interface{}{"name": "ABC"}, 1},
+		{map[string]interface{}{"name": "abc", "count": 1.5}, 1},
+		{map[string]interface{}{"name": "abc", "count": 4.0}, 1},
+		{map[string]interface{}{"name": "abc", "mode": "c"}, 1},
+		{map[string]interface{}{"name": "abc", "tags": []interface{}{"x", 1.0}}, 1},
+		{map[string]interface{}{"name": true, "other": 1.0}, 2},
+	}
+
+	for i, c := range cases {
+		if v := validateSchema(schema, c.params); len(v) != c.violations {
+			t.Errorf("case %d: expected %d violations, got %d: %v", i, c.violations, len(v), v)
+		}
+	}
+}
+
+func TestUnitProvisionDerivedNames(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl, err := NewBusinessLogic(Options{
+		Simulated:       true,
+		NamespaceFrom:   "context",
+		ClusterNameFrom: "instance-name",
+	})
+	if err != nil {
+		t.Fatalf("error creating BusinessLogic: %s", err)
+	}
+
+	req := &osb.ProvisionRequest{
+		InstanceID: nuuid(t),
+		PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+		ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+		Context: map[string]interface{}{
+			"platform":      "kubernetes",
+			"namespace":     "team-a",
+			"instance_name": "Orders_DB",
+		},
+	}
+	_, err = bl.Provision(req, nil)
+	if err != nil {
+		t.Fatalf("error provisioning: %s", err)
+	}
+
+	detail, err := bl.Broker.ClusterDetail(req.InstanceID)
+	if err != nil {
+		t.Fatalf("error getting cluster detail: %s", err)
+	}
+	if detail.Namespace != "team-a" {
+		t.Errorf("expected namespace from context, got %q", detail.Namespace)
+	}
+	if detail.ClusterName != "orders-db" {
+		t.Errorf("expected cluster name derived from instance name, got %q", detail.ClusterName)
+	}
+
+	// Same instance name in the same namespace collides before creation
+	req.InstanceID = nuuid(t)
+	_, err = bl.Provision(req, nil)
+	if s := httpStatus(err); s != http.StatusConflict {
+		t.Fatalf("expected HTTP 409 on cluster name collision, got: %v", err)
+	}
+
+	// Without a namespace in the context, nothing can be derived
+	req.InstanceID = nuuid(t)
+	req.Context = nil
+	_, err = bl.Provision(req, nil)
+	if s := httpStatus(err); s != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 without context namespace, got: %v", err)
+	}
+}
+
+func TestUnitDNSSafeName(t *testing.T) {
+	cases := map[string]string{
+		"orders":    "orders",
+		"Orders_DB": "orders-db",
+		"--a..b--":  "a-b",
+		"9lives":    "osb-9lives",
+		"":          "osb",
+		"osb-a7cb6bd8-cf67-400f-805c-019e85eac3bf":         "osb-a7cb6bd8-cf67-400f-805c-019e85eac3bf",
+		"a-very-long-instance-name-that-exceeds-the-limit": "a-very-long-instance-name-that-exceeds-the",
+	}
+
+	for in, expect := range cases {
+		if out := dnsSafeName(in); out != expect {
+			t.Errorf("dnsSafeName(%q): expected %q, got %q", in, expect, out)
+		}
+	}
+}
+
+func TestUnitProvisionNamespacePolicy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl, err := NewBusinessLogic(Options{
+		Simulated:     true,
+		NamespaceFrom: "policy",
+	})
+	if err != nil {
+		t.Fatalf("error creating BusinessLogic: %s", err)
+	}
+	bl.policy = &namespacePolicy{
+		Rules: []policyRule{
+			{
+				Match:      policyMatch{Platform: "kubernetes", Namespace: "team-a"},
+				Namespaces: []string{"pgo-team-a"},
+			},
+			{
+				Match:      policyMatch{Platform: "cloudfoundry", SpaceGUID: "space-1"},
+				Namespaces: []string{"pgo-cf", "pgo-cf-2"},
+			},
+			{
+				Match:      policyMatch{Group: "dba"},
+				Namespaces: []string{"*"},
+			},
+		},
+	}
+
+	cases := []struct {
+		context   map[string]interface{}
+		identity  *osb.OriginatingIdentity
+		namespace string
+		status    int
+	}{
+		// Namespace assigned by the policy
+		{map[string]interface{}{"platform": "kubernetes", "namespace": "team-a"}, nil, "", 0},
+		{map[string]interface{}{"platform": "kubernetes", "namespace": "team-a"}, nil, "pgo-team-a", 0},
+		{map[string]interface{}{"platform": "kubernetes", "namespace": "team-a"}, nil, "pgo-team-b", http.StatusForbidden},
+		// Several namespaces permitted, one must be chosen
+		{map[string]interface{}{"platform": "cloudfoundry", "space_guid": "space-1"}, nil, "pgo-cf-2", 0},
+		{map[string]interface{}{"platform": "cloudfoundry", "space_guid": "space-1"}, nil, "", http.StatusBadRequest},
+		{map[string]interface{}{"platform": "cloudfoundry", "space_guid": "space-2"}, nil, "pgo-cf", http.StatusForbidden},
+		// Matched by originating identity
+		{
+			map[string]interface{}{"platform": "kubernetes", "namespace": "ops"},
+			&osb.OriginatingIdentity{Platform: "kubernetes", Value: `{"username": "jo", "groups": ["dba"]}`},
+			"anywhere", 0,
+		},
+		// No rule matches
+		{map[string]interface{}{"platform": "kubernetes", "namespace": "team-c"}, nil, "pgo-team-a", http.StatusForbidden},
+	}
+
+	for i, c := range cases {
+		params := map[string]interface{}{
+			"PGO_CLUSTERNAME": fmt.Sprintf("policy%d", i),
+		}
+		if c.namespace != "" {
+			params["PGO_NAMESPACE"] = c.namespace
+		}
+		_, err := bl.Provision(&osb.ProvisionRequest{
+			InstanceID:          nuuid(t),
+			PlanID:              "86064792-7ea2-467b-af93-ac9694d96d5c",
+			ServiceID:           "4be12541-2945-4101-8a33-79ac0ad58750",
+			Parameters:          params,
+			Context:             c.context,
+			OriginatingIdentity: c.identity,
+		}, nil)
+		if s := httpStatus(err); s != c.status || (c.status == 0 && err != nil) {
+			t.Errorf("case %d: expected status %d, got: %v", i, c.status, err)
+		}
+	}
+}
+
+func TestUnitOriginatingIdentityHeader(t *testing.T) {
+	oi := parseOriginatingIdentity("cloudfoundry eyJ1c2VyX2lkIjogImNmLXVzZXIifQ==")
+	if oi == nil {
+		t.Fatal("expected originating identity to be parsed")
+	}
+	if oi.Platform != "cloudfoundry" {
+		t.Errorf("unexpected platform %q", oi.Platform)
+	}
+	if user, _ := identityUser(oi.Value); user != "cf-user" {
+		t.Errorf("unexpected user %q", user)
+	}
+
+	if parseOriginatingIdentity("garbage") != nil {
+		t.Error("expected malformed header to be ignored")
+	}
+}
+
+func TestUnitProvisionPlanLimits(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	cases := []struct {
+		planID     string
+		params     map[string]interface{}
+		violations int
+	}{
+		{
+			// standalone_lg
+			planID: "04349656-4dc9-4b67-9b15-52a93d64d566",
+			params: map[string]interface{}{
+				"PGO_STORAGE_SIZE":   "500Gi",
+				"PGO_STORAGE_CONFIG": "osblarge",
+				"PGO_CCP_IMAGE_TAG":  "ubi8-13.3-4.7.0",
+				"PGO_PGBOUNCER":      true,
+				"PGO_TLS_SECRET":     "server-tls",
+				"PGO_CA_SECRET":      "server-ca",
+				"PGO_TLS_ONLY":       true,
+				"PGO_CUSTOM_CONFIG":  "custom-config",
+				"PGO_LABELS":         map[string]interface{}{"example.com/team": "a"},
+			},
+		},
+		{
+			// standalone_sm
+			planID: "885a1cb6-ca42-43e9-a725-8195918e1343",
+			params: map[string]interface{}{
+				"PGO_STORAGE_SIZE":   "1Ti",
+				"PGO_STORAGE_CONFIG": "osbsmall",
+			},
+			violations: 1,
+		},
+		{
+			planID: "885a1cb6-ca42-43e9-a725-8195918e1343",
+			params: map[string]interface{}{
+				"PGO_STORAGE_CONFIG": "osblarge",
+				"PGO_LABELS":         map[string]interface{}{"good": "b c"},
+			},
+			violations: 2,
+		},
+		{
+			planID: "885a1cb6-ca42-43e9-a725-8195918e1343",
+			params: map[string]interface{}{
+				"PGO_TLS_SECRET": "server-tls",
+				"PGO_LABELS":     map[string]interface{}{"-bad": "a"},
+			},
+			violations: 2,
+		},
+	}
+
+	for i, c := range cases {
+		c.params["PGO_NAMESPACE"] = "unitnamespace"
+		c.params["PGO_CLUSTERNAME"] = fmt.Sprintf("unitinstance%d", i)
+		req := &osb.ProvisionRequest{
+			InstanceID: nuuid(t),
+			PlanID:     c.planID,
+			ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+			Parameters: c.params,
+		}
+
+		_, err := bl.Provision(req, nil)
+		if c.violations == 0 {
+			if err != nil {
+				t.Errorf("case %d: unexpected error: %s", i, err)
+			}
+			continue
+		}
+		e, ok := osb.IsHTTPError(err)
+		if !ok || e.StatusCode != http.StatusBadRequest {
+			t.Errorf("case %d: expected HTTP 400, got: %v", i, err)
+			continue
+		}
+		if ip, ok := e.ResponseError.(broker.ErrInvalidParams); !ok || len(ip.Violations) != c.violations {
+			t.Errorf("case %d: expected %d violations, got: %v", i, c.violations, e.ResponseError)
+		}
+	}
+}
+
+func TestUnitProvisionRestore(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	bl.policy = &namespacePolicy{
+		Rules: []policyRule{
+			{
+				Match:      policyMatch{Namespace: "staging"},
+				Namespaces: []string{"pgo-staging"},
+			},
+			{
+				Match:      policyMatch{Namespace: "prod"},
+				Namespaces: []string{"pgo-prod", "pgo-staging"},
+			},
+		},
+	}
+
+	provision := func(ns, name, ctxNS string, extra map[string]interface{}) (string, error) {
+		params := map[string]interface{}{
+			"PGO_NAMESPACE":   ns,
+			"PGO_CLUSTERNAME": name,
+		}
+		for k, v := range extra {
+			params[k] = v
+		}
+		req := &osb.ProvisionRequest{
+			InstanceID: nuuid(t),
+			PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+			ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+			Context:    map[string]interface{}{"namespace": ctxNS},
+			Parameters: params,
+		}
+		_, err := bl.Provision(req, nil)
+		return req.InstanceID, err
+	}
+
+	srcID, err := provision("pgo-prod", "source", "prod", nil)
+	if err != nil {
+		t.Fatalf("error provisioning source: %s", err)
+	}
+
+	if _, err := provision("pgo-staging", "clone", "prod", map[string]interface{}{
+		"restore_from_instance_id": srcID,
+		"restore_target":           "2021-06-09T14:15:11Z",
+	}); err != nil {
+		t.Errorf("unexpected error cloning: %s", err)
+	}
+
+	cases := []struct {
+		ctxNS  string
+		params map[string]interface{}
+		status int
+	}{
+		{"prod", map[string]interface{}{"restore_from_instance_id": nuuid(t)}, http.StatusBadRequest},
+		{"prod", map[string]interface{}{"restore_target": "2021-06-09T14:15:11Z"}, http.StatusBadRequest},
+		{"prod", map[string]interface{}{"restore_from_instance_id": srcID, "restore_target": "yesterday"}, http.StatusBadRequest},
+		// Source namespace not permitted for the tenant
+		{"staging", map[string]interface{}{"restore_from_instance_id": srcID}, http.StatusForbidden},
+	}
+	for i, c := range cases {
+		_, err := provision("pgo-staging", fmt.Sprintf("clone%d", i), c.ctxNS, c.params)
+		if s := httpStatus(err); s != c.status {
+			t.Errorf("case %d: expected status %d, got %d: %v", i, c.status, s, err)
+		}
+	}
+}
+
+func TestUnitStandby(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	provision := func(name string, extra map[string]interface{}) string {
+		return provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", name, extra).InstanceID
+	}
+	lastOp := func(instanceID string) (osb.LastOperationState, error) {
+		resp, err := bl.LastOperation(&osb.LastOperationRequest{InstanceID: instanceID}, nil)
+		if err != nil {
+			return "", err
+		}
+		return resp.State, nil
+	}
+
+	srcID := provision("primary", nil)
+	stbyID := provision("standby", map[string]interface{}{"standby_of_instance_id": srcID})
+
+	bl.Broker.(*broker.Mock).SetBusy(stbyID, true)
+	if state, err := lastOp(stbyID); err != nil || state != osb.StateInProgress {
+		t.Errorf("expected operation in progress while busy, got %q: %v", state, err)
+	}
+	bl.Broker.(*broker.Mock).SetBusy(stbyID, false)
+	if state, err := lastOp(stbyID); err != nil || state != osb.StateSucceeded {
+		t.Errorf("expected operation succeeded, got %q: %v", state, err)
+	}
+	if _, err := lastOp(nuuid(t)); httpStatus(err) != http.StatusGone {
+		t.Errorf("expected HTTP 410 for missing instance, got: %v", err)
+	}
+
+	bind := func(instanceID string) map[string]interface{} {
+		resp, err := bl.Bind(&osb.BindRequest{InstanceID: instanceID, BindingID: nuuid(t)}, nil)
+		if err != nil {
+			t.Fatalf("error binding: %s", err)
+		}
+		return resp.Credentials
+	}
+	if ro, _ := bind(stbyID)["read_only"].(bool); !ro {
+		t.Error("expected read-only binding to standby")
+	}
+	if ro, _ := bind(srcID)["read_only"].(bool); ro {
+		t.Error("expected writable binding to primary")
+	}
+
+	// The roles of standbys live on their source, so they may only read
+	recs, err := bl.Broker.ListBindings(stbyID)
+	if err != nil || len(recs) != 1 || recs[0].Access != broker.AccessReadOnly {
+		t.Errorf("expected a readonly binding of the standby, got %v: %v", recs, err)
+	}
+	for _, params := range []map[string]interface{}{
+		{"role": "owner"},
+		{"role": "readwrite"},
+		{"isolation": "schema"},
+	} {
+		_, err := bl.Bind(&osb.BindRequest{InstanceID: stbyID, BindingID: nuuid(t), Parameters: params}, nil)
+		if httpStatus(err) != http.StatusBadRequest {
+			t.Errorf("expected HTTP 400 binding a standby with %v, got: %v", params, err)
+		}
+	}
+	_, err = bl.Bind(&osb.BindRequest{InstanceID: stbyID, BindingID: nuuid(t), Parameters: map[string]interface{}{"role": "readonly"}}, nil)
+	if err != nil {
+		t.Errorf("error binding a standby readonly: %s", err)
+	}
+	_, err = bl.Broker.CreateBinding(broker.BindRequest{InstanceID: stbyID, BindingID: nuuid(t), Access: broker.AccessOwner})
+	if _, ok := err.(broker.ErrInvalidParams); !ok {
+		t.Errorf("expected the broker to refuse an owner binding of a standby, got: %v", err)
+	}
+
+	promote := func(instanceID string) error {
+		_, err := bl.Update(&osb.UpdateInstanceRequest{
+			InstanceID: instanceID,
+			Parameters: map[string]interface{}{"promote": true},
+		}, nil)
+		return err
+	}
+	if err := promote(srcID); httpStatus(err) != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 promoting a primary, got: %v", err)
+	}
+	if err := promote(stbyID); err != nil {
+		t.Fatalf("error promoting standby: %s", err)
+	}
+	if ro, _ := bind(stbyID)["read_only"].(bool); ro {
+		t.Error("expected writable binding to promoted standby")
+	}
+}
+
+func TestUnitProvisionSynchronousFinalBackup(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	req := &osb.ProvisionRequest{
+		InstanceID: nuuid(t),
+		PlanID:     "dc951396-bb28-45a4-b040-cfe3bebc6121",
+		ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+		Parameters: map[string]interface{}{
+			"PGO_NAMESPACE":   "unitnamespace",
+			"PGO_CLUSTERNAME": "unitinstance",
+			"final_backup":    true,
+		},
+	}
+	if _, err := bl.Provision(req, nil); httpStatus(err) != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for a final backup on a synchronous broker, got: %v", err)
+	}
+
+	// The plan's final backup is dropped, so the instance can be
+	// deprovisioned synchronously
+	delete(req.Parameters, "final_backup")
+	if _, err := bl.Provision(req, nil); err != nil {
+		t.Fatalf("error provisioning: %s", err)
+	}
+	resp, err := bl.Deprovision(&osb.DeprovisionRequest{InstanceID: req.InstanceID}, nil)
+	if err != nil {
+		t.Fatalf("error deprovisioning: %s", err)
+	}
+	if resp.Async {
+		t.Errorf("expected a synchronous deprovision, got %+v", resp)
+	}
+	if _, err := bl.Deprovision(&osb.DeprovisionRequest{InstanceID: req.InstanceID}, nil); httpStatus(err) != http.StatusGone {
+		t.Errorf("expected HTTP 410 once deleted, got: %v", err)
+	}
+}
+
+func TestUnitProvisionRetainedVolumes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	provision := func(name string, params map[string]interface{}) (string, error) {
+		id := nuuid(t)
+		params["PGO_NAMESPACE"] = "unitnamespace"
+		params["PGO_CLUSTERNAME"] = name
+		_, err := bl.Provision(&osb.ProvisionRequest{
+			InstanceID: id,
+			PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+			ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+			Parameters: params,
+		}, nil)
+		return id, err
+	}
+	for name, params := range map[string]map[string]interface{}{
+		"keptbackups": {},
+		"purged":      {"backup_retention_days": 0},
+	} {
+		id, err := provision(name, params)
+		if err != nil {
+			t.Fatalf("error provisioning %s: %s", name, err)
+		}
+		if _, err := bl.Deprovision(&osb.DeprovisionRequest{InstanceID: id}, nil); err != nil {
+			t.Fatalf("error deprovisioning %s: %s", name, err)
+		}
+	}
+
+	// The backups of the first instance would be adopted by a new cluster
+	if _, err := provision("keptbackups", map[string]interface{}{}); httpStatus(err) != http.StatusConflict {
+		t.Errorf("expected HTTP 409 for a name with retained volumes, got: %v", err)
+	}
+	if _, err := provision("purged", map[string]interface{}{}); err != nil {
+		t.Errorf("error provisioning a name without retained volumes: %s", err)
+	}
+}
+
+func TestUnitDeprovisionFinalBackup(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	provision := func(name string, extra map[string]interface{}) (string, error) {
+		params := map[string]interface{}{
+			"PGO_NAMESPACE":   "unitnamespace",
+			"PGO_CLUSTERNAME": name,
+		}
+		for k, v := range extra {
+			params[k] = v
+		}
+		req := &osb.ProvisionRequest{
+			InstanceID: nuuid(t),
+			PlanID:     "86064792-7ea2-467b-af93-ac9694d96d5c",
+			ServiceID:  "4be12541-2945-4101-8a33-79ac0ad58750",
+			Parameters: params,
+		}
+		_, err := bl.Provision(req, nil)
+		return req.InstanceID, err
+	}
+
+	if _, err := provision("nodays", map[string]interface{}{
+		"final_backup":          true,
+		"backup_retention_days": 0,
+	}); httpStatus(err) != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 for final backup without retention, got: %v", err)
+	}
+
+	bl.async = true
+	id, err := provision("backedup", map[string]interface{}{"final_backup": true})
+	if err != nil {
+		t.Fatalf("error provisioning: %s", err)
+	}
+	deprovision := func() error {
+		resp, err := bl.Deprovision(&osb.DeprovisionRequest{InstanceID: id, AcceptsIncomplete: true}, nil)
+		if err == nil && (!resp.Async || resp.OperationKey == nil) {
+			t.Errorf("expected an asynchronous deprovision awaiting the final backup, got %+v", resp)
+		}
+		return err
+	}
+	lastOp := func() (osb.LastOperationState, error) {
+		resp, err := bl.LastOperation(&osb.LastOperationRequest{InstanceID: id}, nil)
+		if err != nil {
+			return "", err
+		}
+		return resp.State, nil
+	}
+
+	// The instance outlives the deprovision, which has to be asynchronous,
+	// should the broker have been restarted without --async
+	bl.async = false
+	_, err = bl.Deprovision(&osb.DeprovisionRequest{InstanceID: id, AcceptsIncomplete: true}, nil)
+	if e, ok := osb.IsHTTPError(err); !ok || e.StatusCode != http.StatusUnprocessableEntity || e.ErrorMessage == nil || *e.ErrorMessage != osb.AsyncErrorMessage {
+		t.Errorf("expected HTTP 422 AsyncRequired for a synchronous broker, got: %v", err)
+	}
+	if state, err := lastOp(); err != nil || state != osb.StateSucceeded {
+		t.Errorf("expected the instance to be left alone, got %q: %v", state, err)
+	}
+	bl.async = true
+	if _, err := bl.Deprovision(&osb.DeprovisionRequest{InstanceID: id}, nil); httpStatus(err) != http.StatusUnprocessableEntity {
+		t.Errorf("expected HTTP 422 for a platform not accepting incomplete deprovisions, got: %v", err)
+	}
+
+	if err := deprovision(); err != nil {
+		t.Fatalf("error deprovisioning: %s", err)
+	}
+	if state, err := lastOp(); err != nil || state != osb.StateInProgress {
+		t.Errorf("expected deprovision in progress awaiting final backup, got %q: %v", state, err)
+	}
+	if err := deprovision(); err != nil {
+		t.Errorf("expected repeated deprovision to succeed, got: %s", err)
+	}
+	if _, err := bl.Bind(&osb.BindRequest{InstanceID: id, BindingID: nuuid(t)}, nil); httpStatus(err) != http.StatusUnprocessableEntity {
+		t.Errorf("expected HTTP 422 binding while deprovisioning, got: %v", err)
+	}
+
+	if err := bl.Broker.(broker.Janitor).CleanUp(); err != nil {
+		t.Fatalf("error cleaning up: %s", err)
+	}
+	if _, err := lastOp(); httpStatus(err) != http.StatusGone {
+		t.Errorf("expected HTTP 410 once deleted, got: %v", err)
+	}
+}
+
+func TestUnitDeprovisionProtection(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", map[string]interface{}{"deletion_protection": true})
+	if _, err := bl.Bind(&osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t)}, nil); err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+
+	deprovision := func() error {
+		_, err := bl.Deprovision(&osb.DeprovisionRequest{InstanceID: preq.InstanceID}, nil)
+		return err
+	}
+	setProtection := func(p bool) {
+		_, err := bl.Update(&osb.UpdateInstanceRequest{
+			InstanceID: preq.InstanceID,
+			Parameters: map[string]interface{}{"deletion_protection": p},
+		}, nil)
+		if err != nil {
+			t.Fatalf("error updating deletion protection: %s", err)
+		}
+	}
+
+	err := deprovision()
+	if e, ok := osb.IsHTTPError(err); !ok || e.StatusCode != http.StatusUnprocessableEntity || *e.ErrorMessage != "DeletionProtected" {
+		t.Fatalf("expected HTTP 422 DeletionProtected, got: %v", err)
+	}
+
+	setProtection(false)
+	if err := deprovision(); httpStatus(err) != http.StatusUnprocessableEntity {
+		t.Fatalf("expected bindings to block deprovision, got: %v", err)
+	}
+
+	bl.Broker.(*broker.Mock).SetForceDelete(preq.InstanceID, true)
+	if err := deprovision(); err != nil {
+		t.Fatalf("expected forced deprovision to succeed, got: %s", err)
+	}
+}
+
+func TestUnitAdminBindings(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", nil)
+	appGUID := "unitapp"
+	bindIDs := []string{nuuid(t), nuuid(t)}
+	for _, id := range bindIDs {
+		_, err := bl.Bind(&osb.BindRequest{InstanceID: preq.InstanceID, BindingID: id, AppGUID: &appGUID}, nil)
+		if err != nil {
+			t.Fatalf("error binding: %s", err)
+		}
+	}
+	_, err := bl.Unbind(&osb.UnbindRequest{InstanceID: preq.InstanceID, BindingID: bindIDs[0]}, nil)
+	if err != nil {
+		t.Fatalf("error unbinding: %s", err)
+	}
+
+	h := bl.AdminHandler("secret")
+	get := func(path, token string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		body := map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid admin response: %s", err)
+		}
+		return rec.Code, body
+	}
+
+	path := "/admin/v1/instances/" + preq.InstanceID + "/bindings"
+	if status, _ := get(path, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected HTTP 401 without token, got %d", status)
+	}
+	if status, _ := get(path, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("expected HTTP 401 with wrong token, got %d", status)
+	}
+	if status, _ := get("/admin/v1/instances/"+nuuid(t)+"/bindings", "secret"); status != http.StatusNotFound {
+		t.Errorf("expected HTTP 404 for missing instance, got %d", status)
+	}
+
+	status, body := get(path, "secret")
+	if status != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %v", status, body)
+	}
+	bindings, _ := body["bindings"].([]interface{})
+	if len(bindings) != 1 {
+		t.Fatalf("expected one binding, got: %v", body["bindings"])
+	}
+	if b, _ := bindings[0].(map[string]interface{}); b["binding_id"] != bindIDs[1] || b["app_guid"] != appGUID || b["role"] == "" {
+		t.Errorf("unexpected binding record: %v", b)
+	}
+}
+
+func TestUnitBindingAccess(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", nil)
+
+	cases := []struct {
+		name     string
+		params   map[string]interface{}
+		access   broker.AccessLevel
+		readOnly bool
+		status   int
+	}{
+		{name: "default", access: broker.AccessOwner},
+		{name: "readonly", params: map[string]interface{}{"role": "readonly"}, access: broker.AccessReadOnly, readOnly: true},
+		{name: "readwrite", params: map[string]interface{}{"role": "readwrite"}, access: broker.AccessReadWrite},
+		{name: "owner", params: map[string]interface{}{"role": "owner"}, access: broker.AccessOwner},
+		{name: "unknown", params: map[string]interface{}{"role": "superuser"}, status: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		breq := &osb.BindRequest{
+			InstanceID: preq.InstanceID,
+			BindingID:  nuuid(t),
+			Parameters: c.params,
+		}
+		resp, err := bl.Bind(breq, nil)
+		if c.status != 0 {
+			if status := httpStatus(err); status != c.status {
+				t.Errorf("%s: expected HTTP %d, got %d (%v)", c.name, c.status, status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error binding: %s", c.name, err)
+			continue
+		}
+		if ro, _ := resp.Credentials["read_only"].(bool); ro != c.readOnly {
+			t.Errorf("%s: expected read_only %t, got %v", c.name, c.readOnly, resp.Credentials["read_only"])
+		}
+
+		recs, err := bl.Broker.ListBindings(preq.InstanceID)
+		if err != nil {
+			t.Fatalf("error listing bindings: %s", err)
+		}
+		for _, rec := range recs {
+			if rec.BindingID == breq.BindingID && rec.Access != c.access {
+				t.Errorf("%s: expected %s access recorded, got %q", c.name, c.access, rec.Access)
+			}
+		}
+
+		// Repeating the binding with different privileges conflicts
+		other := "readonly"
+		if c.access == broker.AccessReadOnly {
+			other = "owner"
+		}
+		breq.Parameters = map[string]interface{}{"role": other}
+		if _, err := bl.Bind(breq, nil); httpStatus(err) != http.StatusConflict {
+			t.Errorf("%s: expected HTTP 409 rebinding as %s, got: %v", c.name, other, err)
+		}
+	}
+}
+
+func TestUnitBindingIsolation(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", nil)
+
+	cases := []struct {
+		name   string
+		params map[string]interface{}
+		schema bool
+		ownDB  bool
+		status int
+	}{
+		{name: "shared"},
+		{name: "schema", params: map[string]interface{}{"isolation": "schema"}, schema: true},
+		{name: "database", params: map[string]interface{}{"isolation": "database", "keep_on_unbind": true}, ownDB: true},
+		{name: "readonly schema", params: map[string]interface{}{"isolation": "schema", "role": "readonly"}, status: http.StatusBadRequest},
+		{name: "keep shared", params: map[string]interface{}{"keep_on_unbind": true}, status: http.StatusBadRequest},
+		{name: "unknown", params: map[string]interface{}{"isolation": "cluster"}, status: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		breq := &osb.BindRequest{
+			InstanceID: preq.InstanceID,
+			BindingID:  nuuid(t),
+			Parameters: c.params,
+		}
+		resp, err := bl.Bind(breq, nil)
+		if c.status != 0 {
+			if status := httpStatus(err); status != c.status {
+				t.Errorf("%s: expected HTTP %d, got %d (%v)", c.name, c.status, status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error binding: %s", c.name, err)
+			continue
+		}
+
+		user := resp.Credentials["username"]
+		if schema, ok := resp.Credentials["schema"]; ok != c.schema || (ok && schema != user) {
+			t.Errorf("%s: unexpected schema %v for user %v", c.name, schema, user)
+		}
+		dbName := resp.Credentials["db_name"]
+		if c.ownDB && dbName != user {
+			t.Errorf("%s: expected database %v, got %v", c.name, user, dbName)
+		} else if !c.ownDB && dbName != broker.MockStatic.Database {
+			t.Errorf("%s: expected instance database, got %v", c.name, dbName)
+		}
+
+		if _, err := bl.Unbind(&osb.UnbindRequest{InstanceID: preq.InstanceID, BindingID: breq.BindingID}, nil); err != nil {
+			t.Errorf("%s: error unbinding: %s", c.name, err)
+		}
+	}
+}
+
+func TestUnitBindingCredentialsFormat(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", map[string]interface{}{"PGO_TLS_SECRET": "unit-tls", "PGO_CA_SECRET": "unit-ca"})
+
+	bind := func(format string) map[string]interface{} {
+		resp, err := bl.Bind(&osb.BindRequest{
+			InstanceID: preq.InstanceID,
+			BindingID:  nuuid(t),
+			Parameters: map[string]interface{}{"credentials_format": format},
+		}, nil)
+		if err != nil {
+			t.Fatalf("%s: error binding: %s", format, err)
+		}
+		return resp.Credentials
+	}
+
+	creds := bind("servicebinding")
+	user, _ := creds["username"].(string)
+	password, _ := creds["password"].(string)
+	expected := map[string]interface{}{
+		"type":         "postgresql",
+		"provider":     "crunchydata",
+		"host":         broker.MockStatic.ExternalIP,
+		"port":         "5432",
+		"database":     broker.MockStatic.Database,
+		"sslmode":      "verify-ca",
+		"ca.crt":       broker.MockStatic.CACert,
+		"replica-host": broker.MockStatic.ReplicaIP,
+		"jdbc-url": "jdbc:postgresql://" + broker.MockStatic.ExternalIP + ":5432/" + broker.MockStatic.Database +
+			"?password=" + url.QueryEscape(password) + "&sslmode=verify-ca&user=" + user,
+		"dsn": "host='" + broker.MockStatic.ExternalIP + "' port=5432 dbname='" + broker.MockStatic.Database +
+			"' user='" + user + "' password='" + password + "' sslmode=verify-ca",
+	}
+	for k, v := range expected {
+		if creds[k] != v {
+			t.Errorf("servicebinding: expected %s %q, got %q", k, v, creds[k])
+		}
+	}
+	if _, ok := creds["db_host"]; ok {
+		t.Errorf("servicebinding: unexpected osb key db_host")
+	}
+
+	creds = bind("all")
+	for _, k := range []string{"type", "jdbc-url", "db_host", "db_port", "internal_host"} {
+		if _, ok := creds[k]; !ok {
+			t.Errorf("all: missing key %s", k)
+		}
+	}
+
+	creds = bind("osb")
+	if _, ok := creds["type"]; ok {
+		t.Errorf("osb: unexpected servicebinding key type")
+	}
+}
+
+func TestUnitBindingEndpoint(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", nil)
+
+	cases := []struct {
+		endpoint string
+		host     string
+		port     int
+		status   int
+	}{
+		{endpoint: "auto", host: broker.MockStatic.ExternalIP, port: 5432},
+		{endpoint: "service-dns", host: "unitinstance.unitnamespace.svc.cluster.local", port: 5432},
+		{endpoint: "cluster-ip", host: broker.MockStatic.ClusterIP, port: 5432},
+		{endpoint: "load-balancer", host: broker.MockStatic.LBHostname, port: 5432},
+		{endpoint: "node-port", status: http.StatusBadRequest},
+		{endpoint: "route", status: http.StatusBadRequest},
+		{endpoint: "pod-ip", status: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		resp, err := bl.Bind(&osb.BindRequest{
+			InstanceID: preq.InstanceID,
+			BindingID:  nuuid(t),
+			Parameters: map[string]interface{}{"endpoint": c.endpoint},
+		}, nil)
+		if c.status != 0 {
+			if status := httpStatus(err); status != c.status {
+				t.Errorf("%s: expected HTTP %d, got %d (%v)", c.endpoint, c.status, status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error binding: %s", c.endpoint, err)
+			continue
+		}
+		if resp.Credentials["db_host"] != c.host || resp.Credentials["db_port"] != c.port {
+			t.Errorf("%s: expected %s:%d, got %v:%v", c.endpoint, c.host, c.port,
+				resp.Credentials["db_host"], resp.Credentials["db_port"])
+		}
+	}
+
+	// Endpoints which are not available do not leave bindings behind
+	recs, err := bl.Broker.ListBindings(preq.InstanceID)
+	if err != nil {
+		t.Fatalf("error listing bindings: %s", err)
+	}
+	if len(recs) != 4 {
+		t.Errorf("expected 4 bindings, got %d", len(recs))
+	}
+
+	bl.endpoints.nodePortHost = "nodes.example.com"
+	resp, err := bl.Bind(&osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+		Parameters: map[string]interface{}{"endpoint": "node-port"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("node-port: unexpected error binding: %s", err)
+	}
+	if resp.Credentials["db_host"] != "nodes.example.com" || resp.Credentials["db_port"] != broker.MockStatic.NodePort {
+		t.Errorf("node-port: unexpected endpoint %v:%v", resp.Credentials["db_host"], resp.Credentials["db_port"])
+	}
+}
+
+func TestUnitBindingPgBouncer(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	provision := func(name string, pgbouncer bool) string {
+		return provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", name, map[string]interface{}{"PGO_PGBOUNCER": pgbouncer}).InstanceID
+	}
+	pooled := provision("unitpooled", true)
+	direct := provision("unitdirect", false)
+
+	_, err := bl.Bind(&osb.BindRequest{
+		InstanceID: direct,
+		BindingID:  nuuid(t),
+		Parameters: map[string]interface{}{"pgbouncer": true},
+	}, nil)
+	if status := httpStatus(err); status != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 binding through missing pgBouncer, got %d (%v)", status, err)
+	}
+
+	breq := &osb.BindRequest{
+		InstanceID: pooled,
+		BindingID:  nuuid(t),
+		Parameters: map[string]interface{}{"pgbouncer": true, "credentials_format": "all"},
+	}
+	resp, err := bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error binding through pgBouncer: %s", err)
+	}
+	if resp.Credentials["db_host"] != broker.MockStatic.BouncerIP || resp.Credentials["internal_host"] != broker.MockStatic.BouncerIP {
+		t.Errorf("expected pgBouncer host %s, got %v", broker.MockStatic.BouncerIP, resp.Credentials["db_host"])
+	}
+	if resp.Credentials["replica-host"] != broker.MockStatic.ReplicaIP {
+		t.Errorf("expected replica host %s, got %v", broker.MockStatic.ReplicaIP, resp.Credentials["replica-host"])
+	}
+	recs, err := bl.Broker.ListBindings(pooled)
+	if err != nil || len(recs) != 1 || !recs[0].PgBouncer {
+		t.Errorf("expected a pgBouncer binding recorded, got %v (%v)", recs, err)
+	}
+
+	// The pooled endpoint is only used when requested
+	resp, err = bl.Bind(&osb.BindRequest{InstanceID: pooled, BindingID: nuuid(t)}, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	if resp.Credentials["db_host"] != broker.MockStatic.ExternalIP {
+		t.Errorf("expected primary host %s, got %v", broker.MockStatic.ExternalIP, resp.Credentials["db_host"])
+	}
+}
+
+func TestUnitBindingNetworkPolicy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitfenced", nil)
+
+	_, err := bl.Bind(&osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+		Parameters: map[string]interface{}{"network_policy": true},
+	}, nil)
+	if status := httpStatus(err); status != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 without a context namespace, got %d (%v)", status, err)
+	}
+
+	breq := &osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+		Parameters: map[string]interface{}{"network_policy": true, "include_endpoints": true},
+		Context:    map[string]interface{}{"platform": "kubernetes", "namespace": "unitapp"},
+	}
+	resp, err := bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	eps, _ := resp.Credentials["endpoints"].([]endpoint)
+	if len(eps) != 2 || eps[0].Host != broker.MockStatic.ExternalIP || eps[0].Ports[0] != "5432" || eps[1].Host != broker.MockStatic.ReplicaIP {
+		t.Errorf("unexpected endpoints %v", resp.Credentials["endpoints"])
+	}
+	recs, err := bl.Broker.ListBindings(preq.InstanceID)
+	if err != nil || len(recs) != 1 || recs[0].AppNamespace != "unitapp" {
+		t.Fatalf("expected a binding admitting unitapp, got %v (%v)", recs, err)
+	}
+
+	// Binding again from another namespace conflicts with the policy
+	breq.Context = map[string]interface{}{"platform": "kubernetes", "namespace": "unitother"}
+	_, err = bl.Bind(breq, nil)
+	if status := httpStatus(err); status != http.StatusConflict {
+		t.Errorf("expected HTTP 409 rebinding from another namespace, got %d (%v)", status, err)
+	}
+
+	_, err = bl.Unbind(&osb.UnbindRequest{InstanceID: preq.InstanceID, BindingID: breq.BindingID}, nil)
+	if err != nil {
+		t.Fatalf("error unbinding: %s", err)
+	}
+	if recs, _ := bl.Broker.ListBindings(preq.InstanceID); len(recs) != 0 {
+		t.Errorf("expected no bindings after unbind, got %v", recs)
+	}
+
+	// A policy would cut off the apps of bindings without one
+	open := &osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t)}
+	resp, err = bl.Bind(open, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	if _, ok := resp.Credentials["endpoints"]; ok {
+		t.Errorf("expected no endpoints without include_endpoints, got %v", resp.Credentials["endpoints"])
+	}
+	breq.BindingID = nuuid(t)
+	breq.Context = map[string]interface{}{"platform": "kubernetes", "namespace": "unitapp"}
+	if _, err := bl.Bind(breq, nil); httpStatus(err) != http.StatusConflict {
+		t.Errorf("expected HTTP 409 for a policy while a binding has none, got %v", err)
+	}
+	if _, err := bl.Unbind(&osb.UnbindRequest{InstanceID: preq.InstanceID, BindingID: open.BindingID}, nil); err != nil {
+		t.Fatalf("error unbinding: %s", err)
+	}
+	if _, err := bl.Bind(breq, nil); err != nil {
+		t.Errorf("expected a policy once all bindings have one: %s", err)
+	}
+
+	// The apps of a binding without a policy would be cut off in turn
+	open.BindingID = nuuid(t)
+	if _, err := bl.Bind(open, nil); httpStatus(err) != http.StatusConflict {
+		t.Errorf("expected HTTP 409 for a binding without a policy while one has one, got %v", err)
+	}
+}
+
+func TestUnitBindingRotation(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitrotated", nil)
+	breq := &osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t)}
+	first, err := bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+
+	h := bl.AdminHandler("secret")
+	rotate := func(bindID, body string) (int, map[string]interface{}) {
+		path := "/admin/v1/instances/" + preq.InstanceID + "/bindings/" + bindID + "/rotate"
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		resp := map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid admin response: %s", err)
+		}
+		return rec.Code, resp
+	}
+
+	if status, body := rotate(nuuid(t), ""); status != http.StatusNotFound {
+		t.Errorf("expected HTTP 404 rotating a missing binding, got %d: %v", status, body)
+	}
+	if status, body := rotate(breq.BindingID, `{"grace_period": "soon"}`); status != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 for an invalid grace period, got %d: %v", status, body)
+	}
+
+	// Without a grace period, the password of the role changes at once
+	if status, body := rotate(breq.BindingID, ""); status != http.StatusOK {
+		t.Fatalf("expected HTTP 200 rotating, got %d: %v", status, body)
+	}
+	second, err := bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error fetching binding: %s", err)
+	}
+	if second.Credentials["username"] != first.Credentials["username"] || second.Credentials["password"] == first.Credentials["password"] {
+		t.Errorf("expected a new password for %v, got %v", first.Credentials["username"], second.Credentials)
+	}
+
+	// With one, the binding switches to its alternate role
+	status, body := rotate(breq.BindingID, `{"grace_period": "1h"}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected HTTP 200 rotating with grace, got %d: %v", status, body)
+	}
+	rec, _ := body["binding"].(map[string]interface{})
+	if rec["grace_until"] == nil || rec["active_role"] != first.Credentials["username"].(string)+"_alt" {
+		t.Errorf("expected the alternate role in a grace period, got %v", rec)
+	}
+	third, err := bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error fetching binding: %s", err)
+	}
+	if third.Credentials["username"] != rec["active_role"] || third.Credentials["password"] == second.Credentials["password"] {
+		t.Errorf("expected credentials of the alternate role, got %v", third.Credentials)
+	}
+	if status, body := rotate(breq.BindingID, ""); status != http.StatusConflict {
+		t.Errorf("expected HTTP 409 rotating during the grace period, got %d: %v", status, body)
+	}
+
+	// Scheduled rotation applies to bindings older than the interval
+	other := &osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t)}
+	before, err := bl.Bind(other, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	mock := bl.Broker.(*broker.Mock)
+	mock.SetRotationPolicy(broker.RotationPolicy{Interval: time.Nanosecond})
+	if err := mock.CleanUp(); err != nil {
+		t.Fatalf("error cleaning up: %s", err)
+	}
+	after, err := bl.Bind(other, nil)
+	if err != nil {
+		t.Fatalf("error fetching binding: %s", err)
+	}
+	if after.Credentials["password"] == before.Credentials["password"] {
+		t.Errorf("expected the janitor to rotate the password of %v", before.Credentials["username"])
+	}
+}
+
+func TestUnitBindingLifetime(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	plan := planDef{ID: nuuid(t), Name: "unitlifetime", MaxStorageSize: "1Gi", MaxBindingLifetime: time.Hour}
+	if err := bl.setPlans([]planDef{plan}); err != nil {
+		t.Fatalf("error setting plans: %s", err)
+	}
+	preq := provisionInstance(t, bl, plan.ID, "unitexpiring", nil)
+	bind := func(params map[string]interface{}) (*osb.BindRequest, map[string]interface{}, error) {
+		breq := &osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t), PlanID: preq.PlanID, Parameters: params}
+		resp, err := bl.Bind(breq, nil)
+		if err != nil {
+			return breq, nil, err
+		}
+		return breq, resp.Credentials, nil
+	}
+	expiresIn := func(creds map[string]interface{}) time.Duration {
+		s, _ := creds["expires_at"].(string)
+		at, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("expected an RFC 3339 expires_at, got %v", creds["expires_at"])
+		}
+		return time.Until(at)
+	}
+
+	for _, lifetime := range []string{"2h", "-1h", "soon"} {
+		if _, _, err := bind(map[string]interface{}{"lifetime": lifetime}); httpStatus(err) != http.StatusBadRequest {
+			t.Errorf("expected HTTP 400 for lifetime %s, got %v", lifetime, err)
+		}
+	}
+
+	// Bindings not setting a lifetime are given the plan's maximum
+	_, creds, err := bind(nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	if d := expiresIn(creds); d <= 50*time.Minute || d > time.Hour {
+		t.Errorf("expected the binding to expire in an hour, got %s", d)
+	}
+	_, creds, err = bind(map[string]interface{}{"lifetime": "10m"})
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	if d := expiresIn(creds); d <= 0 || d > 10*time.Minute {
+		t.Errorf("expected the binding to expire in 10m, got %s", d)
+	}
+
+	// Expired bindings can no longer be fetched and are reaped
+	expired, _, err := bind(map[string]interface{}{"lifetime": "1ns"})
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := bl.Bind(expired, nil); httpStatus(err) != http.StatusConflict {
+		t.Errorf("expected HTTP 409 binding again after expiry, got %v", err)
+	}
+	if err := bl.Broker.(*broker.Mock).CleanUp(); err != nil {
+		t.Fatalf("error cleaning up: %s", err)
+	}
+	recs, err := bl.Broker.ListBindings(preq.InstanceID)
+	if err != nil {
+		t.Fatalf("error listing bindings: %s", err)
+	}
+	for _, rec := range recs {
+		if rec.BindingID == expired.BindingID {
+			t.Errorf("expected expired binding %s to be reaped", expired.BindingID)
+		}
+	}
+}
+
+func TestUnitBindingSuccessor(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitsucceeded", nil)
+	pred := &osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+		Parameters: map[string]interface{}{"isolation": "schema"},
+	}
+	predResp, err := bl.Bind(pred, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+
+	succeed := func(params map[string]interface{}) (*osblib.BindResponse, error) {
+		params["predecessor_binding_id"] = pred.BindingID
+		return bl.Bind(&osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t), Parameters: params}, nil)
+	}
+	if _, err := succeed(map[string]interface{}{"role": "readonly"}); httpStatus(err) != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 for a successor with other privileges, got %v", err)
+	}
+	missing := &osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+		Parameters: map[string]interface{}{"predecessor_binding_id": nuuid(t)},
+	}
+	if _, err := bl.Bind(missing, nil); httpStatus(err) != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 for a missing predecessor, got %v", err)
+	}
+
+	// The successor inherits the isolation, and with it the schema
+	succResp, err := succeed(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("error binding successor: %s", err)
+	}
+	if succResp.Credentials["schema"] != predResp.Credentials["schema"] {
+		t.Errorf("expected successor to take over schema %v, got %v", predResp.Credentials["schema"], succResp.Credentials["schema"])
+	}
+	if succResp.Credentials["username"] == predResp.Credentials["username"] {
+		t.Errorf("expected successor to have a role of its own, got %v", succResp.Credentials["username"])
+	}
+	if _, err := succeed(map[string]interface{}{}); httpStatus(err) != http.StatusConflict {
+		t.Errorf("expected HTTP 409 for a second successor, got %v", err)
+	}
+}
+
+func TestUnitBindingPasswordPolicy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	plan := planDef{ID: nuuid(t), Name: "unitpolicy", MaxStorageSize: "1Gi"}
+
+	plan.PasswordPolicy = broker.PasswordPolicy{Length: 2, Classes: []broker.CharClass{broker.CharLower, broker.CharUpper, broker.CharDigit}}
+	if err := bl.setPlans([]planDef{plan}); err == nil {
+		t.Errorf("expected an error for a password too short for its character classes")
+	}
+	plan.PasswordPolicy = broker.PasswordPolicy{Classes: []broker.CharClass{"emoji"}}
+	if err := bl.setPlans([]planDef{plan}); err == nil {
+		t.Errorf("expected an error for an unknown character class")
+	}
+
+	plan.PasswordPolicy = broker.PasswordPolicy{
+		Length:    24,
+		Classes:   []broker.CharClass{broker.CharLower, broker.CharDigit, broker.CharSymbol},
+		SCRAMOnly: true,
+	}
+	if err := bl.setPlans([]planDef{plan}); err != nil {
+		t.Fatalf("error setting plans: %s", err)
+	}
+	preq := provisionInstance(t, bl, plan.ID, "unitpolicy", nil)
+	breq := &osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t), PlanID: preq.PlanID}
+	resp, err := bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+
+	pw, _ := resp.Credentials["password"].(string)
+	if len(pw) != 24 {
+		t.Errorf("expected a 24 character password, got %q", pw)
+	}
+	for _, chars := range []string{"abcdefghijklmnopqrstuvwxyz", "0123456789", "!#%*+,-.:;=?@^_~"} {
+		if !strings.ContainsAny(pw, chars) {
+			t.Errorf("expected password %q to contain one of %q", pw, chars)
+		}
+	}
+	if strings.ContainsAny(pw, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		t.Errorf("expected password %q to have no upper case letters", pw)
+	}
+
+	// Rotations follow the policy the binding was created with
+	if _, err := bl.Broker.RotateBinding(broker.RotateRequest{InstanceID: preq.InstanceID, BindingID: breq.BindingID}); err != nil {
+		t.Fatalf("error rotating: %s", err)
+	}
+	recs, err := bl.Broker.ListBindings(preq.InstanceID)
+	if err != nil || len(recs) != 1 || recs[0].PasswordPolicy == nil || !recs[0].PasswordPolicy.SCRAMOnly {
+		t.Fatalf("expected the binding to record its password policy, got %v: %v", recs, err)
+	}
+	rotated, err := bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error fetching binding: %s", err)
+	}
+	if rpw, _ := rotated.Credentials["password"].(string); len(rpw) != 24 || rpw == pw {
+		t.Errorf("expected a new 24 character password, got %q", rpw)
+	}
+}
+
+func TestUnitPlanConfig(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	for _, p := range planDefs {
+		if p.PasswordPolicy.IsZero() {
+			t.Errorf("expected plan %s to ship with a password policy", p.Name)
+		}
+	}
+
+	cfg := planConfig{Plans: map[string]planOverride{
+		"ha_lg": {PasswordPolicy: &passwordPolicyConfig{Length: 64, Classes: []broker.CharClass{broker.CharLower, broker.CharDigit}}},
+	}}
+	plans, err := cfg.apply(planDefs)
+	if err != nil {
+		t.Fatalf("error applying plan configuration: %s", err)
+	}
+	bl := mockLogic(t)
+	if err := bl.setPlans(plans); err != nil {
+		t.Fatalf("error setting plans: %s", err)
+	}
+	lg := bl.findPlan("470ca1a0-2763-41f1-a4cf-985acdb549ab")
+	if lg.PasswordPolicy.Length != 64 || lg.PasswordPolicy.SCRAMOnly {
+		t.Errorf("expected the configured password policy for ha_lg, got %+v", lg.PasswordPolicy)
+	}
+	if sm := bl.findPlan("877432f8-07eb-4e57-b984-d025a71d2282"); !reflect.DeepEqual(sm.PasswordPolicy, standardPasswordPolicy) {
+		t.Errorf("expected ha_sm to keep its password policy, got %+v", sm.PasswordPolicy)
+	}
+	if planDefs[6].PasswordPolicy.Length != standardPasswordPolicy.Length {
+		t.Errorf("expected the shipped plans to be left as they are")
+	}
+
+	cfg = planConfig{Plans: map[string]planOverride{"standalone_md": {MaxBindingLifetime: "720h"}}}
+	if plans, err = cfg.apply(planDefs); err != nil {
+		t.Fatalf("error applying plan configuration: %s", err)
+	}
+	if md := plans[2]; md.MaxBindingLifetime != 720*time.Hour || md.PasswordPolicy.IsZero() {
+		t.Errorf("expected a binding lifetime of 720h for standalone_md, got %s", md.MaxBindingLifetime)
+	}
+	for _, lifetime := range []string{"a month", "-1h"} {
+		cfg = planConfig{Plans: map[string]planOverride{"default": {MaxBindingLifetime: lifetime}}}
+		if _, err := cfg.apply(planDefs); err == nil {
+			t.Errorf("expected an error for a binding lifetime of %q", lifetime)
+		}
+	}
+
+	for _, p := range planDefs {
+		if p.MaxBindingLimits.ConnectionLimit == 0 || p.MaxBindingLimits.WorkMem == 0 {
+			t.Errorf("expected plan %s to ship with binding limits", p.Name)
+		}
+		if !p.BindingLimits.IsZero() {
+			t.Errorf("expected plan %s to ship without default binding limits, got %+v", p.Name, p.BindingLimits)
+		}
+	}
+	cfg = planConfig{Plans: map[string]planOverride{
+		"ha_md": {
+			MaxBindingLimits: &bindingLimitsConfig{ConnectionLimit: 100, StatementTimeout: "10m", WorkMem: "512MB"},
+			BindingLimits:    &bindingLimitsConfig{ConnectionLimit: 50},
+		},
+	}}
+	if plans, err = cfg.apply(planDefs); err != nil {
+		t.Fatalf("error applying plan configuration: %s", err)
+	}
+	expLimits := broker.RoleLimits{ConnectionLimit: 100, StatementTimeout: 10 * time.Minute, WorkMem: 512 << 10}
+	if md := plans[5]; md.MaxBindingLimits != expLimits || md.BindingLimits != (broker.RoleLimits{ConnectionLimit: 50}) {
+		t.Errorf("expected binding limits %+v defaulting to 50 connections for ha_md, got %+v and %+v", expLimits, md.MaxBindingLimits, md.BindingLimits)
+	}
+	if err := bl.setPlans(plans); err != nil {
+		t.Errorf("error setting plans: %s", err)
+	}
+	cfg = planConfig{Plans: map[string]planOverride{"default": {BindingLimits: &bindingLimitsConfig{ConnectionLimit: 100}}}}
+	if plans, err := cfg.apply(planDefs); err != nil || bl.setPlans(plans) == nil {
+		t.Errorf("expected default binding limits above the caps to be rejected, got %v", err)
+	}
+	for _, limits := range []bindingLimitsConfig{{StatementTimeout: "1 minute"}, {WorkMem: "1TB"}} {
+		cfg = planConfig{Plans: map[string]planOverride{"default": {MaxBindingLimits: &limits}}}
+		if _, err := cfg.apply(planDefs); err == nil {
+			t.Errorf("expected an error for binding limits %+v", limits)
+		}
+	}
+
+	cfg = planConfig{Plans: map[string]planOverride{"xl": {}}}
+	if _, err := cfg.apply(planDefs); err == nil {
+		t.Errorf("expected an error for an unknown plan")
+	}
+	cfg = planConfig{Plans: map[string]planOverride{
+		"default": {PasswordPolicy: &passwordPolicyConfig{Length: 1, Classes: []broker.CharClass{broker.CharLower, broker.CharDigit}}},
+	}}
+	if plans, err := cfg.apply(planDefs); err != nil || bl.setPlans(plans) == nil {
+		t.Errorf("expected an invalid password policy to be rejected, got %v", err)
+	}
+}
+
+func TestUnitBindingClientCert(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	if _, err := NewBusinessLogic(Options{Simulated: true, ClientCASecret: "client-ca"}); err == nil {
+		t.Errorf("expected an error for a client CA secret without a namespace")
+	}
+	bl, err := NewBusinessLogic(Options{Simulated: true, ClientCASecret: "pgo-osb/client-ca"})
+	if err != nil {
+		t.Fatalf("error creating BusinessLogic: %s", err)
+	}
+
+	bindCert := func(bl *BusinessLogic, instanceID string, params map[string]interface{}) (*osb.BindRequest, *osblib.BindResponse, error) {
+		params["client_certificate"] = true
+		breq := &osb.BindRequest{InstanceID: instanceID, BindingID: nuuid(t), Parameters: params}
+		resp, err := bl.Bind(breq, nil)
+		return breq, resp, err
+	}
+
+	plain := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitplain", nil).InstanceID
+	if _, _, err := bindCert(bl, plain, map[string]interface{}{}); httpStatus(err) != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 for an instance without TLS, got %v", err)
+	}
+	secured := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitsecured", map[string]interface{}{
+		"PGO_TLS_SECRET": "unit-tls",
+		"PGO_CA_SECRET":  "unit-ca",
+	}).InstanceID
+	if _, _, err := bindCert(bl, secured, map[string]interface{}{"pgbouncer": true}); httpStatus(err) != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 for a client certificate through pgBouncer, got %v", err)
+	}
+	if _, _, err := bindCert(mockLogic(t), secured, map[string]interface{}{}); httpStatus(err) == 0 {
+		t.Errorf("expected an error without a client CA")
+	}
+
+	breq, resp, err := bindCert(bl, secured, map[string]interface{}{"credentials_format": "all"})
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	creds := resp.Credentials
+	if _, ok := creds["password"]; ok {
+		t.Errorf("expected no password, got %v", creds["password"])
+	}
+	block, _ := pem.Decode([]byte(fmt.Sprint(creds["client_cert"])))
+	if block == nil {
+		t.Fatalf("expected a PEM encoded client_cert, got %v", creds["client_cert"])
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("invalid client certificate: %s", err)
+	}
+	if cert.Subject.CommonName != creds["username"] {
+		t.Errorf("expected the certificate CN to be %v, got %s", creds["username"], cert.Subject.CommonName)
+	}
+	if creds["client_key"] == nil || creds["client_ca"] == nil || creds["tls.crt"] != creds["client_cert"] {
+		t.Errorf("expected the key, CA and servicebinding keys, got %v", creds)
+	}
+	if uri := fmt.Sprint(creds["uri"]); strings.Contains(uri, ":@") {
+		t.Errorf("expected a URI without a password, got %s", uri)
+	}
+
+	// Repeated requests return the same certificate
+	again, err := bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error fetching binding: %s", err)
+	}
+	if again.Credentials["client_cert"] != creds["client_cert"] {
+		t.Errorf("expected the same client certificate")
+	}
+	if _, err := bl.Broker.RotateBinding(broker.RotateRequest{InstanceID: secured, BindingID: breq.BindingID}); err == nil {
+		t.Errorf("expected an error rotating the password of a client certificate binding")
+	}
+}
+
+func TestUnitBindingTypes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, planDefs[0].ID, "unittypes", nil)
+	bind := func(params map[string]interface{}) (*osb.BindRequest, error) {
+		breq := &osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t), PlanID: preq.PlanID, Parameters: params}
+		_, err := bl.Bind(breq, nil)
+		return breq, err
+	}
+
+	for _, params := range []map[string]interface{}{
+		{"type": "backup"},
+		{"type": "monitoring", "role": "readonly"},
+		{"type": "monitoring", "isolation": "schema"},
+		{"type": "monitoring", "replication_slot": "unit_slot"},
+		{"type": "replication", "pgbouncer": true},
+		{"type": "replication", "replication_slot": "Unit-Slot"},
+		{"publication": "unit_pub"},
+		{"replication_slot": "unit_slot"},
+	} {
+		if _, err := bind(params); err == nil {
+			t.Errorf("expected an error binding with %v", params)
+		}
+	}
+
+	if _, err := bind(map[string]interface{}{"type": "monitoring"}); err != nil {
+		t.Fatalf("error binding for monitoring: %s", err)
+	}
+	repl := map[string]interface{}{"type": "replication", "publication": "unit_pub", "replication_slot": "unit_slot"}
+	breq, err := bind(repl)
+	if err != nil {
+		t.Fatalf("error binding for replication: %s", err)
+	}
+	recs, err := bl.Broker.ListBindings(preq.InstanceID)
+	if err != nil || len(recs) != 2 {
+		t.Fatalf("expected 2 bindings, got %v: %v", recs, err)
+	}
+	for _, rec := range recs {
+		if rec.Access != broker.AccessReadOnly || rec.Isolation != broker.IsolationShared {
+			t.Errorf("expected %s binding %s to be readonly and shared, got %s and %s", rec.Type, rec.BindingID, rec.Access, rec.Isolation)
+		}
+		if rec.BindingID == breq.BindingID && (rec.Type != broker.BindingReplication || rec.Publication != "unit_pub" || rec.Slot != "unit_slot") {
+			t.Errorf("expected the replication binding to record its publication and slot, got %+v", rec)
+		}
+	}
+
+	// The slot belongs to the binding until it is unbound
+	if _, err := bind(map[string]interface{}{"type": "replication", "replication_slot": "unit_slot"}); httpStatus(err) != http.StatusConflict {
+		t.Errorf("expected a conflict binding with a slot in use, got %v", err)
+	}
+	// Nor are those created outside the broker taken over, as unbinding
+	// would drop them
+	for _, params := range []map[string]interface{}{
+		{"type": "replication", "publication": broker.MockStatic.Publication},
+		{"type": "replication", "replication_slot": broker.MockStatic.Slot},
+	} {
+		if _, err := bind(params); httpStatus(err) != http.StatusConflict {
+			t.Errorf("expected a conflict binding with %v, got %v", params, err)
+		}
+	}
+	if _, err := bind(map[string]interface{}{"predecessor_binding_id": breq.BindingID}); err == nil {
+		t.Errorf("expected an error succeeding a replication binding")
+	}
+	if _, err := bl.Unbind(&osb.UnbindRequest{InstanceID: preq.InstanceID, BindingID: breq.BindingID}, nil); err != nil {
+		t.Fatalf("error unbinding: %s", err)
+	}
+	if _, err := bind(repl); err != nil {
+		t.Errorf("expected the slot and publication of an unbound binding to be reusable: %s", err)
+	}
+}
+
+func TestUnitBindingLimits(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	plan := planDef{ID: nuuid(t), Name: "unitlimits", MaxStorageSize: "1Gi"}
+
+	plan.MaxBindingLimits = broker.RoleLimits{WorkMem: 16}
+	if err := bl.setPlans([]planDef{plan}); err == nil {
+		t.Errorf("expected an error for a work_mem cap below the minimum")
+	}
+
+	plan.MaxBindingLimits = broker.RoleLimits{ConnectionLimit: 10, StatementTimeout: time.Minute, WorkMem: 64 << 10}
+	plan.BindingLimits = broker.RoleLimits{StatementTimeout: 2 * time.Minute}
+	if err := bl.setPlans([]planDef{plan}); err == nil {
+		t.Errorf("expected an error for a default statement_timeout above the cap")
+	}
+
+	plan.BindingLimits = broker.RoleLimits{StatementTimeout: time.Minute}
+	if err := bl.setPlans([]planDef{plan}); err != nil {
+		t.Fatalf("error setting plans: %s", err)
+	}
+	preq := provisionInstance(t, bl, plan.ID, "unitlimits", nil)
+
+	for _, params := range []map[string]interface{}{
+		{"connection_limit": 0},
+		{"connection_limit": 11},
+		{"statement_timeout": "2m"},
+		{"statement_timeout": "forever"},
+		{"idle_in_transaction_session_timeout": "0s"},
+		{"work_mem": "128MB"},
+		{"work_mem": "32kB"},
+		{"work_mem": "64mb"},
+	} {
+		breq := &osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t), PlanID: preq.PlanID, Parameters: params}
+		if _, err := bl.Bind(breq, nil); err == nil {
+			t.Errorf("expected an error binding with %v", params)
+		}
+	}
+
+	// Bindings not setting their own limits get those configured for the
+	// plan, not its caps
+	resp, err := bl.Bind(&osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t), PlanID: preq.PlanID}, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	expected := map[string]interface{}{"statement_timeout": "1m0s"}
+	if limits := resp.Credentials["limits"]; !reflect.DeepEqual(limits, expected) {
+		t.Errorf("expected limits %v, got %v", expected, limits)
+	}
+
+	breq := &osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+		PlanID:     preq.PlanID,
+		Parameters: map[string]interface{}{
+			"connection_limit":                    5,
+			"idle_in_transaction_session_timeout": "30s",
+			"work_mem":                            "4096kB",
+			"credentials_format":                  "servicebinding",
+		},
+	}
+	resp, err = bl.Bind(breq, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	for k, v := range map[string]string{
+		"connection-limit":                    "5",
+		"statement-timeout":                   "1m0s",
+		"idle-in-transaction-session-timeout": "30s",
+		"work-mem":                            "4MB",
+	} {
+		if resp.Credentials[k] != v {
+			t.Errorf("expected %s of %q, got %v", k, v, resp.Credentials[k])
+		}
+	}
+	recs, err := bl.Broker.ListBindings(preq.InstanceID)
+	if err != nil {
+		t.Fatalf("error listing bindings: %s", err)
+	}
+	for _, rec := range recs {
+		if rec.BindingID == breq.BindingID && (rec.Limits == nil || rec.Limits.ConnectionLimit != 5 || rec.Limits.WorkMem != 4096) {
+			t.Errorf("expected the binding to record its limits, got %+v", rec.Limits)
+		}
+	}
+
+	breq.Parameters["connection_limit"] = 6
+	if _, err := bl.Bind(breq, nil); httpStatus(err) != http.StatusConflict {
+		t.Errorf("expected a conflict binding again with other limits, got %v", err)
+	}
+}
+
+func TestUnitBindingLimitsCredentials(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	bl := mockLogic(t)
+	preq := provisionInstance(t, bl, "86064792-7ea2-467b-af93-ac9694d96d5c", "unitinstance", nil)
+
+	// The caps of the built-in plans are not applied to bindings which do
+	// not ask for limits
+	resp, err := bl.Bind(&osb.BindRequest{InstanceID: preq.InstanceID, BindingID: nuuid(t), PlanID: preq.PlanID}, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	if limits, ok := resp.Credentials["limits"]; ok {
+		t.Errorf("expected no limits without asking for them, got %v", limits)
+	}
+	recs, err := bl.Broker.ListBindings(preq.InstanceID)
+	if err != nil || len(recs) != 1 || recs[0].Limits != nil {
+		t.Errorf("expected a binding recorded without limits, got %v (%v)", recs, err)
+	}
+
+	resp, err = bl.Bind(&osb.BindRequest{
+		InstanceID: preq.InstanceID,
+		BindingID:  nuuid(t),
+		PlanID:     preq.PlanID,
+		Parameters: map[string]interface{}{"connection_limit": 5},
+	}, nil)
+	if err != nil {
+		t.Fatalf("error binding: %s", err)
+	}
+	expected := map[string]interface{}{"connection_limit": "5"}
+	if limits := resp.Credentials["limits"]; !reflect.DeepEqual(limits, expected) {
+		t.Errorf("expected limits %v, got %v", expected, limits)
+	}
+}
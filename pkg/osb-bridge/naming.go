@@ -0,0 +1,171 @@
+package bridge
+
+/*
+Copyright 2018-2021 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/crunchydata/pgo-osb/pkg/broker"
+)
+
+// Sources for deriving the namespace of a new cluster when PGO_NAMESPACE is
+// omitted
+const (
+	namespaceFromNone    = ""
+	namespaceFromContext = "context"
+	namespaceFromFixed   = "fixed"
+	namespaceFromPolicy  = "policy"
+)
+
+// Sources for deriving the name of a new cluster when PGO_CLUSTERNAME is
+// omitted
+const (
+	clusterNameFromNone         = ""
+	clusterNameFromInstanceID   = "instance-id"
+	clusterNameFromInstanceName = "instance-name"
+)
+
+// derivedNamePrefix is prepended to derived cluster names, ensuring they
+// start with a letter and are recognizable as created by the broker
+const derivedNamePrefix = "osb-"
+
+// namingRules determines how the cluster name and namespace are derived
+// for provision requests that omit them
+type namingRules struct {
+	namespaceFrom   string
+	namespace       string
+	clusterNameFrom string
+}
+
+func newNamingRules(o Options) (namingRules, error) {
+	r := namingRules{
+		namespaceFrom:   o.NamespaceFrom,
+		namespace:       o.FixedNamespace,
+		clusterNameFrom: o.ClusterNameFrom,
+	}
+
+	switch r.namespaceFrom {
+	case namespaceFromNone, namespaceFromContext, namespaceFromPolicy:
+	case namespaceFromFixed:
+		if r.namespace == "" {
+			return r, fmt.Errorf("a fixed namespace is required when deriving namespaces with %q", r.namespaceFrom)
+		}
+	default:
+		return r, fmt.Errorf("unknown namespace source %q", r.namespaceFrom)
+	}
+
+	switch r.clusterNameFrom {
+	case clusterNameFromNone, clusterNameFromInstanceID, clusterNameFromInstanceName:
+	default:
+		return r, fmt.Errorf("unknown cluster name source %q", r.clusterNameFrom)
+	}
+
+	return r, nil
+}
+
+// requiredParams lists the provision parameters which cannot be derived and
+// must therefore be provided by the caller
+func (r namingRules) requiredParams() []string {
+	var req []string
+	if r.clusterNameFrom == clusterNameFromNone {
+		req = append(req, paramClusterName)
+	}
+	if r.namespaceFrom == namespaceFromNone {
+		req = append(req, paramNamespace)
+	}
+	return req
+}
+
+// apply fills in the cluster name and namespace of rp when omitted, based
+// on the instance ID and OSB context of the provision request. policyNS is
+// the namespace assigned to the tenant by the namespace policy, if any
+func (r namingRules) apply(rp *provReqParams, instanceID string, osbContext map[string]interface{}, policyNS string) error {
+	var violations []string
+
+	if rp.Namespace == "" {
+		switch r.namespaceFrom {
+		case namespaceFromContext:
+			rp.Namespace = contextString(osbContext, "namespace")
+			if rp.Namespace == "" {
+				violations = append(violations, paramNamespace+": not provided and no namespace in request context")
+			}
+		case namespaceFromFixed:
+			rp.Namespace = r.namespace
+		case namespaceFromPolicy:
+			rp.Namespace = policyNS
+			if rp.Namespace == "" {
+				violations = append(violations, paramNamespace+": not provided and the namespace policy does not assign a single namespace")
+			}
+		}
+	}
+
+	if rp.ClusterName == "" {
+		switch r.clusterNameFrom {
+		case clusterNameFromInstanceID:
+			rp.ClusterName = dnsSafeName(derivedNamePrefix + instanceID)
+		case clusterNameFromInstanceName:
+			if name := contextString(osbContext, "instance_name"); name != "" {
+				rp.ClusterName = dnsSafeName(name)
+			} else {
+				rp.ClusterName = dnsSafeName(derivedNamePrefix + instanceID)
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return broker.ErrInvalidParams{Violations: violations}
+	}
+
+	return nil
+}
+
+// contextString returns the string value of key in the OSB request context,
+// or an empty string when missing
+func contextString(osbContext map[string]interface{}, key string) string {
+	if osbContext == nil {
+		return ""
+	}
+	s, _ := osbContext[key].(string)
+	return s
+}
+
+// dnsSafeName converts s into a name matching clusterNamePattern by
+// lowercasing it, replacing disallowed characters with dashes and truncating
+// it to clusterNameMaxLength
+func dnsSafeName(s string) string {
+	var b strings.Builder
+	lastDash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			lastDash = false
+		} else if !lastDash && b.Len() > 0 {
+			b.WriteRune('-')
+			lastDash = true
+		}
+	}
+
+	name := b.String()
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = derivedNamePrefix + name
+	}
+	if len(name) > clusterNameMaxLength {
+		name = name[:clusterNameMaxLength]
+	}
+
+	return strings.TrimRight(name, "-")
+}
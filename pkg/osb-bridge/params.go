@@ -16,39 +16,772 @@ limitations under the License.
 */
 
 import (
-	"log"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crunchydata/pgo-osb/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
+// Parameter names accepted in requests
+const (
+	paramClusterName   = "PGO_CLUSTERNAME"
+	paramNamespace     = "PGO_NAMESPACE"
+	paramStorageSize   = "PGO_STORAGE_SIZE"
+	paramStorageConfig = "PGO_STORAGE_CONFIG"
+	paramImageTag      = "PGO_CCP_IMAGE_TAG"
+	paramPgBouncer     = "PGO_PGBOUNCER"
+	paramTLSSecret     = "PGO_TLS_SECRET"
+	paramCASecret      = "PGO_CA_SECRET"
+	paramTLSOnly       = "PGO_TLS_ONLY"
+	paramCustomConfig  = "PGO_CUSTOM_CONFIG"
+	paramLabels        = "PGO_LABELS"
+	paramRestoreFrom   = "restore_from_instance_id"
+	paramRestoreTarget = "restore_target"
+	paramStandbyOf     = "standby_of_instance_id"
+	paramPromote       = "promote"
+	paramFinalBackup   = "final_backup"
+	paramBackupDays    = "backup_retention_days"
+	paramDeleteData    = "delete_data"
+	paramProtection    = "deletion_protection"
+	paramPublicSchema  = "restrict_public_schema"
+	paramRole          = "role"
+	paramIsolation     = "isolation"
+	paramKeepOnUnbind  = "keep_on_unbind"
+	paramCredsFormat   = "credentials_format"
+	paramEndpoints     = "include_endpoints"
+	paramEndpoint      = "endpoint"
+	paramPgBouncerBind = "pgbouncer"
+	paramNetworkPolicy = "network_policy"
+	paramLifetime      = "lifetime"
+	paramPredecessor   = "predecessor_binding_id"
+	paramClientCert    = "client_certificate"
+	paramBindingType   = "type"
+	paramPublication   = "publication"
+	paramSlot          = "replication_slot"
+	paramConnLimit     = "connection_limit"
+	paramStmtTimeout   = "statement_timeout"
+	paramIdleTimeout   = "idle_in_transaction_session_timeout"
+	paramWorkMem       = "work_mem"
+)
+
+const (
+	// dns1123LabelPattern matches names usable as Kubernetes namespaces
+	dns1123LabelPattern = "^[a-z0-9]([-a-z0-9]*[a-z0-9])?$"
+	// clusterNamePattern matches names usable as a cluster name, which must
+	// also be valid as Service names and therefore start with a letter
+	clusterNamePattern = "^[a-z]([-a-z0-9]*[a-z0-9])?$"
+	// clusterNameMaxLength leaves room for the suffixes the operator appends
+	// to cluster names, e.g. "-backrest-shared-repo", within the 63
+	// character limit of a Service name
+	clusterNameMaxLength = 42
+	// maxBackupDays limits how long backups are kept after deprovisioning
+	maxBackupDays = 365
+	// dns1123SubdomainPattern matches names usable for Secrets and ConfigMaps
+	dns1123SubdomainPattern = "^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$"
+	// storageSizePattern matches the binary quantities accepted as storage
+	// sizes, which keeps them comparable against plan limits
+	storageSizePattern = "^[1-9][0-9]*(Mi|Gi|Ti)$"
+	// imageTagPattern matches container image tags
+	imageTagPattern = "^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$"
+	// labelValuePattern matches Kubernetes label values
+	labelValuePattern = "^([A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?)?$"
+	// slotNamePattern matches the names allowed for replication slots, which
+	// publications of replication bindings are restricted to as well
+	slotNamePattern = "^[a-z0-9_]{1,63}$"
+	// bindingTypeApp is the type of bindings connecting apps, which the
+	// broker leaves empty
+	bindingTypeApp = "app"
+	// workMemPattern matches work_mem sizes in the units PostgreSQL accepts
+	// for memory settings
+	workMemPattern = "^[1-9][0-9]*(kB|MB|GB)$"
+)
+
+// labelKeyRegexp matches Kubernetes label keys, an optional DNS subdomain
+// prefix followed by a name. JSON Schema draft-04 cannot constrain the keys
+// of an object, so these are checked separately from the schema
+var labelKeyRegexp = regexp.MustCompile("^([a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$")
+
+// The schemas below are the single source of the parameters accepted for
+// each plan and operation. They are published in the catalog and every
+// incoming parameters map is validated against them before it is unpacked
+
+// protectionSchema is shared by the provision and update schemas
+var protectionSchema = map[string]interface{}{
+	"type":        "boolean",
+	"description": "Prevent the instance from being deprovisioned until disabled",
+}
+
+// provisionSchema returns the JSON Schema for provision parameters
+func (b *BusinessLogic) provisionSchema(plan planDef) map[string]interface{} {
+	return objectSchema(map[string]interface{}{
+		paramClusterName: map[string]interface{}{
+			"type":        "string",
+			"description": "Name of the PostgreSQL cluster to create",
+			"pattern":     clusterNamePattern,
+			"maxLength":   clusterNameMaxLength,
+		},
+		paramNamespace: map[string]interface{}{
+			"type":        "string",
+			"description": "Namespace to create the PostgreSQL cluster in",
+			"pattern":     dns1123LabelPattern,
+			"maxLength":   63,
+		},
+		paramStorageSize: map[string]interface{}{
+			"type":        "string",
+			"description": "Size of the PostgreSQL data volume, at most " + plan.MaxStorageSize + " for this plan",
+			"pattern":     storageSizePattern,
+		},
+		paramStorageConfig: map[string]interface{}{
+			"type":        "string",
+			"description": "Operator storage configuration, selecting the storage class of the data volume",
+			"enum":        stringEnum(plan.StorageConfigs),
+		},
+		paramImageTag: map[string]interface{}{
+			"type":        "string",
+			"description": "Crunchy Container Suite image tag, selecting the PostgreSQL version, e.g. ubi8-13.3-4.7.0",
+			"pattern":     imageTagPattern,
+		},
+		paramPgBouncer: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Deploy pgBouncer in front of the cluster",
+		},
+		paramTLSSecret: map[string]interface{}{
+			"type":        "string",
+			"description": "Secret holding the TLS key pair for the server, requires " + paramCASecret,
+			"pattern":     dns1123SubdomainPattern,
+			"maxLength":   253,
+		},
+		paramCASecret: map[string]interface{}{
+			"type":        "string",
+			"description": "Secret holding the CA used to verify TLS clients, requires " + paramTLSSecret,
+			"pattern":     dns1123SubdomainPattern,
+			"maxLength":   253,
+		},
+		paramTLSOnly: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Only accept TLS connections, requires " + paramTLSSecret,
+		},
+		paramCustomConfig: map[string]interface{}{
+			"type":        "string",
+			"description": "ConfigMap holding a custom postgresql.conf and pg_hba.conf",
+			"pattern":     dns1123SubdomainPattern,
+			"maxLength":   253,
+		},
+		paramLabels: map[string]interface{}{
+			"type":        "object",
+			"description": "Additional labels to apply to the cluster",
+			"additionalProperties": map[string]interface{}{
+				"type":      "string",
+				"pattern":   labelValuePattern,
+				"maxLength": 63,
+			},
+		},
+		paramRestoreFrom: map[string]interface{}{
+			"type":        "string",
+			"description": "ID of an existing service instance to clone the data of",
+		},
+		paramRestoreTarget: map[string]interface{}{
+			"type":        "string",
+			"description": "RFC 3339 timestamp to restore the data of " + paramRestoreFrom + " to, defaulting to the latest backup and archived WAL",
+			"format":      "date-time",
+		},
+		paramStandbyOf: map[string]interface{}{
+			"type":        "string",
+			"description": "ID of an existing service instance to follow as a read-only standby",
+		},
+		paramFinalBackup: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Take a full backup before deleting the cluster on deprovision, which requires an asynchronous broker",
+			"default":     plan.Retention.FinalBackup && b.async,
+		},
+		paramBackupDays: map[string]interface{}{
+			"type":        "integer",
+			"description": "Days to keep backups after deprovisioning, 0 deleting them with the cluster",
+			"minimum":     0,
+			"maximum":     maxBackupDays,
+			"default":     plan.Retention.BackupDays,
+		},
+		paramDeleteData: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Delete the data volumes on deprovision, otherwise they are kept as long as the backups",
+			"default":     plan.Retention.DeleteData,
+		},
+		paramProtection: protectionSchema,
+		paramPublicSchema: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Revoke CREATE on the public schema from PUBLIC when first bound, so that only owner bindings and the instance user create objects there. Done on the first readonly binding regardless",
+			"default":     false,
+		},
+	}, b.naming.requiredParams()...)
+}
+
+// updateSchema returns the JSON Schema for update parameters
+func (b *BusinessLogic) updateSchema(plan planDef) map[string]interface{} {
+	return objectSchema(map[string]interface{}{
+		paramPromote: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Promote a standby instance so that it accepts writes",
+		},
+		paramProtection: protectionSchema,
+	})
+}
+
+// bindSchema returns the JSON Schema for bind parameters
+func (b *BusinessLogic) bindSchema(plan planDef) map[string]interface{} {
+	max := plan.MaxBindingLimits
+	connLimit := map[string]interface{}{
+		"type":        "integer",
+		"description": "Most connections the binding may open at once",
+		"minimum":     1,
+	}
+	if max.ConnectionLimit > 0 {
+		connLimit["maximum"] = max.ConnectionLimit
+	}
+	if n := plan.BindingLimits.ConnectionLimit; n > 0 {
+		connLimit["default"] = n
+	}
+
+	return objectSchema(map[string]interface{}{
+		paramRole: map[string]interface{}{
+			"type":        "string",
+			"description": "Privileges of the binding on the instance database: readonly, readwrite, or owner to also create and alter objects. Bindings of standbys are readonly",
+			"enum":        []interface{}{string(broker.AccessReadOnly), string(broker.AccessReadWrite), string(broker.AccessOwner)},
+			"default":     string(broker.AccessOwner),
+		},
+		paramIsolation: map[string]interface{}{
+			"type":        "string",
+			"description": "Where the binding's data lives: the shared instance database, or a schema or database dedicated to the binding, which require the owner role",
+			"enum":        []interface{}{string(broker.IsolationShared), string(broker.IsolationSchema), string(broker.IsolationDatabase)},
+			"default":     string(plan.bindingIsolation()),
+		},
+		paramKeepOnUnbind: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Keep the schema or database of an isolated binding when it is unbound",
+			"default":     false,
+		},
+		paramEndpoint: map[string]interface{}{
+			"type":        "string",
+			"description": "How bindings reach the instance: auto for its external IP or ClusterIP, or its service-dns name, cluster-ip, load-balancer, node-port or OpenShift route",
+			"enum":        stringEnum(endpointStrategies),
+			"default":     plan.endpoint(),
+		},
+		paramPgBouncerBind: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Connect through the pgBouncer of the instance, which must have been provisioned with " + paramPgBouncer,
+			"default":     false,
+		},
+		paramNetworkPolicy: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Admit only the namespace of the bound app, taken from the request context, to the instance with a NetworkPolicy removed on unbind",
+			"default":     false,
+		},
+		paramClientCert: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Authenticate with a TLS client certificate instead of a password, for instances with TLS whose " + paramCASecret + " holds the broker's client CA",
+			"default":     false,
+		},
+		paramBindingType: map[string]interface{}{
+			"type":        "string",
+			"description": "What the binding is for: app, monitoring for a member of pg_monitor only, or replication for a role with the REPLICATION attribute that reads the instance database",
+			"enum":        []interface{}{bindingTypeApp, string(broker.BindingMonitoring), string(broker.BindingReplication)},
+			"default":     bindingTypeApp,
+		},
+		paramPublication: map[string]interface{}{
+			"type":        "string",
+			"description": "Publication of all tables of the instance database to create for a replication binding and drop on unbind",
+			"pattern":     slotNamePattern,
+		},
+		paramSlot: map[string]interface{}{
+			"type":        "string",
+			"description": "Logical replication slot using pgoutput to create for a replication binding and drop on unbind, which requires wal_level logical",
+			"pattern":     slotNamePattern,
+		},
+		paramConnLimit: connLimit,
+		paramStmtTimeout: map[string]interface{}{
+			"type":        "string",
+			"description": "Longest a statement of the binding may run, as a duration such as 30s",
+		},
+		paramIdleTimeout: map[string]interface{}{
+			"type":        "string",
+			"description": "Longest a session of the binding may be idle in a transaction, as a duration such as 5m",
+		},
+		paramWorkMem: map[string]interface{}{
+			"type":        "string",
+			"description": "Memory each sort or hash of the binding's queries may use, such as 64MB",
+			"pattern":     workMemPattern,
+		},
+		paramLifetime: map[string]interface{}{
+			"type":        "string",
+			"description": "How long the binding may be used, as a duration such as 720h, after which its role can no longer log in and is dropped",
+		},
+		paramPredecessor: map[string]interface{}{
+			"type":        "string",
+			"description": "Binding this one replaces, whose role, isolation and schema or database it takes over",
+		},
+		paramCredsFormat: map[string]interface{}{
+			"type":        "string",
+			"description": "Keys of the returned credentials: osb for the broker's own, servicebinding for servicebinding.io ones with JDBC URL, DSN, TLS and replica variants, or all for both",
+			"enum":        []interface{}{credsFormatOSB, credsFormatServiceBinding, credsFormatAll},
+			"default":     credsFormatOSB,
+		},
+		paramEndpoints: map[string]interface{}{
+			"type":        "boolean",
+			"description": "Add the hosts and ports of the binding to the osb credentials as endpoints, for platforms generating network policies from them",
+			"default":     false,
+		},
+	})
+}
+
+// planSchemas returns the schemas published in the catalog for a plan
+func (b *BusinessLogic) planSchemas(plan planDef) *osb.Schemas {
+	return &osb.Schemas{
+		ServiceInstance: &osb.ServiceInstanceSchema{
+			Create: &osb.InputParametersSchema{
+				Parameters: b.provisionSchema(plan),
+			},
+			Update: &osb.InputParametersSchema{
+				Parameters: b.updateSchema(plan),
+			},
+		},
+		ServiceBinding: &osb.ServiceBindingSchema{
+			Create: &osb.RequestResponseSchema{
+				InputParametersSchema: osb.InputParametersSchema{
+					Parameters: b.bindSchema(plan),
+				},
+			},
+		},
+	}
+}
+
+// validateParams checks request parameters against schema, returning a
+// broker.ErrInvalidParams listing every violation found
+func validateParams(schema map[string]interface{}, params map[string]interface{}) error {
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	if v := validateSchema(schema, params); len(v) > 0 {
+		return broker.ErrInvalidParams{Violations: v}
+	}
+
+	return nil
+}
+
 // Many of the types present represent safe access to request payloads and
 // provide hooks for centralized unpacking and validation
 type provReqParams struct {
-	ClusterName string
-	Namespace   string
+	ClusterName   string
+	Namespace     string
+	StorageSize   string
+	StorageConfig string
+	ImageTag      string
+	PgBouncer     bool
+	TLSSecret     string
+	CASecret      string
+	TLSOnly       bool
+	CustomConfig  string
+	Labels        map[string]string
+	RestoreFrom   string
+	RestoreTarget time.Time
+	StandbyOf     string
+	Retention     broker.Retention
+	Protection    bool
+	// RestrictPublic affects all roles of the instance, so it is left off
+	// unless requested
+	RestrictPublic bool
 }
 
 // NewProvReqParams encapsulates the parameter processing for incoming
-// provision requests
-func NewProvReqParams(params map[string]interface{}) *provReqParams {
+// provision requests, validating them against the provision schema and the
+// limits of the plan before unpacking
+func NewProvReqParams(plan planDef, schema map[string]interface{}, params map[string]interface{}) (*provReqParams, error) {
+	if err := validateParams(schema, params); err != nil {
+		return nil, err
+	}
+
+	// Types are guaranteed by validation
 	rp := &provReqParams{}
-	if params == nil {
-		return rp
+	rp.ClusterName, _ = params[paramClusterName].(string)
+	rp.Namespace, _ = params[paramNamespace].(string)
+	rp.StorageSize, _ = params[paramStorageSize].(string)
+	rp.StorageConfig, _ = params[paramStorageConfig].(string)
+	rp.ImageTag, _ = params[paramImageTag].(string)
+	rp.PgBouncer, _ = params[paramPgBouncer].(bool)
+	rp.TLSSecret, _ = params[paramTLSSecret].(string)
+	rp.CASecret, _ = params[paramCASecret].(string)
+	rp.TLSOnly, _ = params[paramTLSOnly].(bool)
+	rp.CustomConfig, _ = params[paramCustomConfig].(string)
+	if labels, ok := params[paramLabels].(map[string]interface{}); ok {
+		rp.Labels = make(map[string]string, len(labels))
+		for k, v := range labels {
+			rp.Labels[k], _ = v.(string)
+		}
+	}
+
+	rp.RestoreFrom, _ = params[paramRestoreFrom].(string)
+	rp.StandbyOf, _ = params[paramStandbyOf].(string)
+
+	rp.Retention = plan.Retention
+	if fb, ok := params[paramFinalBackup].(bool); ok {
+		rp.Retention.FinalBackup = fb
+	}
+	if days, ok := toFloat(params[paramBackupDays]); ok {
+		rp.Retention.BackupDays = int(days)
+	}
+	if dd, ok := params[paramDeleteData].(bool); ok {
+		rp.Retention.DeleteData = dd
+	}
+	rp.Protection, _ = params[paramProtection].(bool)
+	rp.RestrictPublic, _ = params[paramPublicSchema].(bool)
+
+	var violations []string
+	if target, ok := params[paramRestoreTarget].(string); ok {
+		t, err := time.Parse(time.RFC3339, target)
+		if err != nil {
+			violations = append(violations, fmt.Sprintf("%s: must be an RFC 3339 timestamp", paramRestoreTarget))
+		}
+		rp.RestoreTarget = t
+	}
+
+	if v := append(violations, rp.violations(plan)...); len(v) > 0 {
+		return nil, broker.ErrInvalidParams{Violations: v}
+	}
+
+	return rp, nil
+}
+
+// synchronous drops the final backup of instances provisioned by a broker
+// handling requests synchronously, which could never deprovision them: the
+// cluster is only deleted once the backup completes, after the request. A
+// final backup requested explicitly is refused instead
+func (rp *provReqParams) synchronous(params map[string]interface{}) error {
+	if fb, _ := params[paramFinalBackup].(bool); fb {
+		return broker.ErrInvalidParams{Violations: []string{
+			fmt.Sprintf("%s: requires the broker to handle requests asynchronously", paramFinalBackup),
+		}}
+	}
+	rp.Retention.FinalBackup = false
+	return nil
+}
+
+// violations checks the constraints on provision parameters which cannot be
+// expressed in the schema
+func (rp *provReqParams) violations(plan planDef) []string {
+	var v []string
+
+	if rp.StorageSize != "" {
+		size, err := resource.ParseQuantity(rp.StorageSize)
+		max := resource.MustParse(plan.MaxStorageSize)
+		if err != nil {
+			v = append(v, fmt.Sprintf("%s: %s", paramStorageSize, err))
+		} else if size.Cmp(max) > 0 {
+			v = append(v, fmt.Sprintf("%s: must be at most %s for plan %s", paramStorageSize, plan.MaxStorageSize, plan.Name))
+		}
+	}
+
+	if (rp.TLSSecret == "") != (rp.CASecret == "") {
+		v = append(v, fmt.Sprintf("%s and %s must be provided together", paramTLSSecret, paramCASecret))
+	}
+	if rp.TLSOnly && rp.TLSSecret == "" {
+		v = append(v, fmt.Sprintf("%s: requires %s", paramTLSOnly, paramTLSSecret))
+	}
+
+	if !rp.RestoreTarget.IsZero() && rp.RestoreFrom == "" {
+		v = append(v, fmt.Sprintf("%s: requires %s", paramRestoreTarget, paramRestoreFrom))
+	}
+	if rp.Retention.FinalBackup && rp.Retention.BackupDays == 0 {
+		v = append(v, fmt.Sprintf("%s: requires %s greater than 0", paramFinalBackup, paramBackupDays))
+	}
+	if rp.StandbyOf != "" && rp.RestoreFrom != "" {
+		v = append(v, fmt.Sprintf("%s and %s cannot be combined", paramStandbyOf, paramRestoreFrom))
+	}
+
+	keys := make([]string, 0, len(rp.Labels))
+	for k := range rp.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !labelKeyRegexp.MatchString(k) {
+			v = append(v, fmt.Sprintf("%s.%s: invalid label key", paramLabels, k))
+		}
+	}
+
+	return v
+}
+
+type bindReqParams struct {
+	Access            broker.AccessLevel
+	Isolation         broker.Isolation
+	KeepOnUnbind      bool
+	CredentialsFormat string
+	IncludeEndpoints  bool
+	Endpoint          string
+	PgBouncer         bool
+	NetworkPolicy     bool
+	Lifetime          time.Duration
+	Predecessor       string
+	ClientCert        bool
+	Type              broker.BindingType
+	Publication       string
+	Slot              string
+	Limits            broker.RoleLimits
+}
+
+// NewBindReqParams validates bind parameters against the bind schema before
+// unpacking them, applying the defaults of the plan
+func NewBindReqParams(plan planDef, schema map[string]interface{}, params map[string]interface{}) (*bindReqParams, error) {
+	if err := validateParams(schema, params); err != nil {
+		return nil, err
 	}
 
-	if cn, ok := params["PGO_CLUSTERNAME"]; ok {
-		if _, ok := cn.(string); ok {
-			rp.ClusterName = cn.(string)
-		} else {
-			log.Printf("Expected type string for PGO_CLUSTERNAME, got %T instead", cn)
+	rp := &bindReqParams{
+		Access:            broker.AccessOwner,
+		Isolation:         plan.bindingIsolation(),
+		CredentialsFormat: credsFormatOSB,
+		Endpoint:          plan.endpoint(),
+	}
+	if role, ok := params[paramRole].(string); ok {
+		rp.Access = broker.AccessLevel(role)
+	}
+	if iso, ok := params[paramIsolation].(string); ok {
+		rp.Isolation = broker.Isolation(iso)
+	}
+	rp.KeepOnUnbind, _ = params[paramKeepOnUnbind].(bool)
+	if format, ok := params[paramCredsFormat].(string); ok {
+		rp.CredentialsFormat = format
+	}
+	rp.IncludeEndpoints, _ = params[paramEndpoints].(bool)
+	if endpoint, ok := params[paramEndpoint].(string); ok {
+		rp.Endpoint = endpoint
+	}
+	rp.PgBouncer, _ = params[paramPgBouncerBind].(bool)
+	rp.NetworkPolicy, _ = params[paramNetworkPolicy].(bool)
+	rp.Predecessor, _ = params[paramPredecessor].(string)
+	rp.ClientCert, _ = params[paramClientCert].(bool)
+	if t, ok := params[paramBindingType].(string); ok && t != bindingTypeApp {
+		rp.Type = broker.BindingType(t)
+	}
+	rp.Publication, _ = params[paramPublication].(string)
+	rp.Slot, _ = params[paramSlot].(string)
+
+	v := rp.typeViolations(params)
+	v = append(v, rp.limitViolations(plan, params)...)
+	rp.Lifetime = plan.MaxBindingLifetime
+	if lifetime, ok := params[paramLifetime].(string); ok {
+		d, err := time.ParseDuration(lifetime)
+		switch {
+		case err != nil || d <= 0:
+			v = append(v, fmt.Sprintf("%s: must be a positive duration", paramLifetime))
+		case plan.MaxBindingLifetime > 0 && d > plan.MaxBindingLifetime:
+			v = append(v, fmt.Sprintf("%s: must be at most %s for plan %s", paramLifetime, plan.MaxBindingLifetime, plan.Name))
+		default:
+			rp.Lifetime = d
 		}
 	}
+	if rp.Isolation != broker.IsolationShared && rp.Access != broker.AccessOwner {
+		v = append(v, fmt.Sprintf("%s: %s isolation requires the %s role", paramRole, rp.Isolation, broker.AccessOwner))
+	}
+	if rp.KeepOnUnbind && rp.Isolation == broker.IsolationShared {
+		v = append(v, fmt.Sprintf("%s: requires schema or database %s", paramKeepOnUnbind, paramIsolation))
+	}
+	if rp.ClientCert && rp.PgBouncer {
+		v = append(v, fmt.Sprintf("%s: cannot be combined with %s", paramClientCert, paramPgBouncerBind))
+	}
+	if len(v) > 0 {
+		return nil, broker.ErrInvalidParams{Violations: v}
+	}
+
+	return rp, nil
+}
 
-	if ns, ok := params["PGO_NAMESPACE"]; ok {
-		if _, ok := ns.(string); ok {
-			rp.Namespace = ns.(string)
-		} else {
-			log.Printf("Expected type string for PGO_NAMESPACE, got %T instead", ns)
+// limitViolations unpacks the limits of a binding, which default to those
+// configured for the plan and may not exceed its caps
+func (rp *bindReqParams) limitViolations(plan planDef, params map[string]interface{}) []string {
+	max := plan.MaxBindingLimits
+	rp.Limits = plan.BindingLimits
+
+	var v []string
+	if n, ok := toFloat(params[paramConnLimit]); ok {
+		// The schema bounds it by the cap of the plan
+		rp.Limits.ConnectionLimit = int(n)
+	}
+	timeouts := []struct {
+		param string
+		max   time.Duration
+		limit *time.Duration
+	}{
+		{paramStmtTimeout, max.StatementTimeout, &rp.Limits.StatementTimeout},
+		{paramIdleTimeout, max.IdleInTransactionTimeout, &rp.Limits.IdleInTransactionTimeout},
+	}
+	for _, t := range timeouts {
+		s, ok := params[t.param].(string)
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		switch {
+		case err != nil || d < time.Millisecond:
+			v = append(v, fmt.Sprintf("%s: must be a duration of at least 1ms", t.param))
+		case t.max > 0 && d > t.max:
+			v = append(v, fmt.Sprintf("%s: must be at most %s for plan %s", t.param, t.max, plan.Name))
+		default:
+			*t.limit = d
+		}
+	}
+	if s, ok := params[paramWorkMem].(string); ok {
+		kb, err := parseWorkMem(s)
+		switch {
+		case err != nil || kb < 64:
+			v = append(v, fmt.Sprintf("%s: must be at least 64kB", paramWorkMem))
+		case max.WorkMem > 0 && kb > max.WorkMem:
+			v = append(v, fmt.Sprintf("%s: must be at most %s for plan %s", paramWorkMem, formatWorkMem(max.WorkMem), plan.Name))
+		default:
+			rp.Limits.WorkMem = kb
+		}
+	}
+
+	return v
+}
+
+// workMemUnits are the multiples of a kB of the units of workMemPattern
+var workMemUnits = map[string]int{"kB": 1, "MB": 1 << 10, "GB": 1 << 20}
+
+// parseWorkMem returns a size matching workMemPattern in kB
+func parseWorkMem(s string) (int, error) {
+	for unit, kb := range workMemUnits {
+		if strings.HasSuffix(s, unit) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, unit))
+			if err != nil || n > math.MaxInt32/kb {
+				return 0, fmt.Errorf("invalid size %q", s)
+			}
+			return n * kb, nil
 		}
 	}
+	return 0, fmt.Errorf("invalid size %q", s)
+}
+
+// formatWorkMem returns a size in kB in the largest unit dividing it
+func formatWorkMem(kb int) string {
+	switch {
+	case kb%workMemUnits["GB"] == 0:
+		return fmt.Sprintf("%dGB", kb/workMemUnits["GB"])
+	case kb%workMemUnits["MB"] == 0:
+		return fmt.Sprintf("%dMB", kb/workMemUnits["MB"])
+	default:
+		return fmt.Sprintf("%dkB", kb)
+	}
+}
 
-	return rp
+// typeViolations checks the parameters of monitoring and replication
+// bindings, which connect to the instance database with privileges of their
+// own rather than those of a role. It runs ahead of the other checks, which
+// then apply to the access level and isolation of those bindings
+func (rp *bindReqParams) typeViolations(params map[string]interface{}) []string {
+	var v []string
+	if rp.Type == "" {
+		if rp.Publication != "" {
+			v = append(v, fmt.Sprintf("%s: requires %s %s", paramPublication, paramBindingType, broker.BindingReplication))
+		}
+		if rp.Slot != "" {
+			v = append(v, fmt.Sprintf("%s: requires %s %s", paramSlot, paramBindingType, broker.BindingReplication))
+		}
+		return v
+	}
+
+	if _, ok := params[paramRole]; ok {
+		v = append(v, fmt.Sprintf("%s: cannot be combined with %s %s", paramRole, paramBindingType, rp.Type))
+	}
+	if _, ok := params[paramIsolation]; ok && rp.Isolation != broker.IsolationShared {
+		v = append(v, fmt.Sprintf("%s: %s bindings require %s isolation", paramIsolation, rp.Type, broker.IsolationShared))
+	}
+	if rp.PgBouncer && rp.Type == broker.BindingReplication {
+		v = append(v, fmt.Sprintf("%s: cannot be combined with %s %s", paramPgBouncerBind, paramBindingType, rp.Type))
+	}
+	if rp.Type == broker.BindingMonitoring && (rp.Publication != "" || rp.Slot != "") {
+		v = append(v, fmt.Sprintf("%s and %s: require %s %s", paramPublication, paramSlot, paramBindingType, broker.BindingReplication))
+	}
+	// Privileges of their own are granted in place of an access level, in
+	// the instance database whatever the plan isolates bindings to
+	rp.Access, rp.Isolation = broker.AccessReadOnly, broker.IsolationShared
+
+	return v
+}
+
+// inherit gives a successor binding the privileges of its predecessor.
+// Parameters set by the request must agree with them
+func (rp *bindReqParams) inherit(pred broker.BindingRecord, params map[string]interface{}) error {
+	// Records made before access levels existed are for owners
+	access, isolation := pred.Access, pred.Isolation
+	if access == "" {
+		access = broker.AccessOwner
+	}
+	if isolation == "" {
+		isolation = broker.IsolationShared
+	}
+
+	// The slot and publication of a binding are dropped with it, so typed
+	// bindings are rotated rather than succeeded
+	if pred.Type != "" || rp.Type != "" {
+		return broker.ErrInvalidParams{Violations: []string{fmt.Sprintf("%s: only app bindings can be succeeded", paramPredecessor)}}
+	}
+
+	var v []string
+	if _, ok := params[paramRole]; ok && rp.Access != access {
+		v = append(v, fmt.Sprintf("%s: binding %s has the %s role", paramRole, pred.BindingID, access))
+	}
+	if _, ok := params[paramIsolation]; ok && rp.Isolation != isolation {
+		v = append(v, fmt.Sprintf("%s: binding %s has %s isolation", paramIsolation, pred.BindingID, isolation))
+	}
+	if len(v) > 0 {
+		return broker.ErrInvalidParams{Violations: v}
+	}
+	rp.Access, rp.Isolation = access, isolation
+	if _, ok := params[paramKeepOnUnbind]; !ok {
+		rp.KeepOnUnbind = pred.KeepOnUnbind
+	}
+	if _, ok := params[paramClientCert]; !ok {
+		rp.ClientCert = pred.ClientCert
+	}
+
+	return nil
+}
+
+// standby confines a binding of a standby to reading the instance
+// database. The roles of standbys are created on their source, where any
+// other role or isolation would let the binding write. Parameters set by the
+// request must agree
+func (rp *bindReqParams) standby(params map[string]interface{}) error {
+	var v []string
+	if _, ok := params[paramRole]; ok && rp.Access != broker.AccessReadOnly {
+		v = append(v, fmt.Sprintf("%s: bindings of a standby have the %s role", paramRole, broker.AccessReadOnly))
+	}
+	if _, ok := params[paramIsolation]; ok && rp.Isolation != broker.IsolationShared {
+		v = append(v, fmt.Sprintf("%s: bindings of a standby have %s isolation", paramIsolation, broker.IsolationShared))
+	}
+	if rp.KeepOnUnbind {
+		v = append(v, fmt.Sprintf("%s: bindings of a standby have %s isolation", paramKeepOnUnbind, broker.IsolationShared))
+	}
+	if len(v) > 0 {
+		return broker.ErrInvalidParams{Violations: v}
+	}
+	rp.Access, rp.Isolation = broker.AccessReadOnly, broker.IsolationShared
+
+	return nil
+}
+
+// stringEnum converts values for use as a JSON Schema enum
+func stringEnum(values []string) []interface{} {
+	e := make([]interface{}, 0, len(values))
+	for _, s := range values {
+		e = append(e, s)
+	}
+	return e
 }
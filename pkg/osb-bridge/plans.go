@@ -0,0 +1,351 @@
+package bridge
+
+/*
+Copyright 2018-2021 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/crunchydata/pgo-osb/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// planDef describes a plan offered in the catalog. Some platforms (PCF) do
+// not cope with plan names or IDs changing or going away, so existing
+// entries should be left as they are
+type planDef struct {
+	ID          string
+	Name        string
+	Description string
+
+	// MaxStorageSize is the largest PGO_STORAGE_SIZE which may be requested
+	MaxStorageSize string
+	// StorageConfigs are the operator storage configurations which may be
+	// requested with PGO_STORAGE_CONFIG
+	StorageConfigs []string
+	// Retention applies to instances which do not set their own
+	Retention broker.Retention
+	// BindingIsolation applies to bindings which do not set their own,
+	// broker.IsolationShared when empty
+	BindingIsolation broker.Isolation
+	// Endpoint is the endpoint strategy of bindings which do not set their
+	// own, endpointAuto when empty
+	Endpoint string
+	// MaxBindingLifetime limits how long bindings may be used when greater
+	// than zero, and is the lifetime of bindings which do not set their own
+	MaxBindingLifetime time.Duration
+	// PasswordPolicy constrains the passwords of bindings, which are
+	// generated by the operator when it is the zero value
+	PasswordPolicy broker.PasswordPolicy
+	// MaxBindingLimits cap the limits bindings may ask for. Zero fields
+	// leave the limit uncapped
+	MaxBindingLimits broker.RoleLimits
+	// BindingLimits are the limits of bindings which do not set their own,
+	// within MaxBindingLimits. Zero fields leave the instance settings in
+	// place
+	BindingLimits broker.RoleLimits
+}
+
+// endpoint returns the endpoint strategy of bindings not requesting one
+func (p planDef) endpoint() string {
+	if p.Endpoint == "" {
+		return endpointAuto
+	}
+	return p.Endpoint
+}
+
+// bindingIsolation returns the isolation of bindings not requesting one
+func (p planDef) bindingIsolation() broker.Isolation {
+	if p.BindingIsolation == "" {
+		return broker.IsolationShared
+	}
+	return p.BindingIsolation
+}
+
+// Limits shared by plans of the same size
+var (
+	smallStorageConfigs  = []string{"osbsmall"}
+	mediumStorageConfigs = []string{"osbsmall", "osbmedium"}
+	largeStorageConfigs  = []string{"osbsmall", "osbmedium", "osblarge"}
+
+	smallRetention  = broker.Retention{BackupDays: 7, DeleteData: true}
+	mediumRetention = broker.Retention{FinalBackup: true, BackupDays: 14, DeleteData: true}
+	largeRetention  = broker.Retention{FinalBackup: true, BackupDays: 30, DeleteData: true}
+
+	// Statements are left uncapped, as apps running reports or migrations
+	// would otherwise have no way around the cap
+	smallBindingLimits  = broker.RoleLimits{ConnectionLimit: 20, IdleInTransactionTimeout: time.Hour, WorkMem: 64 << 10}
+	mediumBindingLimits = broker.RoleLimits{ConnectionLimit: 40, IdleInTransactionTimeout: time.Hour, WorkMem: 256 << 10}
+	largeBindingLimits  = broker.RoleLimits{ConnectionLimit: 80, IdleInTransactionTimeout: time.Hour, WorkMem: 1 << 20}
+)
+
+// standardPasswordPolicy applies to the bindings of all plans. The symbols
+// drawn from are escaped or quoted in every connection string returned
+var standardPasswordPolicy = broker.PasswordPolicy{
+	Length:    32,
+	Classes:   []broker.CharClass{broker.CharLower, broker.CharUpper, broker.CharDigit, broker.CharSymbol},
+	SCRAMOnly: true,
+}
+
+var planDefs = []planDef{
+	{
+		ID:               "86064792-7ea2-467b-af93-ac9694d96d5c",
+		Name:             "default",
+		Description:      "The default plan for the pgo osb service",
+		MaxStorageSize:   "10Gi",
+		StorageConfigs:   smallStorageConfigs,
+		Retention:        smallRetention,
+		PasswordPolicy:   standardPasswordPolicy,
+		MaxBindingLimits: smallBindingLimits,
+	},
+	{
+		ID:               "885a1cb6-ca42-43e9-a725-8195918e1343",
+		Name:             "standalone_sm",
+		Description:      "Small postgres server, no replicas",
+		MaxStorageSize:   "10Gi",
+		StorageConfigs:   smallStorageConfigs,
+		Retention:        smallRetention,
+		PasswordPolicy:   standardPasswordPolicy,
+		MaxBindingLimits: smallBindingLimits,
+	},
+	{
+		ID:               "dc951396-bb28-45a4-b040-cfe3bebc6121",
+		Name:             "standalone_md",
+		Description:      "Medium postgres server, no replicas",
+		MaxStorageSize:   "100Gi",
+		StorageConfigs:   mediumStorageConfigs,
+		Retention:        mediumRetention,
+		PasswordPolicy:   standardPasswordPolicy,
+		MaxBindingLimits: mediumBindingLimits,
+	},
+	{
+		ID:               "04349656-4dc9-4b67-9b15-52a93d64d566",
+		Name:             "standalone_lg",
+		Description:      "Large postgres server, no replicas",
+		MaxStorageSize:   "500Gi",
+		StorageConfigs:   largeStorageConfigs,
+		Retention:        largeRetention,
+		PasswordPolicy:   standardPasswordPolicy,
+		MaxBindingLimits: largeBindingLimits,
+	},
+	{
+		ID:               "877432f8-07eb-4e57-b984-d025a71d2282",
+		Name:             "ha_sm",
+		Description:      "Small postgres server with replicas",
+		MaxStorageSize:   "10Gi",
+		StorageConfigs:   smallStorageConfigs,
+		Retention:        smallRetention,
+		PasswordPolicy:   standardPasswordPolicy,
+		MaxBindingLimits: smallBindingLimits,
+	},
+	{
+		ID:               "89bcdf8a-e637-4bb3-b7ce-aca083cc1e69",
+		Name:             "ha_md",
+		Description:      "Medium postgres server with replicas",
+		MaxStorageSize:   "100Gi",
+		StorageConfigs:   mediumStorageConfigs,
+		Retention:        mediumRetention,
+		PasswordPolicy:   standardPasswordPolicy,
+		MaxBindingLimits: mediumBindingLimits,
+	},
+	{
+		ID:               "470ca1a0-2763-41f1-a4cf-985acdb549ab",
+		Name:             "ha_lg",
+		Description:      "Large postgres server with replicas",
+		MaxStorageSize:   "500Gi",
+		StorageConfigs:   largeStorageConfigs,
+		Retention:        largeRetention,
+		PasswordPolicy:   standardPasswordPolicy,
+		MaxBindingLimits: largeBindingLimits,
+	},
+}
+
+// setPlans checks the settings of the plans offered before replacing them
+func (b *BusinessLogic) setPlans(plans []planDef) error {
+	if len(plans) == 0 {
+		return fmt.Errorf("no plans to offer")
+	}
+	for _, p := range plans {
+		if err := p.PasswordPolicy.Validate(); err != nil {
+			return fmt.Errorf("password policy of plan %s: %s", p.Name, err)
+		}
+		if err := p.MaxBindingLimits.Validate(); err != nil {
+			return fmt.Errorf("binding limits of plan %s: %s", p.Name, err)
+		}
+		if err := p.BindingLimits.Validate(); err != nil {
+			return fmt.Errorf("default binding limits of plan %s: %s", p.Name, err)
+		}
+		if err := limitsWithin(p.BindingLimits, p.MaxBindingLimits); err != nil {
+			return fmt.Errorf("default binding limits of plan %s: %s", p.Name, err)
+		}
+	}
+	b.plans = plans
+	return nil
+}
+
+// limitsWithin checks that the limits l do not exceed the caps max, so that
+// bindings are not given defaults they could not ask for
+func limitsWithin(l, max broker.RoleLimits) error {
+	switch {
+	case max.ConnectionLimit > 0 && l.ConnectionLimit > max.ConnectionLimit:
+		return fmt.Errorf("%s exceeds the cap of %d", paramConnLimit, max.ConnectionLimit)
+	case max.StatementTimeout > 0 && l.StatementTimeout > max.StatementTimeout:
+		return fmt.Errorf("%s exceeds the cap of %s", paramStmtTimeout, max.StatementTimeout)
+	case max.IdleInTransactionTimeout > 0 && l.IdleInTransactionTimeout > max.IdleInTransactionTimeout:
+		return fmt.Errorf("%s exceeds the cap of %s", paramIdleTimeout, max.IdleInTransactionTimeout)
+	case max.WorkMem > 0 && l.WorkMem > max.WorkMem:
+		return fmt.Errorf("%s exceeds the cap of %s", paramWorkMem, formatWorkMem(max.WorkMem))
+	}
+	return nil
+}
+
+// findPlan returns the plan definition for planID. Unknown plans are given
+// the definition of the first plan, matching the behavior of the broker
+func (b *BusinessLogic) findPlan(planID string) planDef {
+	for _, p := range b.plans {
+		if p.ID == planID {
+			return p
+		}
+	}
+	return b.plans[0]
+}
+
+// catalogPlans returns the plans as published in the catalog
+func (b *BusinessLogic) catalogPlans() []osb.Plan {
+	plans := make([]osb.Plan, 0, len(b.plans))
+	for _, p := range b.plans {
+		plans = append(plans, osb.Plan{
+			Name:        p.Name,
+			ID:          p.ID,
+			Description: p.Description,
+			Free:        truePtr(),
+			Schemas:     b.planSchemas(p),
+		})
+	}
+
+	return plans
+}
+
+// planConfig adjusts the shipped plans, keyed by plan name, as read from
+// the file passed with --plan-config
+type planConfig struct {
+	Plans map[string]planOverride `yaml:"plans"`
+}
+
+// planOverride lists the settings of a plan to replace. Settings left out
+// keep their shipped value
+type planOverride struct {
+	// MaxBindingLifetime is a duration such as 720h, 0 to lift the cap
+	MaxBindingLifetime string                `yaml:"max_binding_lifetime"`
+	PasswordPolicy     *passwordPolicyConfig `yaml:"password_policy"`
+	MaxBindingLimits   *bindingLimitsConfig  `yaml:"max_binding_limits"`
+	BindingLimits      *bindingLimitsConfig  `yaml:"binding_limits"`
+}
+
+type passwordPolicyConfig struct {
+	Length    int                `yaml:"length"`
+	Classes   []broker.CharClass `yaml:"classes"`
+	SCRAMOnly bool               `yaml:"scram_only"`
+}
+
+// bindingLimitsConfig takes the limits in the format of the bind parameters
+// setting them. Limits left out are uncapped, or unset by default
+type bindingLimitsConfig struct {
+	ConnectionLimit          int    `yaml:"connection_limit"`
+	StatementTimeout         string `yaml:"statement_timeout"`
+	IdleInTransactionTimeout string `yaml:"idle_in_transaction_session_timeout"`
+	WorkMem                  string `yaml:"work_mem"`
+}
+
+func (c bindingLimitsConfig) limits() (broker.RoleLimits, error) {
+	l := broker.RoleLimits{ConnectionLimit: c.ConnectionLimit}
+	var err error
+	if c.StatementTimeout != "" {
+		if l.StatementTimeout, err = time.ParseDuration(c.StatementTimeout); err != nil {
+			return l, fmt.Errorf("%s: %s", paramStmtTimeout, err)
+		}
+	}
+	if c.IdleInTransactionTimeout != "" {
+		if l.IdleInTransactionTimeout, err = time.ParseDuration(c.IdleInTransactionTimeout); err != nil {
+			return l, fmt.Errorf("%s: %s", paramIdleTimeout, err)
+		}
+	}
+	if c.WorkMem != "" {
+		if l.WorkMem, err = parseWorkMem(c.WorkMem); err != nil {
+			return l, fmt.Errorf("%s: %s", paramWorkMem, err)
+		}
+	}
+	return l, nil
+}
+
+// loadPlanConfig reads a plan configuration from a YAML file
+func loadPlanConfig(path string) (planConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return planConfig{}, err
+	}
+
+	var cfg planConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return planConfig{}, fmt.Errorf("parsing plan configuration %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// apply returns a copy of plans with the settings of the configuration
+func (cfg planConfig) apply(plans []planDef) ([]planDef, error) {
+	applied := make([]planDef, len(plans))
+	copy(applied, plans)
+
+	byName := map[string]*planDef{}
+	for i := range applied {
+		byName[applied[i].Name] = &applied[i]
+	}
+	for name, o := range cfg.Plans {
+		p, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("plan configuration names unknown plan %s", name)
+		}
+		if o.MaxBindingLifetime != "" {
+			lifetime, err := time.ParseDuration(o.MaxBindingLifetime)
+			if err != nil || lifetime < 0 {
+				return nil, fmt.Errorf("max_binding_lifetime of plan %s: invalid duration %q", name, o.MaxBindingLifetime)
+			}
+			p.MaxBindingLifetime = lifetime
+		}
+		if pp := o.PasswordPolicy; pp != nil {
+			p.PasswordPolicy = broker.PasswordPolicy{Length: pp.Length, Classes: pp.Classes, SCRAMOnly: pp.SCRAMOnly}
+		}
+		if o.MaxBindingLimits != nil {
+			limits, err := o.MaxBindingLimits.limits()
+			if err != nil {
+				return nil, fmt.Errorf("max_binding_limits of plan %s: %s", name, err)
+			}
+			p.MaxBindingLimits = limits
+		}
+		if o.BindingLimits != nil {
+			limits, err := o.BindingLimits.limits()
+			if err != nil {
+				return nil, fmt.Errorf("binding_limits of plan %s: %s", name, err)
+			}
+			p.BindingLimits = limits
+		}
+	}
+	return applied, nil
+}
@@ -0,0 +1,235 @@
+package bridge
+
+/*
+Copyright 2018-2021 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/crunchydata/pgo-osb/pkg/broker"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	osblib "github.com/pmorie/osb-broker-lib/pkg/broker"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// originatingIdentityHeader carries the identity of the platform user
+	// making a request, see the OSB spec
+	originatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+	// policyAnyNamespace allows any namespace when listed in a rule
+	policyAnyNamespace = "*"
+	// policyContextNamespace is replaced with the namespace of the request
+	// context when listed in a rule
+	policyContextNamespace = "${namespace}"
+)
+
+// tenant identifies who a request was made on behalf of, as described by
+// the OSB request context and originating identity
+type tenant struct {
+	Platform         string
+	Namespace        string
+	OrganizationGUID string
+	SpaceGUID        string
+	User             string
+	Groups           []string
+}
+
+// newTenant gathers the tenant of a request. The originating identity is
+// taken from the request when provided, falling back to the raw header
+func newTenant(osbContext map[string]interface{}, orgGUID, spaceGUID string, oi *osb.OriginatingIdentity, c *osblib.RequestContext) tenant {
+	t := tenant{
+		Platform:         contextString(osbContext, "platform"),
+		Namespace:        contextString(osbContext, "namespace"),
+		OrganizationGUID: contextString(osbContext, "organization_guid"),
+		SpaceGUID:        contextString(osbContext, "space_guid"),
+	}
+	if t.OrganizationGUID == "" {
+		t.OrganizationGUID = orgGUID
+	}
+	if t.SpaceGUID == "" {
+		t.SpaceGUID = spaceGUID
+	}
+
+	if oi == nil && c != nil && c.Request != nil {
+		oi = parseOriginatingIdentity(c.Request.Header.Get(originatingIdentityHeader))
+	}
+	if oi != nil {
+		if t.Platform == "" {
+			t.Platform = oi.Platform
+		}
+		t.User, t.Groups = identityUser(oi.Value)
+	}
+
+	return t
+}
+
+// parseOriginatingIdentity unpacks the "<platform> <base64 value>" format of
+// the originating identity header
+func parseOriginatingIdentity(header string) *osb.OriginatingIdentity {
+	var platform, value string
+	if n, _ := fmt.Sscan(header, &platform, &value); n != 2 {
+		return nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		log.Printf("unable to decode originating identity: %s\n", err)
+		return nil
+	}
+
+	return &osb.OriginatingIdentity{Platform: platform, Value: string(decoded)}
+}
+
+// identityUser extracts the user and groups from the JSON value of an
+// originating identity, covering both the Kubernetes ("username", "groups")
+// and Cloud Foundry ("user_id") formats
+func identityUser(value string) (string, []string) {
+	var id struct {
+		Username string   `json:"username"`
+		UserID   string   `json:"user_id"`
+		Groups   []string `json:"groups"`
+	}
+	if err := json.Unmarshal([]byte(value), &id); err != nil {
+		log.Printf("unable to parse originating identity: %s\n", err)
+		return "", nil
+	}
+
+	if id.Username != "" {
+		return id.Username, id.Groups
+	}
+	return id.UserID, id.Groups
+}
+
+// namespacePolicy maps tenants to the namespaces they may provision into.
+// Rules are evaluated in order and the first rule matching the tenant
+// applies; tenants matching no rule may not provision at all
+type namespacePolicy struct {
+	Rules []policyRule `yaml:"rules"`
+}
+
+type policyRule struct {
+	Match      policyMatch `yaml:"match"`
+	Namespaces []string    `yaml:"namespaces"`
+}
+
+// policyMatch lists the tenant attributes a rule applies to. Empty fields
+// match any value
+type policyMatch struct {
+	Platform         string `yaml:"platform"`
+	Namespace        string `yaml:"namespace"`
+	OrganizationGUID string `yaml:"organization_guid"`
+	SpaceGUID        string `yaml:"space_guid"`
+	User             string `yaml:"user"`
+	Group            string `yaml:"group"`
+}
+
+// loadNamespacePolicy reads a namespace policy from a YAML file
+func loadNamespacePolicy(path string) (*namespacePolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &namespacePolicy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("parsing namespace policy %s: %s", path, err)
+	}
+	for i, r := range p.Rules {
+		if len(r.Namespaces) == 0 {
+			return nil, fmt.Errorf("namespace policy rule %d lists no namespaces", i)
+		}
+	}
+
+	return p, nil
+}
+
+func (m policyMatch) matches(t tenant) bool {
+	if m.Group != "" {
+		found := false
+		for _, g := range t.Groups {
+			if g == m.Group {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return matchField(m.Platform, t.Platform) &&
+		matchField(m.Namespace, t.Namespace) &&
+		matchField(m.OrganizationGUID, t.OrganizationGUID) &&
+		matchField(m.SpaceGUID, t.SpaceGUID) &&
+		matchField(m.User, t.User)
+}
+
+func matchField(want, have string) bool {
+	return want == "" || want == have
+}
+
+// namespaces returns the namespaces the tenant may use, which may include
+// policyAnyNamespace. A nil policy places no restrictions
+func (p *namespacePolicy) namespaces(t tenant) []string {
+	if p == nil {
+		return []string{policyAnyNamespace}
+	}
+
+	for _, r := range p.Rules {
+		if !r.Match.matches(t) {
+			continue
+		}
+
+		ns := make([]string, 0, len(r.Namespaces))
+		for _, n := range r.Namespaces {
+			if n == policyContextNamespace {
+				if t.Namespace == "" {
+					continue
+				}
+				n = t.Namespace
+			}
+			ns = append(ns, n)
+		}
+		return ns
+	}
+
+	return nil
+}
+
+// allow returns broker.ErrForbidden unless the tenant may use namespace
+func (p *namespacePolicy) allow(t tenant, namespace string) error {
+	for _, n := range p.namespaces(t) {
+		if n == policyAnyNamespace || n == namespace {
+			return nil
+		}
+	}
+
+	return broker.ErrForbidden{Reason: fmt.Sprintf("namespace %s is not permitted for this tenant", namespace)}
+}
+
+// defaultNamespace returns the namespace to provision into for a tenant
+// allowed a single concrete namespace, or an empty string otherwise
+func (p *namespacePolicy) defaultNamespace(t tenant) string {
+	if ns := p.namespaces(t); len(ns) == 1 && ns[0] != policyAnyNamespace {
+		return ns[0]
+	}
+	return ""
+}
@@ -0,0 +1,270 @@
+package bridge
+
+/*
+Copyright 2018-2021 Crunchy Data Solutions, Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file implements validation for the subset of JSON Schema (draft-04)
+// used by the schemas published in the catalog: type, enum, pattern,
+// minLength, maxLength, minimum, maximum, properties, required,
+// additionalProperties and items. Schemas are expressed as the same
+// map[string]interface{} values published to platforms so that what is
+// advertised is exactly what is enforced.
+
+const jsonSchemaDraft = "http://json-schema.org/draft-04/schema#"
+
+// objectSchema builds the schema of a parameters object with the given
+// properties, rejecting any parameter not listed
+func objectSchema(properties map[string]interface{}, required ...string) map[string]interface{} {
+	s := map[string]interface{}{
+		"$schema":              jsonSchemaDraft,
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+
+	return s
+}
+
+// validateSchema checks value against schema, returning a description of
+// each violation found. An empty result means the value is valid
+func validateSchema(schema map[string]interface{}, value interface{}) []string {
+	v := &schemaValidator{}
+	v.validate("", schema, value)
+	return v.violations
+}
+
+type schemaValidator struct {
+	violations []string
+}
+
+func (v *schemaValidator) addf(path, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if path == "" {
+		v.violations = append(v.violations, msg)
+	} else {
+		v.violations = append(v.violations, path+": "+msg)
+	}
+}
+
+func (v *schemaValidator) validate(path string, schema map[string]interface{}, value interface{}) {
+	if t, ok := schema["type"].(string); ok && !isSchemaType(t, value) {
+		v.addf(path, "expected type %s, got %s", t, jsonTypeName(value))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.addf(path, "must be one of %v", enum)
+		}
+	}
+
+	switch val := value.(type) {
+	case string:
+		v.validateString(path, schema, val)
+	case map[string]interface{}:
+		v.validateObject(path, schema, val)
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range val {
+				v.validate(fmt.Sprintf("%s[%d]", path, i), items, item)
+			}
+		}
+	default:
+		if n, ok := toFloat(value); ok {
+			v.validateNumber(path, schema, n)
+		}
+	}
+}
+
+func (v *schemaValidator) validateString(path string, schema map[string]interface{}, s string) {
+	l := utf8.RuneCountInString(s)
+	if min, ok := toFloat(schema["minLength"]); ok && float64(l) < min {
+		v.addf(path, "must be at least %v characters", min)
+	}
+	if max, ok := toFloat(schema["maxLength"]); ok && float64(l) > max {
+		v.addf(path, "must be at most %v characters", max)
+	}
+	if p, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			v.addf(path, "invalid pattern in schema: %s", err)
+		} else if !re.MatchString(s) {
+			v.addf(path, "must match pattern %s", p)
+		}
+	}
+}
+
+func (v *schemaValidator) validateNumber(path string, schema map[string]interface{}, n float64) {
+	if min, ok := toFloat(schema["minimum"]); ok && n < min {
+		v.addf(path, "must be at least %v", min)
+	}
+	if max, ok := toFloat(schema["maximum"]); ok && n > max {
+		v.addf(path, "must be at most %v", max)
+	}
+}
+
+func (v *schemaValidator) validateObject(path string, schema map[string]interface{}, obj map[string]interface{}) {
+	props, _ := schema["properties"].(map[string]interface{})
+
+	for _, r := range requiredNames(schema["required"]) {
+		if _, ok := obj[r]; !ok {
+			v.addf(joinPath(path, r), "is required")
+		}
+	}
+
+	// Sorted for stable, readable error descriptions
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if ps, ok := props[k].(map[string]interface{}); ok {
+			v.validate(joinPath(path, k), ps, obj[k])
+			continue
+		}
+		switch ap := schema["additionalProperties"].(type) {
+		case bool:
+			if !ap {
+				v.addf(joinPath(path, k), "unknown parameter")
+			}
+		case map[string]interface{}:
+			v.validate(joinPath(path, k), ap, obj[k])
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func requiredNames(r interface{}) []string {
+	switch names := r.(type) {
+	case []string:
+		return names
+	case []interface{}:
+		s := make([]string, 0, len(names))
+		for _, n := range names {
+			if ns, ok := n.(string); ok {
+				s = append(s, ns)
+			}
+		}
+		return s
+	}
+	return nil
+}
+
+// isSchemaType reports whether value is of the named JSON Schema type.
+// Parameters decoded from JSON hold numbers as float64, but integer types are
+// accepted to allow for values constructed in code
+func isSchemaType(t string, value interface{}) bool {
+	switch t {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "number":
+		_, ok := toFloat(value)
+		return ok
+	case "integer":
+		n, ok := toFloat(value)
+		return ok && n == math.Trunc(n)
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	if _, ok := toFloat(value); ok {
+		return "number"
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", value), "*")
+}
+
+// toFloat converts any numeric value to float64
+func toFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func jsonEqual(a, b interface{}) bool {
+	if na, ok := toFloat(a); ok {
+		nb, ok := toFloat(b)
+		return ok && na == nb
+	}
+	return reflect.DeepEqual(a, b)
+}